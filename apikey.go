@@ -0,0 +1,357 @@
+package seven5
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	s5ApiKeyPrefix = "s5k" //lets us tell an api key from a login token
+
+	API_KEY_TOUCH_INTERVAL = time.Minute
+)
+
+//ApiKey is the stored form of a personal api key.  The key itself is never
+//stored, only its Prefix (used to find the record) and the sha256 Hash of the
+//whole key.  Owner is the unique id of the user, the same value that is passed
+//to SessionManager.Assign and Generator.Generate.  Scopes is a space separated
+//list of the scopes granted to the key.  The field names are chosen to work
+//well with Qbs.
+type ApiKey struct {
+	Id       int64
+	Owner    string `qbs:"index"`
+	Name     string
+	Prefix   string `qbs:"unique"`
+	Hash     string
+	Scopes   string
+	Created  time.Time
+	LastUsed time.Time
+	Revoked  bool
+}
+
+//ScopeList returns the scopes granted to this key.
+func (self *ApiKey) ScopeList() []string {
+	return strings.Fields(self.Scopes)
+}
+
+//ApiKeyStore is the storage for api keys.  Implementations must be safe to
+//be used from multiple goroutines.  FindKeyByPrefix should return nil, nil if
+//no key has the prefix provided.  RevokeKey should return false, nil if no
+//key with the given id belongs to owner.  Revoked keys are still returned by
+//FindKeyByPrefix and ListKeys so that users can see them.
+type ApiKeyStore interface {
+	CreateKey(*ApiKey) error
+	FindKeyByPrefix(prefix string) (*ApiKey, error)
+	ListKeys(owner string) ([]*ApiKey, error)
+	RevokeKey(owner string, id int64) (bool, error)
+	TouchKey(id int64, t time.Time) error
+}
+
+//MemoryApiKeyStore is an ApiKeyStore that keeps keys in memory.  This is
+//useful for tests and for applications that have no database.
+type MemoryApiKeyStore struct {
+	lock   sync.Mutex
+	nextId int64
+	keys   map[int64]*ApiKey
+}
+
+//NewMemoryApiKeyStore returns an empty MemoryApiKeyStore.
+func NewMemoryApiKeyStore() *MemoryApiKeyStore {
+	return &MemoryApiKeyStore{
+		nextId: 1,
+		keys:   make(map[int64]*ApiKey),
+	}
+}
+
+//CreateKey stores a copy of the key and sets the Id field of k.
+func (self *MemoryApiKeyStore) CreateKey(k *ApiKey) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	k.Id = self.nextId
+	self.nextId++
+	cp := *k
+	self.keys[k.Id] = &cp
+	return nil
+}
+
+//FindKeyByPrefix returns a copy of the key with the given prefix.
+func (self *MemoryApiKeyStore) FindKeyByPrefix(prefix string) (*ApiKey, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, k := range self.keys {
+		if k.Prefix == prefix {
+			cp := *k
+			return &cp, nil
+		}
+	}
+	return nil, nil
+}
+
+//ListKeys returns copies of all the keys belonging to owner, ordered by id.
+func (self *MemoryApiKeyStore) ListKeys(owner string) ([]*ApiKey, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	result := []*ApiKey{}
+	for _, k := range self.keys {
+		if k.Owner == owner {
+			cp := *k
+			result = append(result, &cp)
+		}
+	}
+	sort.Sort(apiKeysById(result))
+	return result, nil
+}
+
+//RevokeKey marks the key as revoked, if it belongs to owner.
+func (self *MemoryApiKeyStore) RevokeKey(owner string, id int64) (bool, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	k, ok := self.keys[id]
+	if !ok || k.Owner != owner {
+		return false, nil
+	}
+	k.Revoked = true
+	return true, nil
+}
+
+//TouchKey records the last time a key was used.
+func (self *MemoryApiKeyStore) TouchKey(id int64, t time.Time) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if k, ok := self.keys[id]; ok {
+		k.LastUsed = t
+	}
+	return nil
+}
+
+type apiKeysById []*ApiKey
+
+func (a apiKeysById) Len() int           { return len(a) }
+func (a apiKeysById) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a apiKeysById) Less(i, j int) bool { return a[i].Id < a[j].Id }
+
+//ApiKeyManager issues and verifies personal api keys, using an ApiKeyStore
+//for storage.  Keys look like s5k_0123abcd_<32 hex digits>; the part between
+//the underscores is the prefix that is stored in the clear so the key can be
+//found, the rest is only stored as a hash.
+type ApiKeyManager struct {
+	store ApiKeyStore
+}
+
+//NewApiKeyManager returns an ApiKeyManager that keeps its keys in store.
+func NewApiKeyManager(store ApiKeyStore) *ApiKeyManager {
+	return &ApiKeyManager{store: store}
+}
+
+//Store returns the ApiKeyStore used by this manager.
+func (self *ApiKeyManager) Store() ApiKeyStore {
+	return self.store
+}
+
+//IsApiKey returns true if s has the form of a personal api key.  It does not
+//check that the key exists.
+func IsApiKey(s string) bool {
+	parts := strings.Split(s, "_")
+	return len(parts) == 3 && parts[0] == s5ApiKeyPrefix && len(parts[1]) == 8 && len(parts[2]) == 32
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Panicf("failed to read the random stream: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+//Generate creates a new key for owner with the given name and scopes.  The
+//returned string is the key itself, which should be shown to the user once
+//and then forgotten; it cannot be recovered later.
+func (self *ApiKeyManager) Generate(owner string, name string, scopes []string) (string, *ApiKey, error) {
+	if owner == "" {
+		return "", nil, fmt.Errorf("api keys must have an owner")
+	}
+	prefix := randomHex(4)
+	key := fmt.Sprintf("%s_%s_%s", s5ApiKeyPrefix, prefix, randomHex(16))
+	record := &ApiKey{
+		Owner:   owner,
+		Name:    name,
+		Prefix:  prefix,
+		Hash:    hashApiKey(key),
+		Scopes:  strings.Join(scopes, " "),
+		Created: time.Now(),
+	}
+	if err := self.store.CreateKey(record); err != nil {
+		return "", nil, err
+	}
+	return key, record, nil
+}
+
+//Verify returns the record for key if the key is known and not revoked, or
+//nil, nil otherwise.  The time the key was last used is updated, but at most
+//once per API_KEY_TOUCH_INTERVAL to avoid a write on every request.
+func (self *ApiKeyManager) Verify(key string) (*ApiKey, error) {
+	if !IsApiKey(key) {
+		return nil, nil
+	}
+	record, err := self.store.FindKeyByPrefix(strings.Split(key, "_")[1])
+	if err != nil || record == nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(record.Hash), []byte(hashApiKey(key))) != 1 {
+		return nil, nil
+	}
+	if record.Revoked {
+		return nil, nil
+	}
+	now := time.Now()
+	if now.Sub(record.LastUsed) > API_KEY_TOUCH_INTERVAL {
+		if err := self.store.TouchKey(record.Id, now); err != nil {
+			log.Printf("[APIKEY] unable to record use of key %d: %v", record.Id, err)
+		}
+		record.LastUsed = now
+	}
+	return record, nil
+}
+
+//ApiKeyWire is the wire type for the api key resource.  Key is only sent to
+//the client in response to the POST that creates the key.  On POST, the
+//client provides Name and Scopes.
+type ApiKeyWire struct {
+	Id       int64
+	Name     string
+	Prefix   string
+	Scopes   []string
+	Created  time.Time
+	LastUsed time.Time
+	Revoked  bool
+	Key      string
+}
+
+//ApiKeyOwner returns the unique id of the user making the request, or "" if
+//there is no logged in user.  This is needed by the ApiKeyResource because
+//only the application knows how its user data relates to the unique id.
+type ApiKeyOwner func(PBundle) string
+
+//ApiKeyResource is a rest resource that allows users to create, list and
+//revoke their own api keys.  It is usually registered like this:
+//  d.ResourceSeparate("ApiKey", &ApiKeyWire{}, r, r, r, nil, r)
+//Requests authenticated with an api key cannot create or revoke keys.
+type ApiKeyResource struct {
+	keys  *ApiKeyManager
+	owner ApiKeyOwner
+}
+
+//NewApiKeyResource returns a resource for the keys managed by keys.
+func NewApiKeyResource(keys *ApiKeyManager, owner ApiKeyOwner) *ApiKeyResource {
+	return &ApiKeyResource{keys: keys, owner: owner}
+}
+
+func apiKeyToWire(k *ApiKey) *ApiKeyWire {
+	return &ApiKeyWire{
+		Id:       k.Id,
+		Name:     k.Name,
+		Prefix:   k.Prefix,
+		Scopes:   k.ScopeList(),
+		Created:  k.Created,
+		LastUsed: k.LastUsed,
+		Revoked:  k.Revoked,
+	}
+}
+
+func (self *ApiKeyResource) ownerOf(pb PBundle, mutating bool) (string, error) {
+	owner := self.owner(pb)
+	if owner == "" {
+		return "", HTTPError(http.StatusUnauthorized, "not logged in")
+	}
+	if mutating {
+		if cred := CredentialOf(pb); cred != nil && cred.Source == CREDENTIAL_API_KEY {
+			return "", HTTPError(http.StatusForbidden, "api keys cannot manage api keys")
+		}
+	}
+	return owner, nil
+}
+
+//Index returns all the keys, including revoked ones, of the current user.
+func (self *ApiKeyResource) Index(pb PBundle) (interface{}, error) {
+	owner, err := self.ownerOf(pb, false)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := self.keys.store.ListKeys(owner)
+	if err != nil {
+		return nil, err
+	}
+	result := []*ApiKeyWire{}
+	for _, k := range keys {
+		result = append(result, apiKeyToWire(k))
+	}
+	return result, nil
+}
+
+//Find returns one key of the current user.
+func (self *ApiKeyResource) Find(id int64, pb PBundle) (interface{}, error) {
+	owner, err := self.ownerOf(pb, false)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := self.keys.store.ListKeys(owner)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if k.Id == id {
+			return apiKeyToWire(k), nil
+		}
+	}
+	return nil, HTTPError(http.StatusNotFound, fmt.Sprintf("no api key %d", id))
+}
+
+//Post creates a new key for the current user.  This is the only time the
+//key is sent to the client.
+func (self *ApiKeyResource) Post(i interface{}, pb PBundle) (interface{}, error) {
+	owner, err := self.ownerOf(pb, true)
+	if err != nil {
+		return nil, err
+	}
+	in, ok := i.(*ApiKeyWire)
+	if !ok || in == nil {
+		return nil, HTTPError(http.StatusBadRequest, "expected name and scopes for the api key")
+	}
+	key, record, err := self.keys.Generate(owner, in.Name, in.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	result := apiKeyToWire(record)
+	result.Key = key
+	return result, nil
+}
+
+//Delete revokes a key of the current user.
+func (self *ApiKeyResource) Delete(id int64, pb PBundle) (interface{}, error) {
+	owner, err := self.ownerOf(pb, true)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := self.keys.store.RevokeKey(owner, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, HTTPError(http.StatusNotFound, fmt.Sprintf("no api key %d", id))
+	}
+	return self.Find(id, pb)
+}
@@ -0,0 +1,92 @@
+package seven5
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestApiKeyLifecycle(t *testing.T) {
+	keys := NewApiKeyManager(NewMemoryApiKeyStore())
+	key, record, err := keys.Generate("fred", "laptop", []string{"house:read"})
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	if !IsApiKey(key) {
+		t.Errorf("generated key is not recognized as a key: %s", key)
+	}
+	if record.Hash == "" || record.Hash == key {
+		t.Errorf("key should be stored hashed, got %s", record.Hash)
+	}
+
+	found, err := keys.Verify(key)
+	if err != nil || found == nil {
+		t.Fatalf("unable to verify key: %v", err)
+	}
+	if found.Owner != "fred" || found.LastUsed.IsZero() {
+		t.Errorf("unexpected key found: %+v", found)
+	}
+	bogus := key[:len(key)-4] + "0000"
+	if found, _ := keys.Verify(bogus); found != nil {
+		t.Errorf("should not verify key with the wrong secret")
+	}
+
+	ok, err := keys.Store().RevokeKey("barney", record.Id)
+	if err != nil || ok {
+		t.Errorf("should not be able to revoke someone else's key (%v,%v)", ok, err)
+	}
+	ok, err = keys.Store().RevokeKey("fred", record.Id)
+	if err != nil || !ok {
+		t.Fatalf("unable to revoke key (%v,%v)", ok, err)
+	}
+	if found, _ := keys.Verify(key); found != nil {
+		t.Errorf("should not verify revoked key")
+	}
+}
+
+func TestApiKeyScopes(t *testing.T) {
+	sm := NewDumbSessionManager()
+	sm.generator = &testGen{}
+	cm := NewSimpleCookieMapper("myapp")
+	keys := NewApiKeyManager(NewMemoryApiKeyStore())
+	hook := NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, cm)
+	hook.Extractors = []CredentialExtractor{NewCookieExtractor(cm), NewApiKeyExtractorWithKeys("", nil, keys)}
+
+	key, _, _ := keys.Generate("fred", "ci", []string{"house:read"})
+	r, _ := http.NewRequest("GET", "/rest/house", nil)
+	r.Header.Set(API_KEY_HEADER, key)
+	pb, err := hook.BundleHook(httptest.NewRecorder(), r, sm)
+	if err != nil {
+		t.Fatalf("unexpected error creating bundle: %v", err)
+	}
+	if pb.Session() == nil || pb.Session().UserData().(string) != "fred" {
+		t.Fatalf("expected a session for fred, got %+v", pb.Session())
+	}
+	if !HasScope(pb, "house:read") || HasScope(pb, "house:write") {
+		t.Errorf("wrong scopes for api key: %+v", CredentialOf(pb))
+	}
+	keyBundle := pb
+
+	res := NewApiKeyResource(keys, func(pb PBundle) string {
+		if pb.Session() == nil {
+			return ""
+		}
+		return pb.Session().UserData().(string)
+	})
+	s, _ := sm.Assign("fred", "fred", time.Time{})
+	r, _ = http.NewRequest("GET", "/rest/house", nil)
+	r.AddCookie(&http.Cookie{Name: cm.CookieName(), Value: s.SessionId()})
+	pb, _ = hook.BundleHook(httptest.NewRecorder(), r, sm)
+	if !HasScope(pb, "house:write") {
+		t.Errorf("cookie sessions should have every scope")
+	}
+	if _, err := res.Index(pb); err != nil {
+		t.Errorf("unable to list keys: %v", err)
+	}
+
+	_, err = res.Post(&ApiKeyWire{Name: "sneaky"}, keyBundle)
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusForbidden {
+		t.Errorf("expected api keys to be unable to create keys, got %v", err)
+	}
+}
@@ -45,7 +45,8 @@ type OauthConnector interface {
 	//Both versions use the state passed in here to help you know what to do when
 	//you land on the login page
 	UserInteractionURL(p1creds OauthCred, state string, callbackPath string) string
-	//Oauth2 client token?
+	//For oauth1 the clientToken is the value named by ClientTokenValueName, for
+	//oauth2 (which has no client token) it is the state
 	Phase2(clientToken string, code string) (OauthConnection, error)
 	Name() string
 }
@@ -9,9 +9,26 @@ package seven5
 //You must pass an already created session manager into this method
 //(see NewSimpleSessionManager(...))
 func NewBaseDispatcher(sm SessionManager, cm CookieMapper) *BaseDispatcher {
+	return NewBaseDispatcherWithTokens(sm, cm, nil)
+}
+
+//NewBaseDispatcherWithTokens returns a BaseDispatcher like NewBaseDispatcher
+//but that also accepts tokens, issued by SimplePasswordHandler, from clients that
+//cannot keep cookies.  The tokens are read from the Authorization: Bearer header
+//or the X-Api-Key header.  If codec is nil, this is the same as NewBaseDispatcher.
+func NewBaseDispatcherWithTokens(sm SessionManager, cm CookieMapper, codec TokenCodec) *BaseDispatcher {
+	return NewBaseDispatcherWithExtractors(sm, cm, DefaultCredentialExtractors(cm, codec)...)
+}
+
+//NewBaseDispatcherWithExtractors returns a BaseDispatcher that finds the session
+//for each request by consulting the CredentialExtractors provided, in order.
+//This is the way to accept personal api keys (see NewApiKeyExtractorWithKeys).
+//The cookie mapper is still needed to remove stale cookies.
+func NewBaseDispatcherWithExtractors(sm SessionManager, cm CookieMapper, ex ...CredentialExtractor) *BaseDispatcher {
 	prefix := "/rest"
 	result := &BaseDispatcher{}
-	io := &RawIOHook{&JsonDecoder{}, &JsonEncoder{}, cm}
+	io := NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, cm)
+	io.Extractors = ex
 	result.RawDispatcher = NewRawDispatcher(io, sm, result, prefix)
 	return result
 }
@@ -5,6 +5,11 @@ const (
 	AUTH_OP_LOGOUT        = "logout"
 	AUTH_OP_PWD_RESET     = "pwdreset"
 	AUTH_OP_PWD_RESET_REQ = "pwdresetreq"
+	AUTH_OP_TOTP_ENROLL   = "totpenroll"
+	AUTH_OP_TOTP_CONFIRM  = "totpconfirm"
+	AUTH_OP_TOTP_VERIFY   = "totpverify"
+	AUTH_OP_SIGNUP        = "signup"
+	AUTH_OP_VERIFY        = "verify"
 )
 
 type PasswordAuthParameters struct {
@@ -13,4 +18,22 @@ type PasswordAuthParameters struct {
 	ResetRequestUdid string
 	UserUdid         string
 	Op               string
+	Code             string
+	RecoveryCode     string
+	ResetToken       string
+	Email            string
+	VerifyToken      string
+}
+
+type PasswordAuthResult struct {
+	Token                string
+	Expires              int64
+	SecondFactorRequired bool
+	VerificationRequired bool
+}
+
+type TOTPEnrollment struct {
+	Secret        string
+	URI           string
+	RecoveryCodes []string
 }
@@ -7,7 +7,6 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
 )
 
 //SimpleIdComponent is designed to allow urls like /foo/1 to work.  IdComponent serves
@@ -474,34 +473,14 @@ func (self *SimpleComponentMatcher) ServeHTTP(w http.ResponseWriter, r *http.Req
 		}
 		//it's a no cookie, which is not a problem
 	} else {
-		//we had a cookie, let's try to look it up
-		rtn, err := self.sm.Find(id)
+		//we had a cookie, let's try to look it up (half-authenticated sessions
+		//are treated as no session)
+		session, _, err = ResolveCredential(self.sm, &Credential{Source: CREDENTIAL_COOKIE, SessionId: id})
 		if err != nil {
 			log.Printf("[SERVE] error trying to find session (%s): %v", r.URL.Path, err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		//if this is nil, there is nothing that could be found (no session or it expired)
-		if rtn != nil {
-			//we got a return value, is it just unique id?
-			if rtn.Session == nil {
-				sd, err := self.sm.Generate(rtn.UniqueId)
-				if err != nil {
-					log.Printf("[SERVE] error trying to reconstruct session (%s): %v", r.URL.Path, err)
-					w.WriteHeader(http.StatusInternalServerError)
-					return
-				}
-				session, err = self.sm.Assign(rtn.UniqueId, sd, time.Time{})
-				if err != nil {
-					log.Printf("[SERVE] error trying to assign session (%s): %v", r.URL.Path, err)
-					w.WriteHeader(http.StatusInternalServerError)
-					return
-				}
-			} else {
-				//this means that the Find() returned a session object inside rtn
-				session = rtn.Session
-			}
-		}
 	}
 
 	//session, if there is one, is assigned here to the correct session
@@ -539,7 +518,9 @@ func (self *SimpleComponentMatcher) ServeHTTP(w http.ResponseWriter, r *http.Req
 		w.Header().Add("Pragma", "no-cache")
 		w.Header().Add("Expires", "0")
 		log.Printf("[SERVE] %+v -> %v", r.URL, finalPath)
-		http.ServeFile(w, r, finalPath)
+		servePage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFile(w, r, finalPath)
+		}), w, r)
 		return
 	}
 }
@@ -0,0 +1,519 @@
+package seven5
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CONFIG_PORT          = "port"
+	CONFIG_TEST          = "test"
+	CONFIG_REDIRECT_HOST = "redirect_host"
+	CONFIG_DATABASE_URL  = "database_url"
+)
+
+//ConfigSource says which layer of a ConfigDeploy a value came from.  Later
+//layers override earlier ones.
+type ConfigSource int
+
+const (
+	CONFIG_UNSET ConfigSource = iota
+	CONFIG_DEFAULT
+	CONFIG_FILE
+	CONFIG_ENV
+	CONFIG_FLAG
+)
+
+func (self ConfigSource) String() string {
+	switch self {
+	case CONFIG_DEFAULT:
+		return "default"
+	case CONFIG_FILE:
+		return "file"
+	case CONFIG_ENV:
+		return "env"
+	case CONFIG_FLAG:
+		return "flag"
+	}
+	return "unset"
+}
+
+//ConfigError is returned by ConfigDeploy.Validate with every problem found,
+//so they can all be fixed at once.
+type ConfigError struct {
+	Problems []string
+}
+
+func (self *ConfigError) Error() string {
+	return "bad configuration:\n\t" + strings.Join(self.Problems, "\n\t")
+}
+
+//ConfigDeploy is a DeploymentEnvironment that is not tied to any hosting
+//service.  Each value is looked up, in order of precedence, in the command line
+//flags, the environment, a config file and the defaults.  Keys are lower case,
+//like "port" or "smtp.host", and the environment variable for a key is the
+//upper case application name and key joined by _, with . and - also turned into
+//_ (so MYAPP_SMTP_HOST).  Some keys also have an alias in the environment, by
+//default PORT and DATABASE_URL, for the benefit of hosting services that set
+//those.
+//
+//The built in keys are port, test, redirect_host and database_url.  Call
+//Validate once at startup, after loading the file and flags, to find all the
+//missing or malformed values.
+type ConfigDeploy struct {
+	appName  string
+	defaults map[string]string
+	file     map[string]string
+	flags    map[string]string
+	aliases  map[string]string
+	required map[string]bool
+	checks   map[string]func(string) error
+	secret   map[string]bool
+}
+
+//NewConfigDeploy returns a ConfigDeploy for the application with the given
+//name, which is used to find its environment variables.  The port defaults to
+//8080.
+func NewConfigDeploy(appName string) *ConfigDeploy {
+	result := &ConfigDeploy{
+		appName:  appName,
+		defaults: map[string]string{CONFIG_PORT: "8080", CONFIG_TEST: "false"},
+		file:     make(map[string]string),
+		flags:    make(map[string]string),
+		aliases:  map[string]string{CONFIG_PORT: "PORT", CONFIG_DATABASE_URL: "DATABASE_URL"},
+		required: make(map[string]bool),
+		checks:   make(map[string]func(string) error),
+		secret:   map[string]bool{CONFIG_DATABASE_URL: true, CONFIG_DATABASE_REPLICA_URLS: true},
+	}
+	result.SetCheck(CONFIG_PORT, checkPort)
+	result.SetCheck(CONFIG_TEST, CheckBool)
+	result.SetCheck(CONFIG_DB_MAX_OPEN, CheckInt)
+	result.SetCheck(CONFIG_DB_MAX_IDLE, CheckInt)
+	result.SetCheck(CONFIG_DB_MAX_LIFETIME, CheckDuration)
+	result.SetCheck(CONFIG_DB_MAX_IDLE_TIME, CheckDuration)
+	return result
+}
+
+func configKey(key string) string {
+	return strings.ToLower(strings.TrimSpace(key))
+}
+
+//SetDefault sets the value used when no other layer has one.
+func (self *ConfigDeploy) SetDefault(key string, value string) {
+	self.defaults[configKey(key)] = value
+}
+
+//Require marks the keys as needing a value (that is not "") from some layer.
+func (self *ConfigDeploy) Require(key ...string) {
+	for _, k := range key {
+		self.required[configKey(k)] = true
+	}
+}
+
+//SetCheck sets a function that Validate uses to check the value of key, if
+//it has one.  See CheckInt, CheckBool and CheckDuration.
+func (self *ConfigDeploy) SetCheck(key string, check func(string) error) {
+	self.checks[configKey(key)] = check
+}
+
+//SetEnvAlias makes the environment variable envVar a second name for key,
+//used if the application's own variable is not set.
+func (self *ConfigDeploy) SetEnvAlias(key string, envVar string) {
+	self.aliases[configKey(key)] = envVar
+}
+
+//SetSecret marks the key as a secret so its value is not shown by Print.  Keys
+//containing "password", "secret" or "token" are always secret.
+func (self *ConfigDeploy) SetSecret(key string) {
+	self.secret[configKey(key)] = true
+}
+
+//EnvName returns the name of the environment variable for key.
+func (self *ConfigDeploy) EnvName(key string) string {
+	r := strings.NewReplacer(".", "_", "-", "_")
+	return strings.ToUpper(r.Replace(self.appName + "_" + configKey(key)))
+}
+
+//LoadFile reads a config file, replacing any read before.  Files ending in
+//.json hold a JSON object and nested objects become dotted keys.  Other files
+//are read as TOML, of which the simple subset of tables and key/value pairs
+//with string, number and boolean values is understood.
+func (self *ConfigDeploy) LoadFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values := make(map[string]string)
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = parseJSONConfig(b, values)
+	} else {
+		err = parseTOMLConfig(b, values)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	self.file = values
+	return nil
+}
+
+//LoadFlags parses the command line arguments (without the program name).  Each
+//key known by then, from a default, Require, SetCheck or the config file, can
+//be given as -key=value or -key value.
+func (self *ConfigDeploy) LoadFlags(args []string) error {
+	fs := flag.NewFlagSet(self.appName, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	for _, k := range self.Keys() {
+		fs.String(k, "", "")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		self.flags[f.Name] = f.Value.String()
+	})
+	return nil
+}
+
+//Lookup returns the value of key and the layer it came from.
+func (self *ConfigDeploy) Lookup(key string) (string, ConfigSource) {
+	key = configKey(key)
+	if v, ok := self.flags[key]; ok {
+		return v, CONFIG_FLAG
+	}
+	if v, ok := os.LookupEnv(self.EnvName(key)); ok {
+		return v, CONFIG_ENV
+	}
+	if alias, ok := self.aliases[key]; ok {
+		if v, ok := os.LookupEnv(alias); ok {
+			return v, CONFIG_ENV
+		}
+	}
+	if v, ok := self.file[key]; ok {
+		return v, CONFIG_FILE
+	}
+	if v, ok := self.defaults[key]; ok {
+		return v, CONFIG_DEFAULT
+	}
+	return "", CONFIG_UNSET
+}
+
+//GetAppValue returns the value of key, or "" if it has none.
+func (self *ConfigDeploy) GetAppValue(key string) string {
+	v, _ := self.Lookup(key)
+	return v
+}
+
+//MustAppValue returns the value of key and panics if it is "".
+func (self *ConfigDeploy) MustAppValue(key string) string {
+	v := self.GetAppValue(key)
+	if v == "" {
+		panic(fmt.Sprintf("no value for %s (set %s)", configKey(key), self.EnvName(key)))
+	}
+	return v
+}
+
+//IntValue returns the value of key as an int.
+func (self *ConfigDeploy) IntValue(key string) (int, error) {
+	v := self.GetAppValue(key)
+	if err := CheckInt(v); err != nil {
+		return 0, fmt.Errorf("%s: %v", configKey(key), err)
+	}
+	return strconv.Atoi(v)
+}
+
+//BoolValue returns the value of key as a bool; "" is false.
+func (self *ConfigDeploy) BoolValue(key string) (bool, error) {
+	v := self.GetAppValue(key)
+	if v == "" {
+		return false, nil
+	}
+	if err := CheckBool(v); err != nil {
+		return false, fmt.Errorf("%s: %v", configKey(key), err)
+	}
+	return strconv.ParseBool(v)
+}
+
+//DurationValue returns the value of key as a duration, like "30s".
+func (self *ConfigDeploy) DurationValue(key string) (time.Duration, error) {
+	v := self.GetAppValue(key)
+	if err := CheckDuration(v); err != nil {
+		return 0, fmt.Errorf("%s: %v", configKey(key), err)
+	}
+	return time.ParseDuration(v)
+}
+
+//Keys returns every key the ConfigDeploy knows about, sorted.
+func (self *ConfigDeploy) Keys() []string {
+	seen := make(map[string]bool)
+	for _, m := range []map[string]string{self.defaults, self.file, self.flags, self.aliases} {
+		for k := range m {
+			seen[k] = true
+		}
+	}
+	for k := range self.required {
+		seen[k] = true
+	}
+	for k := range self.checks {
+		seen[k] = true
+	}
+	result := make([]string, 0, len(seen))
+	for k := range seen {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+//Validate checks every required key has a value and every value with a check
+//passes it.  The error, if any, is a *ConfigError listing all the problems.
+func (self *ConfigDeploy) Validate() error {
+	var problems []string
+	for _, k := range self.Keys() {
+		v, src := self.Lookup(k)
+		if v == "" {
+			if self.required[k] {
+				problems = append(problems, fmt.Sprintf("%s is required (set %s)", k, self.EnvName(k)))
+			}
+			continue
+		}
+		if check, ok := self.checks[k]; ok {
+			if err := check(v); err != nil {
+				problems = append(problems, fmt.Sprintf("%s (from %s): %v", k, src, err))
+			}
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return &ConfigError{Problems: problems}
+}
+
+func (self *ConfigDeploy) isSecret(key string) bool {
+	if self.secret[key] {
+		return true
+	}
+	for _, s := range []string{"password", "secret", "token"} {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+//Print writes the effective configuration, one key per line with the layer it
+//came from.  Secret values are masked.
+func (self *ConfigDeploy) Print(w io.Writer) {
+	for _, k := range self.Keys() {
+		v, src := self.Lookup(k)
+		if v != "" && self.isSecret(k) {
+			v = "********"
+		}
+		fmt.Fprintf(w, "%-24s %-8s %q\n", k, src, v)
+	}
+}
+
+//GetQbsStore returns a store for the database_url, which must be set.  For
+//local development this can be a sqlite database; see NewQbsStoreFromURL.
+//The pool of connections is configured by PoolConfigFromEnv.  The
+//database_replica_urls, if set, is a comma separated list of the urls of
+//read replicas (see AddReplica).
+func (self *ConfigDeploy) GetQbsStore() *QbsStore {
+	store, err := NewQbsStoreFromURL(self.MustAppValue(CONFIG_DATABASE_URL))
+	if err != nil {
+		panic(err.Error())
+	}
+	cfg, err := PoolConfigFromEnv(self)
+	if err != nil {
+		panic(err.Error())
+	}
+	store.SetPool(cfg)
+	for _, u := range strings.Split(self.GetAppValue(CONFIG_DATABASE_REPLICA_URLS), ",") {
+		if u = strings.TrimSpace(u); u == "" {
+			continue
+		}
+		if err := store.AddReplicaURL(u); err != nil {
+			panic(err.Error())
+		}
+	}
+	return store
+}
+
+//IsTest returns the value of test.
+func (self *ConfigDeploy) IsTest() bool {
+	b, err := self.BoolValue(CONFIG_TEST)
+	if err != nil {
+		panic(err.Error())
+	}
+	return b
+}
+
+//Port returns the value of port and panics if it is not a number.
+func (self *ConfigDeploy) Port() int {
+	p, err := self.IntValue(CONFIG_PORT)
+	if err != nil {
+		panic(err.Error())
+	}
+	return p
+}
+
+//RedirectHost returns the value of redirect_host, or when testing and it is
+//not set, localhost with the port.
+func (self *ConfigDeploy) RedirectHost() string {
+	if h := self.GetAppValue(CONFIG_REDIRECT_HOST); h != "" {
+		return strings.TrimSuffix(h, "/")
+	}
+	if self.IsTest() {
+		return fmt.Sprintf(REDIRECT_HOST_TEST, self.Port())
+	}
+	panic(fmt.Sprintf("no value for %s (set %s)", CONFIG_REDIRECT_HOST, self.EnvName(CONFIG_REDIRECT_HOST)))
+}
+
+//Url returns the url of the application itself, which is the RedirectHost.
+//Note that this will not have a / on the end.
+func (self *ConfigDeploy) Url() string {
+	return self.RedirectHost()
+}
+
+//CheckInt is a check for SetCheck that requires an integer.
+func CheckInt(v string) error {
+	if _, err := strconv.Atoi(v); err != nil {
+		return fmt.Errorf("%q is not an integer", v)
+	}
+	return nil
+}
+
+//CheckBool is a check for SetCheck that requires true or false (or 1 or 0).
+func CheckBool(v string) error {
+	if _, err := strconv.ParseBool(v); err != nil {
+		return fmt.Errorf("%q is not true or false", v)
+	}
+	return nil
+}
+
+//CheckDuration is a check for SetCheck that requires a duration like "1m30s".
+func CheckDuration(v string) error {
+	if _, err := time.ParseDuration(v); err != nil {
+		return fmt.Errorf("%q is not a duration", v)
+	}
+	return nil
+}
+
+func checkPort(v string) error {
+	p, err := strconv.Atoi(v)
+	if err != nil || p <= 0 || p > 65535 {
+		return fmt.Errorf("%q is not a port number", v)
+	}
+	return nil
+}
+
+//
+// CONFIG FILES
+//
+
+func parseJSONConfig(b []byte, values map[string]string) error {
+	d := json.NewDecoder(strings.NewReader(string(b)))
+	d.UseNumber()
+	var obj map[string]interface{}
+	if err := d.Decode(&obj); err != nil {
+		return err
+	}
+	return flattenConfig("", obj, values)
+}
+
+func flattenConfig(prefix string, obj map[string]interface{}, values map[string]string) error {
+	for k, v := range obj {
+		key := configKey(prefix + k)
+		switch x := v.(type) {
+		case map[string]interface{}:
+			if err := flattenConfig(key+".", x, values); err != nil {
+				return err
+			}
+		case string:
+			values[key] = x
+		case json.Number:
+			values[key] = x.String()
+		case bool:
+			values[key] = strconv.FormatBool(x)
+		case nil:
+			values[key] = ""
+		default:
+			return fmt.Errorf("%s: unsupported value %v", key, v)
+		}
+	}
+	return nil
+}
+
+//parseTOMLConfig understands tables, comments and key = value with basic or
+//literal strings, numbers and booleans.
+func parseTOMLConfig(b []byte, values map[string]string) error {
+	table := ""
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			end := strings.Index(line, "]")
+			if end < 0 || strings.HasPrefix(line, "[[") {
+				return fmt.Errorf("line %d: bad table %s", i+1, line)
+			}
+			table = configKey(line[1:end]) + "."
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return fmt.Errorf("line %d: expected key = value", i+1)
+		}
+		key := strings.Trim(strings.TrimSpace(line[:eq]), "\"")
+		v, err := tomlValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return fmt.Errorf("line %d: %v", i+1, err)
+		}
+		values[table+configKey(key)] = v
+	}
+	return nil
+}
+
+func tomlValue(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, "\""):
+		end := 1
+		for end < len(v) && v[end] != '"' {
+			if v[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(v) {
+			return "", errors.New("unterminated string")
+		}
+		return strconv.Unquote(v[:end+1])
+	case strings.HasPrefix(v, "'"):
+		end := strings.Index(v[1:], "'")
+		if end < 0 {
+			return "", errors.New("unterminated string")
+		}
+		return v[1 : end+1], nil
+	}
+	if hash := strings.Index(v, "#"); hash >= 0 {
+		v = strings.TrimSpace(v[:hash])
+	}
+	if v == "true" || v == "false" {
+		return v, nil
+	}
+	n := strings.Replace(v, "_", "", -1)
+	if _, err := strconv.ParseFloat(n, 64); err == nil {
+		return n, nil
+	}
+	return "", fmt.Errorf("unsupported value %s", v)
+}
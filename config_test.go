@@ -0,0 +1,112 @@
+package seven5
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s5config")
+	if err != nil {
+		t.Fatalf("unable to make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	toml := filepath.Join(dir, "app.toml")
+	ioutil.WriteFile(toml, []byte(`
+# the app
+port = 9000
+redirect_host = "https://example.com/"
+
+[smtp]
+host = 'mail.example.com'
+port = 2_525 # submission
+password = "hunter2"
+`), 0600)
+
+	conf := NewConfigDeploy("s5conftest")
+	conf.SetDefault("smtp.host", "localhost")
+	conf.SetDefault("greeting", "hi")
+	if err := conf.LoadFile(toml); err != nil {
+		t.Fatalf("unable to load file: %v", err)
+	}
+	os.Setenv("S5CONFTEST_SMTP_PORT", "587")
+	defer os.Unsetenv("S5CONFTEST_SMTP_PORT")
+	if err := conf.LoadFlags([]string{"-greeting=hello"}); err != nil {
+		t.Fatalf("unable to parse flags: %v", err)
+	}
+
+	expected := map[string]string{
+		"port":          "9000",
+		"smtp.host":     "mail.example.com",
+		"smtp.port":     "587",
+		"greeting":      "hello",
+		"smtp.password": "hunter2",
+	}
+	for k, v := range expected {
+		if conf.GetAppValue(k) != v {
+			t.Errorf("expected %s to be %q but got %q", k, v, conf.GetAppValue(k))
+		}
+	}
+	if _, src := conf.Lookup("greeting"); src != CONFIG_FLAG {
+		t.Errorf("expected greeting from flag, got %s", src)
+	}
+	if conf.Port() != 9000 || conf.RedirectHost() != "https://example.com" || conf.IsTest() {
+		t.Errorf("unexpected deployment %d %s %v", conf.Port(), conf.RedirectHost(), conf.IsTest())
+	}
+	if p, err := conf.IntValue("smtp.port"); err != nil || p != 587 {
+		t.Errorf("expected smtp.port 587, got %d (%v)", p, err)
+	}
+
+	var buf bytes.Buffer
+	conf.Print(&buf)
+	if strings.Contains(buf.String(), "hunter2") || !strings.Contains(buf.String(), "mail.example.com") {
+		t.Errorf("unexpected config printed:\n%s", buf.String())
+	}
+
+	json := filepath.Join(dir, "app.json")
+	ioutil.WriteFile(json, []byte(`{"test": true, "smtp": {"host": "json.example.com", "port": 25}}`), 0600)
+	if err := conf.LoadFile(json); err != nil {
+		t.Fatalf("unable to load file: %v", err)
+	}
+	if conf.GetAppValue("smtp.host") != "json.example.com" || !conf.IsTest() {
+		t.Errorf("expected json file to replace toml file")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	conf := NewConfigDeploy("s5conftest")
+	conf.Require("api_key", "smtp.host")
+	conf.SetDefault("timeout", "soon")
+	conf.SetCheck("timeout", CheckDuration)
+	conf.LoadFlags([]string{"-port", "http"})
+
+	err := conf.Validate()
+	cerr, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("expected a *ConfigError but got %v", err)
+	}
+	if len(cerr.Problems) != 4 {
+		t.Errorf("expected 4 problems but got %d: %v", len(cerr.Problems), err)
+	}
+	for _, s := range []string{"S5CONFTEST_API_KEY", "S5CONFTEST_SMTP_HOST", "timeout", "port"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("expected error to mention %s: %v", s, err)
+		}
+	}
+
+	conf = NewConfigDeploy("s5conftest")
+	conf.Require("api_key")
+	if err := conf.LoadFlags([]string{"-api_key", "abc"}); err != nil {
+		t.Fatalf("unable to parse flags: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Errorf("expected valid config: %v", err)
+	}
+	if err := conf.LoadFlags([]string{"-nope=1"}); err == nil {
+		t.Errorf("expected unknown flag to be refused")
+	}
+}
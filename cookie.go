@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 )
 
 const (
-	SESSION_COOKIE = "%s-seven5-session"
+	SESSION_COOKIE     = "%s-seven5-session"
+	HOST_COOKIE_PREFIX = "__Host-"
 )
 
 var (
@@ -25,28 +27,113 @@ type CookieMapper interface {
 	RemoveCookie(http.ResponseWriter)
 }
 
+//CookieOptions controls the attributes that SimpleCookieMapper places on the
+//session cookie it sends to the browser.  If HostPrefix is true, the cookie
+//name is prefixed with __Host- which browsers will only accept if the cookie
+//is Secure, has a Path of / and has no Domain.  MaxAge is only used when the
+//session does not know its own expiration time (see ExpiringSession); if
+//MaxAge is zero in that case the cookie lasts until the browser is closed.
+type CookieOptions struct {
+	Secure     bool
+	HttpOnly   bool
+	SameSite   http.SameSite
+	Domain     string
+	Path       string
+	HostPrefix bool
+	MaxAge     time.Duration
+}
+
+//DefaultCookieOptions returns the cookie options that most applications should
+//use.  The cookie is HttpOnly and SameSite=Lax.  When deployed (env.IsTest()
+//is false) the cookie is also Secure and uses the __Host- prefix.  Locally
+//these two are relaxed because the test server is typically plain http.  If
+//env is nil, it is treated as a test deployment.
+func DefaultCookieOptions(env DeploymentEnvironment) *CookieOptions {
+	deployed := env != nil && !env.IsTest()
+	return &CookieOptions{
+		Secure:     deployed,
+		HttpOnly:   true,
+		SameSite:   http.SameSiteLaxMode,
+		Path:       "/",
+		HostPrefix: deployed,
+	}
+}
+
 //SimpleCookieMapper is a default, cookie mapper that maps UDID strings to Session
 //objects and uses a simple cookie scheme to extract the UDIDs from requests generated by the
 //browser.
 type SimpleCookieMapper struct {
 	cook string
+	opts CookieOptions
 }
 
 //NewSimpleCookieMapper creates an instance of CookieMapper with the given application name.
+//The cookie is HttpOnly and SameSite=Lax but is not marked Secure; use
+//NewSimpleCookieMapperWithOptions and DefaultCookieOptions for deployed
+//applications.
 func NewSimpleCookieMapper(appName string) CookieMapper {
+	return NewSimpleCookieMapperWithOptions(appName, DefaultCookieOptions(nil))
+}
+
+//NewSimpleCookieMapperWithOptions creates an instance of CookieMapper with the given
+//application name and cookie attributes.  If opts is nil, DefaultCookieOptions(nil)
+//is used.  This panics if the options ask for the __Host- prefix but do not meet
+//the browser's requirements for it, since such a cookie would never be accepted.
+func NewSimpleCookieMapperWithOptions(appName string, opts *CookieOptions) CookieMapper {
+	if opts == nil {
+		opts = DefaultCookieOptions(nil)
+	}
+	name := fmt.Sprintf(SESSION_COOKIE, appName)
+	o := *opts
+	if o.Path == "" {
+		o.Path = "/"
+	}
+	if o.HostPrefix {
+		if !o.Secure || o.Domain != "" || o.Path != "/" {
+			panic(fmt.Sprintf("cookie %s: the %s prefix requires Secure, Path=/ and no Domain", name, HOST_COOKIE_PREFIX))
+		}
+		name = HOST_COOKIE_PREFIX + name
+	}
 	result := &SimpleCookieMapper{
-		cook: fmt.Sprintf(SESSION_COOKIE, appName),
+		cook: name,
+		opts: o,
 	}
 	return result
 }
 
+//newCookie returns a cookie with the given value and all the attributes
+//from our options.  Removing a cookie needs the same attributes as setting it,
+//or the browser will consider it a different cookie.
+func (self *SimpleCookieMapper) newCookie(value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     self.CookieName(),
+		Value:    value,
+		Path:     self.opts.Path,
+		Domain:   self.opts.Domain,
+		Secure:   self.opts.Secure,
+		HttpOnly: self.opts.HttpOnly,
+		SameSite: self.opts.SameSite,
+	}
+}
+
 //AssociateCookie is used to effectively "Log in" a particular user by associating a session
-//with a response w that will be sent back to their browser.
+//with a response w that will be sent back to their browser.  If the session is an
+//ExpiringSession the cookie expires at the same time as the session.
 func (self *SimpleCookieMapper) AssociateCookie(w http.ResponseWriter, s Session) {
-	cookie := &http.Cookie{
-		Name:  self.CookieName(),
-		Value: s.SessionId(),
-		Path:  "/",
+	cookie := self.newCookie(s.SessionId())
+	var expires time.Time
+	if es, ok := s.(ExpiringSession); ok {
+		expires = es.Expires()
+	}
+	if expires.IsZero() && self.opts.MaxAge > 0 {
+		expires = time.Now().Add(self.opts.MaxAge)
+	}
+	if !expires.IsZero() {
+		cookie.Expires = expires.UTC()
+		cookie.MaxAge = int(expires.Sub(time.Now()) / time.Second)
+		if cookie.MaxAge <= 0 {
+			cookie.MaxAge = -1
+		}
 	}
 	http.SetCookie(w, cookie)
 }
@@ -54,12 +141,8 @@ func (self *SimpleCookieMapper) AssociateCookie(w http.ResponseWriter, s Session
 //RemoveCookie is used to effectively "Log out" a particular user by removing the association of a session
 //with a response w that will be sent back to their browser.
 func (self *SimpleCookieMapper) RemoveCookie(w http.ResponseWriter) {
-	cookie := &http.Cookie{
-		Name:   self.CookieName(),
-		Value:  "",
-		Path:   "/",
-		MaxAge: -1,
-	}
+	cookie := self.newCookie("")
+	cookie.MaxAge = -1
 	http.SetCookie(w, cookie)
 }
 
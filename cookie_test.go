@@ -0,0 +1,87 @@
+package seven5
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testDeploy struct {
+	isTest bool
+}
+
+func (t *testDeploy) GetQbsStore() *QbsStore          { return nil }
+func (t *testDeploy) IsTest() bool                    { return t.isTest }
+func (t *testDeploy) Port() int                       { return 8080 }
+func (t *testDeploy) RedirectHost() string            { return "http://localhost:8080" }
+func (t *testDeploy) GetAppValue(name string) string  { return "" }
+func (t *testDeploy) MustAppValue(name string) string { panic(name) }
+
+func setCookieFromRecorder(t *testing.T, w *httptest.ResponseRecorder) *http.Cookie {
+	resp := http.Response{Header: w.Header()}
+	cookies := resp.Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected exactly one cookie but got %d", len(cookies))
+	}
+	return cookies[0]
+}
+
+func TestCookieOptionsDeployed(t *testing.T) {
+	cm := NewSimpleCookieMapperWithOptions("myapp", DefaultCookieOptions(&testDeploy{false}))
+	if !strings.HasPrefix(cm.CookieName(), HOST_COOKIE_PREFIX) {
+		t.Errorf("expected %s prefix on cookie name, got %s", HOST_COOKIE_PREFIX, cm.CookieName())
+	}
+	expires := time.Now().Add(2 * time.Hour)
+	s := NewSimpleSession(nil, "abc")
+	s.expires = expires
+
+	w := httptest.NewRecorder()
+	cm.AssociateCookie(w, s)
+	c := setCookieFromRecorder(t, w)
+	if !c.Secure || !c.HttpOnly || c.SameSite != http.SameSiteLaxMode || c.Path != "/" {
+		t.Errorf("cookie not hardened: %+v", c)
+	}
+	if c.Value != "abc" {
+		t.Errorf("expected session id abc but got %s", c.Value)
+	}
+	if c.Expires.Unix() != expires.Unix() {
+		t.Errorf("expected cookie to expire at %v but got %v", expires.UTC(), c.Expires)
+	}
+
+	w = httptest.NewRecorder()
+	cm.RemoveCookie(w)
+	c = setCookieFromRecorder(t, w)
+	if c.MaxAge != -1 || !c.Secure || c.Name != cm.CookieName() {
+		t.Errorf("removal cookie does not match the original: %+v", c)
+	}
+}
+
+func TestCookieOptionsTest(t *testing.T) {
+	cm := NewSimpleCookieMapperWithOptions("myapp", DefaultCookieOptions(&testDeploy{true}))
+	if cm.CookieName() != "myapp-seven5-session" {
+		t.Errorf("unexpected cookie name in test mode: %s", cm.CookieName())
+	}
+	w := httptest.NewRecorder()
+	cm.AssociateCookie(w, NewSimpleSession(nil, "abc"))
+	c := setCookieFromRecorder(t, w)
+	if c.Secure {
+		t.Errorf("did not expect secure cookie in test mode")
+	}
+	if !c.HttpOnly {
+		t.Errorf("expected HttpOnly cookie in test mode")
+	}
+	if c.MaxAge != 0 {
+		t.Errorf("session without expiration should produce a browser session cookie, got max age %d", c.MaxAge)
+	}
+}
+
+func TestCookieHostPrefixRequiresSecure(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic from insecure __Host- cookie")
+		}
+	}()
+	NewSimpleCookieMapperWithOptions("myapp", &CookieOptions{HostPrefix: true, Path: "/"})
+}
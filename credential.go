@@ -0,0 +1,251 @@
+package seven5
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	CREDENTIAL_COOKIE  = "cookie"
+	CREDENTIAL_BEARER  = "bearer"
+	CREDENTIAL_API_KEY = "apikey"
+
+	API_KEY_HEADER = "X-Api-Key"
+)
+
+//Credential is what a CredentialExtractor found in a request.  Either the
+//SessionId or the UniqueId is set.  A SessionId is looked up with the
+//SessionManager's Find, exactly as if it came from a cookie. A UniqueId
+//is a user that the extractor has already verified (for example via an
+//api key), so a session is created for it from Generate.  Source is one of
+//the CREDENTIAL_* constants and is useful for logging and for deciding which
+//credentials are acceptable for an operation.  Scopes is only used for api
+//keys, see HasScope.
+type Credential struct {
+	Source    string
+	SessionId string
+	UniqueId  string
+	Scopes    []string
+}
+
+//CredentialExtractor pulls a Credential out of a request.  It should return
+//nil, nil if the request does not carry this kind of credential at all.  If
+//the request carries a credential that is unacceptable (badly formed, expired)
+//it should return an error created with HTTPError so the client receives a
+//sensible status code.  RawIOHook consults a list of these, in order, to find
+//the session for each request.
+type CredentialExtractor interface {
+	Extract(*http.Request) (*Credential, error)
+}
+
+//CookieExtractor is the CredentialExtractor for browsers.  It uses the
+//CookieMapper to find the session id in the request's cookies.
+type CookieExtractor struct {
+	cm CookieMapper
+}
+
+//NewCookieExtractor returns a CredentialExtractor that reads session ids from
+//the cookie managed by cm.
+func NewCookieExtractor(cm CookieMapper) *CookieExtractor {
+	return &CookieExtractor{cm: cm}
+}
+
+//Extract returns the session id found in the cookie, if any.
+func (self *CookieExtractor) Extract(r *http.Request) (*Credential, error) {
+	id, err := self.cm.Value(r)
+	if err == NO_SUCH_COOKIE {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, nil
+	}
+	return &Credential{Source: CREDENTIAL_COOKIE, SessionId: id}, nil
+}
+
+//BearerExtractor is the CredentialExtractor for clients that send the token
+//they received at login in the Authorization header, as in
+//"Authorization: Bearer s5t.xxxx.yyyy".
+type BearerExtractor struct {
+	codec TokenCodec
+}
+
+//NewBearerExtractor returns a CredentialExtractor that decodes bearer tokens
+//with the codec provided.  This must be the same codec that was used to
+//issue the tokens.
+func NewBearerExtractor(codec TokenCodec) *BearerExtractor {
+	return &BearerExtractor{codec: codec}
+}
+
+//Extract returns the session id inside the bearer token, if any.  An
+//unacceptable token results in a 401.
+func (self *BearerExtractor) Extract(r *http.Request) (*Credential, error) {
+	tok := BearerToken(r)
+	if tok == "" {
+		return nil, nil
+	}
+	sid, err := self.codec.Decode(tok)
+	if err != nil {
+		return nil, HTTPError(http.StatusUnauthorized, err.Error())
+	}
+	return &Credential{Source: CREDENTIAL_BEARER, SessionId: sid}, nil
+}
+
+//ApiKeyExtractor is the CredentialExtractor for clients that send a personal
+//api key (see ApiKeyManager) or their login token in a header of its own, by
+//default X-Api-Key.
+type ApiKeyExtractor struct {
+	header string
+	codec  TokenCodec
+	keys   *ApiKeyManager
+}
+
+//NewApiKeyExtractor returns a CredentialExtractor that decodes tokens from
+//the given header with the codec provided.  If header is "", API_KEY_HEADER
+//is used.
+func NewApiKeyExtractor(header string, codec TokenCodec) *ApiKeyExtractor {
+	return NewApiKeyExtractorWithKeys(header, codec, nil)
+}
+
+//NewApiKeyExtractorWithKeys returns a CredentialExtractor like NewApiKeyExtractor
+//that also understands personal api keys issued by keys.  Either codec or keys
+//may be nil.
+func NewApiKeyExtractorWithKeys(header string, codec TokenCodec, keys *ApiKeyManager) *ApiKeyExtractor {
+	if header == "" {
+		header = API_KEY_HEADER
+	}
+	return &ApiKeyExtractor{header: header, codec: codec, keys: keys}
+}
+
+//Extract returns the owner of the api key, or the session id inside the
+//token, found in our header.  An unacceptable key or token results in a 401.
+func (self *ApiKeyExtractor) Extract(r *http.Request) (*Credential, error) {
+	tok := strings.TrimSpace(r.Header.Get(self.header))
+	if tok == "" {
+		return nil, nil
+	}
+	if self.keys != nil && IsApiKey(tok) {
+		key, err := self.keys.Verify(tok)
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			return nil, HTTPError(http.StatusUnauthorized, "unknown or revoked api key")
+		}
+		return &Credential{Source: CREDENTIAL_API_KEY, UniqueId: key.Owner, Scopes: key.ScopeList()}, nil
+	}
+	if self.codec == nil {
+		return nil, HTTPError(http.StatusUnauthorized, "badly formed api key")
+	}
+	sid, err := self.codec.Decode(tok)
+	if err != nil {
+		return nil, HTTPError(http.StatusUnauthorized, err.Error())
+	}
+	//this is a login token, it carries the full authority of the user
+	return &Credential{Source: CREDENTIAL_BEARER, SessionId: sid}, nil
+}
+
+//DefaultCredentialExtractors returns the extractors for cookies, bearer
+//tokens and the X-Api-Key header, in that order.  If codec is nil only
+//cookies are understood.
+func DefaultCredentialExtractors(cm CookieMapper, codec TokenCodec) []CredentialExtractor {
+	result := []CredentialExtractor{}
+	if cm != nil {
+		result = append(result, NewCookieExtractor(cm))
+	}
+	if codec != nil {
+		result = append(result, NewBearerExtractor(codec), NewApiKeyExtractor("", codec))
+	}
+	return result
+}
+
+//HasScope returns true if the request represented by pb may perform operations
+//requiring scope.  Requests authenticated by a cookie or login token carry the
+//full authority of the user and always have every scope; requests authenticated
+//with a personal api key have only the scopes given to the key.  Requests
+//with no credential have no scopes.  This is intended to be called from
+//Allower, AllowReader and AllowWriter implementations.
+func HasScope(pb PBundle, scope string) bool {
+	cred := CredentialOf(pb)
+	if cred == nil {
+		return false
+	}
+	if cred.Source != CREDENTIAL_API_KEY {
+		return true
+	}
+	for _, s := range cred.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+//BearerToken returns the token from an "Authorization: Bearer" header or ""
+//if there is no such header.
+func BearerToken(r *http.Request) string {
+	auth := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+//ResolveCredential uses the SessionManager to turn a credential into a
+//session.  The second return value is true if the credential referred to a
+//session the SessionManager knows nothing about (it expired, the keys
+//changed, etc), which usually means a cookie should be removed.  Note that
+//the returned session may be nil even when the credential is not stale,
+//if the Generator declines to create user data.  A credential with only a
+//UniqueId (such as an api key) produces a session that is _not_ stored in
+//the SessionManager since such clients send their credential on every
+//request; updates to such a session are lost at the end of the request.
+//Half-authenticated sessions (see PendingSecondFactor) resolve to nil.
+func ResolveCredential(sm SessionManager, cred *Credential) (Session, bool, error) {
+	if cred.SessionId == "" && cred.UniqueId != "" {
+		ud, err := sm.Generate(cred.UniqueId)
+		if err != nil {
+			return nil, false, err
+		}
+		if ud == nil {
+			return nil, false, nil
+		}
+		return NewSimpleSession(ud, ""), false, nil
+	}
+	if cred.SessionId == "" {
+		return nil, true, nil
+	}
+	sr, err := sm.Find(cred.SessionId)
+	if err != nil {
+		return nil, false, err
+	}
+	if sr == nil || (sr.Session == nil && sr.UniqueId == "") {
+		return nil, true, nil
+	}
+	if sr.Session != nil {
+		if IsPendingSecondFactor(sr.Session) {
+			return nil, false, nil
+		}
+		return sr.Session, false, nil
+	}
+	//create a new one?
+	uniq := sr.UniqueId
+	if strings.HasPrefix(uniq, s5PendingPrefix) {
+		return nil, true, nil //half-authenticated sessions are not recovered
+	}
+	ud, err := sm.Generate(uniq)
+	if err != nil {
+		return nil, false, err
+	}
+	if ud == nil {
+		return nil, false, nil
+	}
+	session, err := sm.Assign(uniq, ud, time.Time{})
+	if err != nil {
+		return nil, false, err
+	}
+	return session, false, nil
+}
@@ -0,0 +1,78 @@
+package seven5
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenCodec(t *testing.T) {
+	codec := NewSimpleTokenCodec([]byte(strings.Repeat("k", 16)))
+	tok, err := codec.Encode("some-session-id", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("unable to encode token: %v", err)
+	}
+	sid, err := codec.Decode(tok)
+	if err != nil {
+		t.Fatalf("unable to decode token: %v", err)
+	}
+	if sid != "some-session-id" {
+		t.Errorf("expected to recover some-session-id but got %s", sid)
+	}
+
+	other := NewSimpleTokenCodec([]byte(strings.Repeat("x", 16)))
+	if _, err := other.Decode(tok); err != BAD_TOKEN {
+		t.Errorf("expected token signed with a different key to be refused, got %v", err)
+	}
+	tampered := tok[:len(tok)-2] + "xx"
+	if _, err := codec.Decode(tampered); err != BAD_TOKEN {
+		t.Errorf("expected tampered token to be refused, got %v", err)
+	}
+	old, _ := codec.Encode("some-session-id", time.Now().Add(-time.Minute))
+	if _, err := codec.Decode(old); err != EXPIRED_TOKEN {
+		t.Errorf("expected expired token to be refused, got %v", err)
+	}
+}
+
+func TestBundleHookCredentials(t *testing.T) {
+	sm := NewDumbSessionManager()
+	cm := NewSimpleCookieMapper("myapp")
+	codec := NewSimpleTokenCodec([]byte(strings.Repeat("k", 16)))
+	hook := NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, cm)
+	hook.Extractors = DefaultCredentialExtractors(cm, codec)
+
+	s, _ := sm.Assign("fred", "fred's data", time.Time{})
+	tok, _ := codec.Encode(s.SessionId(), time.Time{})
+
+	for _, hdr := range []string{"Authorization", API_KEY_HEADER} {
+		r, _ := http.NewRequest("GET", "/rest/foo", nil)
+		if hdr == "Authorization" {
+			r.Header.Set(hdr, "Bearer "+tok)
+		} else {
+			r.Header.Set(hdr, tok)
+		}
+		pb, err := hook.BundleHook(httptest.NewRecorder(), r, sm)
+		if err != nil {
+			t.Fatalf("unexpected error creating bundle (%s): %v", hdr, err)
+		}
+		if pb.Session() == nil || pb.Session().SessionId() != s.SessionId() {
+			t.Errorf("expected to find the session via %s, got %+v", hdr, pb.Session())
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "/rest/foo", nil)
+	r.Header.Set("Authorization", "Bearer s5t.garbage.garbage")
+	_, err := hook.BundleHook(httptest.NewRecorder(), r, sm)
+	e, ok := err.(*Error)
+	if !ok || e.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for bad bearer token, got %v", err)
+	}
+
+	r, _ = http.NewRequest("GET", "/rest/foo", nil)
+	pb, err := hook.BundleHook(httptest.NewRecorder(), r, sm)
+	if err != nil || pb.Session() != nil {
+		t.Errorf("expected no session and no error without credentials, got %v, %v", pb, err)
+	}
+}
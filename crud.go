@@ -0,0 +1,344 @@
+package seven5
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/coocood/qbs"
+)
+
+const (
+	CRUD_DEFAULT_LIMIT = 50
+	CRUD_MAX_LIMIT     = 500
+	CRUD_TOTAL_HEADER  = "X-Total-Count"
+)
+
+//CrudHooks customize a QbsCrud.  All the fields are optional.
+type CrudHooks struct {
+	//Validate checks a value sent by the client on Post or Put.  An *Error
+	//is returned to the client as is; other errors become 400s.
+	Validate func(value interface{}, pb PBundle) error
+	//BeforeSave is called, in the transaction, just before a value is saved;
+	//it may change the value, such as by setting timestamps.
+	BeforeSave func(value interface{}, pb PBundle, q *qbs.Qbs) error
+	//Scope returns the owner for the request, typically from the session, or
+	//an error (like a 401) if there is none.  When set, OwnerField must
+	//name a field of the model: clients only see their own rows and new rows
+	//are owned by them.
+	Scope      func(pb PBundle) (interface{}, error)
+	OwnerField string
+}
+
+//qbsCrud is the implementation shared by QbsCrud and QbsCrudUdid, with ids
+//as interface{}.
+type qbsCrud struct {
+	typ   reflect.Type //the struct, not the pointer
+	udid  bool
+	hooks CrudHooks
+	owner string //column
+}
+
+//QbsCrud is a QbsRestAll for a qbs model struct whose wire type is the model
+//itself.  Index returns a page of the rows (see the query parameters offset
+//and limit, at most CRUD_MAX_LIMIT) ordered by id, and sets the
+//CRUD_TOTAL_HEADER return header.  Find, Put and Delete of a row that does
+//not exist, or is not in the requester's scope, is a 404.
+type QbsCrud struct {
+	qbsCrud
+}
+
+//QbsCrudUdid is QbsCrud for models with a string (udid) primary key, which is
+//always assigned by Post; any id sent by the client is ignored.
+type QbsCrudUdid struct {
+	qbsCrud
+}
+
+//NewQbsCrud returns a QbsCrud for the model, given as an example like
+//&Todo{}.  The model must have an int64 field Id.  Give the result to
+//QbsWrapAll and the example to RawDispatcher.Resource.
+func NewQbsCrud(example interface{}, hooks *CrudHooks) *QbsCrud {
+	return &QbsCrud{newQbsCrud(example, hooks, false)}
+}
+
+//NewQbsCrudUdid returns a QbsCrudUdid for the model, which must have a string
+//field Id (tagged qbs:"pk").  Give the result to QbsWrapAllUdid.
+func NewQbsCrudUdid(example interface{}, hooks *CrudHooks) *QbsCrudUdid {
+	return &QbsCrudUdid{newQbsCrud(example, hooks, true)}
+}
+
+func newQbsCrud(example interface{}, hooks *CrudHooks, udid bool) qbsCrud {
+	t := reflect.TypeOf(example)
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		panic("crud example should be a pointer to a struct")
+	}
+	t = t.Elem()
+	id, ok := t.FieldByName("Id")
+	want := reflect.Int64
+	if udid {
+		want = reflect.String
+	}
+	if !ok || id.Type.Kind() != want {
+		panic(fmt.Sprintf("%s must have an Id field of type %s", t.Name(), want))
+	}
+	result := qbsCrud{typ: t, udid: udid}
+	if hooks != nil {
+		result.hooks = *hooks
+	}
+	if result.hooks.Scope != nil {
+		if _, ok := t.FieldByName(result.hooks.OwnerField); !ok {
+			panic(fmt.Sprintf("%s has no owner field %q", t.Name(), result.hooks.OwnerField))
+		}
+		result.owner = qbs.FieldNameToColumnName(result.hooks.OwnerField)
+	}
+	return result
+}
+
+func (self *qbsCrud) notFound(id interface{}) error {
+	return HTTPError(http.StatusNotFound, fmt.Sprintf("no %s with id %v", strings.ToLower(self.typ.Name()), id))
+}
+
+//scope returns the owner of the request, or nil if the crud is not scoped.
+func (self *qbsCrud) scope(pb PBundle) (interface{}, error) {
+	if self.hooks.Scope == nil {
+		return nil, nil
+	}
+	return self.hooks.Scope(pb)
+}
+
+//ownerValue converts the owner returned by Scope to the type of the owner
+//field.
+func (self *qbsCrud) ownerValue(owner interface{}) reflect.Value {
+	f, _ := self.typ.FieldByName(self.hooks.OwnerField)
+	v := reflect.ValueOf(owner)
+	if !v.IsValid() || !v.Type().ConvertibleTo(f.Type) {
+		panic(fmt.Sprintf("scope returned %T but %s is %s", owner, self.hooks.OwnerField, f.Type))
+	}
+	return v.Convert(f.Type)
+}
+
+//check makes sure the value is a pointer to the model.
+func (self *qbsCrud) check(value interface{}) (reflect.Value, error) {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Ptr || v.Elem().Type() != self.typ {
+		return v, HTTPError(http.StatusBadRequest, fmt.Sprintf("expected a %s", self.typ.Name()))
+	}
+	return v, nil
+}
+
+func (self *qbsCrud) validate(value interface{}, pb PBundle) error {
+	if self.hooks.Validate == nil {
+		return nil
+	}
+	if err := self.hooks.Validate(value, pb); err != nil {
+		if _, ok := err.(*Error); ok {
+			return err
+		}
+		return HTTPError(http.StatusBadRequest, err.Error())
+	}
+	return nil
+}
+
+func (self *qbsCrud) index(pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	owner, err := self.scope(pb)
+	if err != nil {
+		return nil, err
+	}
+	limit, offset := int64(CRUD_DEFAULT_LIMIT), int64(0)
+	if pb != nil {
+		limit = pb.IntQueryParameter("limit", CRUD_DEFAULT_LIMIT)
+		offset = pb.IntQueryParameter("offset", 0)
+	}
+	if limit <= 0 || limit > CRUD_MAX_LIMIT {
+		limit = CRUD_MAX_LIMIT
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	where := func() {
+		if self.owner != "" {
+			q.WhereEqual(self.owner, self.ownerValue(owner).Interface())
+		}
+	}
+	if pb != nil {
+		where()
+		pb.SetReturnHeader(CRUD_TOTAL_HEADER, strconv.FormatInt(q.Count(reflect.New(self.typ).Interface()), 10))
+	}
+	rows := reflect.New(reflect.SliceOf(reflect.PtrTo(self.typ)))
+	where()
+	if err := q.Limit(int(limit)).Offset(int(offset)).OrderBy("id").FindAll(rows.Interface()); err != nil {
+		return nil, err
+	}
+	if rows.Elem().IsNil() {
+		rows.Elem().Set(reflect.MakeSlice(rows.Elem().Type(), 0, 0))
+	}
+	return rows.Elem().Interface(), nil
+}
+
+//find returns the row with the id if it is in scope; owner is the scope.
+func (self *qbsCrud) find(id interface{}, owner interface{}, q *qbs.Qbs) (reflect.Value, error) {
+	ptr := reflect.New(self.typ)
+	//qbs finds the first row of the table when the primary key is zero
+	switch v := id.(type) {
+	case int64:
+		if v <= 0 {
+			return ptr, self.notFound(id)
+		}
+	case string:
+		if v == "" {
+			return ptr, self.notFound(id)
+		}
+	}
+	ptr.Elem().FieldByName("Id").Set(reflect.ValueOf(id))
+	err := q.Find(ptr.Interface())
+	if err == sql.ErrNoRows {
+		return ptr, self.notFound(id)
+	}
+	if err != nil {
+		return ptr, err
+	}
+	//rows of others are not found, so as not to reveal they exist
+	if self.owner != "" && ptr.Elem().FieldByName(self.hooks.OwnerField).Interface() != self.ownerValue(owner).Interface() {
+		return ptr, self.notFound(id)
+	}
+	return ptr, nil
+}
+
+func (self *qbsCrud) findQbs(id interface{}, pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	owner, err := self.scope(pb)
+	if err != nil {
+		return nil, err
+	}
+	ptr, err := self.find(id, owner, q)
+	if err != nil {
+		return nil, err
+	}
+	return ptr.Interface(), nil
+}
+
+func (self *qbsCrud) deleteQbs(id interface{}, pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	owner, err := self.scope(pb)
+	if err != nil {
+		return nil, err
+	}
+	ptr, err := self.find(id, owner, q)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := q.Delete(ptr.Interface()); err != nil {
+		return nil, err
+	}
+	return ptr.Interface(), nil
+}
+
+func (self *qbsCrud) save(ptr reflect.Value, pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	if self.hooks.BeforeSave != nil {
+		if err := self.hooks.BeforeSave(ptr.Interface(), pb, q); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := q.Save(ptr.Interface()); err != nil {
+		return nil, err
+	}
+	return ptr.Interface(), nil
+}
+
+func (self *qbsCrud) putQbs(id interface{}, value interface{}, pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	ptr, err := self.check(value)
+	if err != nil {
+		return nil, err
+	}
+	owner, err := self.scope(pb)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := self.find(id, owner, q); err != nil {
+		return nil, err
+	}
+	if err := self.validate(value, pb); err != nil {
+		return nil, err
+	}
+	ptr.Elem().FieldByName("Id").Set(reflect.ValueOf(id))
+	if self.owner != "" {
+		ptr.Elem().FieldByName(self.hooks.OwnerField).Set(self.ownerValue(owner))
+	}
+	return self.save(ptr, pb, q)
+}
+
+func (self *qbsCrud) postQbs(value interface{}, pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	ptr, err := self.check(value)
+	if err != nil {
+		return nil, err
+	}
+	owner, err := self.scope(pb)
+	if err != nil {
+		return nil, err
+	}
+	if err := self.validate(value, pb); err != nil {
+		return nil, err
+	}
+	//the client never chooses the id, or a post could overwrite any row
+	id := ptr.Elem().FieldByName("Id")
+	if self.udid {
+		id.SetString(UDID())
+	} else {
+		id.SetInt(0)
+	}
+	if self.owner != "" {
+		ptr.Elem().FieldByName(self.hooks.OwnerField).Set(self.ownerValue(owner))
+	}
+	return self.save(ptr, pb, q)
+}
+
+//IndexQbs returns a page of the rows in the requester's scope.
+func (self *QbsCrud) IndexQbs(pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	return self.index(pb, q)
+}
+
+//FindQbs returns the row with the given id.
+func (self *QbsCrud) FindQbs(id int64, pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	return self.findQbs(id, pb, q)
+}
+
+//DeleteQbs deletes the row with the given id and returns it.
+func (self *QbsCrud) DeleteQbs(id int64, pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	return self.deleteQbs(id, pb, q)
+}
+
+//PutQbs replaces the row with the given id with the value.
+func (self *QbsCrud) PutQbs(id int64, value interface{}, pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	return self.putQbs(id, value, pb, q)
+}
+
+//PostQbs creates a new row from the value.
+func (self *QbsCrud) PostQbs(value interface{}, pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	return self.postQbs(value, pb, q)
+}
+
+//IndexQbs returns a page of the rows in the requester's scope.
+func (self *QbsCrudUdid) IndexQbs(pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	return self.index(pb, q)
+}
+
+//FindQbs returns the row with the given id.
+func (self *QbsCrudUdid) FindQbs(id string, pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	return self.findQbs(id, pb, q)
+}
+
+//DeleteQbs deletes the row with the given id and returns it.
+func (self *QbsCrudUdid) DeleteQbs(id string, pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	return self.deleteQbs(id, pb, q)
+}
+
+//PutQbs replaces the row with the given id with the value.
+func (self *QbsCrudUdid) PutQbs(id string, value interface{}, pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	return self.putQbs(id, value, pb, q)
+}
+
+//PostQbs creates a new row from the value.
+func (self *QbsCrudUdid) PostQbs(value interface{}, pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	return self.postQbs(value, pb, q)
+}
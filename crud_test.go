@@ -0,0 +1,240 @@
+package seven5
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+type CrudNote struct {
+	Id      int64
+	OwnerId int64
+	Text    string
+}
+
+type CrudTag struct {
+	Id   string `qbs:"pk"`
+	Name string
+}
+
+//CrudItem has an owner field that is not simply snake cased by qbs
+type CrudItem struct {
+	Id      int64
+	OwnerID int64
+	Text    string
+}
+
+type CrudOwnedTag struct {
+	Id      string `qbs:"pk"`
+	OwnerId int64
+	Name    string
+}
+
+func crudPBundle(owner string, query map[string]string) PBundle {
+	headers := map[string]string{}
+	if owner != "" {
+		headers["x-owner"] = owner
+	}
+	return NewTestPBundle(headers, query, nil, nil, map[string]string{}, nil)
+}
+
+func crudHooks() *CrudHooks {
+	return &CrudHooks{
+		Validate: func(value interface{}, pb PBundle) error {
+			if value.(*CrudNote).Text == "" {
+				return errors.New("text is required")
+			}
+			return nil
+		},
+		Scope: func(pb PBundle) (interface{}, error) {
+			owner, ok := pb.Header("X-Owner")
+			if !ok {
+				return nil, HTTPError(http.StatusUnauthorized, "no owner")
+			}
+			if owner == "1" {
+				return 1, nil
+			}
+			return 2, nil
+		},
+		OwnerField: "OwnerId",
+	}
+}
+
+func checkCrudStatus(t *testing.T, err error, status int) {
+	e, ok := err.(*Error)
+	if !ok || e.StatusCode != status {
+		t.Fatalf("expected status %d but got %v", status, err)
+	}
+}
+
+func TestCrudModel(t *testing.T) {
+	for _, example := range []interface{}{CrudNote{}, &struct{ Name string }{}, &CrudTag{}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected a panic for %T", example)
+				}
+			}()
+			NewQbsCrud(example, nil)
+		}()
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected a panic for a missing owner field")
+			}
+		}()
+		NewQbsCrud(&CrudNote{}, &CrudHooks{Scope: crudHooks().Scope, OwnerField: "Owner"})
+	}()
+}
+
+func TestCrudRoundTrip(t *testing.T) {
+	store := NewMemoryQbsStore(&CrudNote{})
+	defer store.Close()
+	crud := QbsWrapAll(NewQbsCrud(&CrudNote{}, crudHooks()), store)
+
+	_, err := crud.Post(&CrudNote{Text: "hi"}, crudPBundle("", nil))
+	checkCrudStatus(t, err, http.StatusUnauthorized)
+	_, err = crud.Post(&CrudNote{}, crudPBundle("1", nil))
+	checkCrudStatus(t, err, http.StatusBadRequest)
+	_, err = crud.Post(&CrudTag{Name: "x"}, crudPBundle("1", nil))
+	checkCrudStatus(t, err, http.StatusBadRequest)
+
+	var first *CrudNote
+	for i := 0; i < 3; i++ {
+		v, err := crud.Post(&CrudNote{Id: 99, OwnerId: 2, Text: "note"}, crudPBundle("1", nil))
+		if err != nil {
+			t.Fatalf("unexpected error on post: %v", err)
+		}
+		note := v.(*CrudNote)
+		if note.Id == 99 || note.OwnerId != 1 {
+			t.Fatalf("expected a new id and owner 1 but got %+v", note)
+		}
+		if first == nil {
+			first = note
+		}
+	}
+	if _, err := crud.Post(&CrudNote{Text: "other"}, crudPBundle("2", nil)); err != nil {
+		t.Fatalf("unexpected error on post: %v", err)
+	}
+
+	v, err := crud.Find(first.Id, crudPBundle("1", nil))
+	if err != nil || v.(*CrudNote).Text != "note" {
+		t.Fatalf("unexpected find result %v, %v", v, err)
+	}
+	_, err = crud.Find(first.Id, crudPBundle("2", nil))
+	checkCrudStatus(t, err, http.StatusNotFound)
+	_, err = crud.Find(1000, crudPBundle("1", nil))
+	checkCrudStatus(t, err, http.StatusNotFound)
+
+	pb := crudPBundle("1", map[string]string{"limit": "2", "offset": "1"})
+	v, err = crud.Index(pb)
+	if err != nil {
+		t.Fatalf("unexpected error on index: %v", err)
+	}
+	if notes := v.([]*CrudNote); len(notes) != 2 || notes[0].Id == first.Id {
+		t.Errorf("expected the second page of notes but got %v", notes)
+	}
+	if pb.ReturnHeader(CRUD_TOTAL_HEADER) != "3" {
+		t.Errorf("expected a total of 3 but got %q", pb.ReturnHeader(CRUD_TOTAL_HEADER))
+	}
+
+	_, err = crud.Put(first.Id, &CrudNote{Text: "stolen"}, crudPBundle("2", nil))
+	checkCrudStatus(t, err, http.StatusNotFound)
+	v, err = crud.Put(first.Id, &CrudNote{Text: "changed"}, crudPBundle("1", nil))
+	if err != nil || v.(*CrudNote).Id != first.Id || v.(*CrudNote).OwnerId != 1 {
+		t.Fatalf("unexpected put result %v, %v", v, err)
+	}
+
+	_, err = crud.Delete(first.Id, crudPBundle("2", nil))
+	checkCrudStatus(t, err, http.StatusNotFound)
+	if _, err := crud.Delete(first.Id, crudPBundle("1", nil)); err != nil {
+		t.Fatalf("unexpected error on delete: %v", err)
+	}
+	_, err = crud.Find(first.Id, crudPBundle("1", nil))
+	checkCrudStatus(t, err, http.StatusNotFound)
+}
+
+func TestCrudUdid(t *testing.T) {
+	store := NewMemoryQbsStore(&CrudTag{})
+	defer store.Close()
+	crud := QbsWrapAllUdid(NewQbsCrudUdid(&CrudTag{}, nil), store)
+
+	v, err := crud.Post(&CrudTag{Name: "go"}, nil)
+	if err != nil || v.(*CrudTag).Id == "" {
+		t.Fatalf("expected a udid to be assigned but got %v, %v", v, err)
+	}
+	id := v.(*CrudTag).Id
+	v, err = crud.Find(id, nil)
+	if err != nil || v.(*CrudTag).Name != "go" {
+		t.Fatalf("unexpected find result %v, %v", v, err)
+	}
+	v, err = crud.Index(nil)
+	if err != nil || len(v.([]*CrudTag)) != 1 {
+		t.Fatalf("unexpected index result %v, %v", v, err)
+	}
+}
+
+func TestCrudUdidPostKeepsOthersRows(t *testing.T) {
+	store := NewMemoryQbsStore(&CrudOwnedTag{})
+	defer store.Close()
+	hooks := crudHooks()
+	hooks.Validate = nil
+	crud := QbsWrapAllUdid(NewQbsCrudUdid(&CrudOwnedTag{}, hooks), store)
+
+	v, err := crud.Post(&CrudOwnedTag{Name: "mine"}, crudPBundle("1", nil))
+	if err != nil {
+		t.Fatalf("unable to post: %v", err)
+	}
+	id := v.(*CrudOwnedTag).Id
+	v, err = crud.Post(&CrudOwnedTag{Id: id, Name: "stolen"}, crudPBundle("2", nil))
+	if err != nil || v.(*CrudOwnedTag).Id == id {
+		t.Fatalf("expected a post with another owner's id to get a new id, got %v, %v", v, err)
+	}
+	v, err = crud.Find(id, crudPBundle("1", nil))
+	if err != nil || v.(*CrudOwnedTag).Name != "mine" || v.(*CrudOwnedTag).OwnerId != 1 {
+		t.Fatalf("expected the original row to be untouched, got %v, %v", v, err)
+	}
+	_, err = crud.Find(id, crudPBundle("2", nil))
+	checkCrudStatus(t, err, http.StatusNotFound)
+}
+
+func TestCrudOwnerColumn(t *testing.T) {
+	store := NewMemoryQbsStore(&CrudItem{})
+	defer store.Close()
+	hooks := crudHooks()
+	hooks.Validate = nil
+	hooks.OwnerField = "OwnerID"
+	crud := QbsWrapAll(NewQbsCrud(&CrudItem{}, hooks), store)
+
+	for _, owner := range []string{"1", "2", "2"} {
+		if _, err := crud.Post(&CrudItem{Text: owner}, crudPBundle(owner, nil)); err != nil {
+			t.Fatalf("unable to post: %v", err)
+		}
+	}
+	v, err := crud.Index(crudPBundle("2", nil))
+	if err != nil || len(v.([]*CrudItem)) != 2 {
+		t.Fatalf("expected only the owner's rows, got %v, %v", v, err)
+	}
+}
+
+func TestCrudZeroId(t *testing.T) {
+	store := NewMemoryQbsStore(&CrudNote{})
+	defer store.Close()
+	crud := QbsWrapAll(NewQbsCrud(&CrudNote{}, nil), store)
+
+	if _, err := crud.Post(&CrudNote{OwnerId: 1, Text: "first"}, nil); err != nil {
+		t.Fatalf("unable to post: %v", err)
+	}
+	_, err := crud.Find(0, nil)
+	checkCrudStatus(t, err, http.StatusNotFound)
+	_, err = crud.Put(0, &CrudNote{Text: "changed"}, nil)
+	checkCrudStatus(t, err, http.StatusNotFound)
+	_, err = crud.Delete(0, nil)
+	checkCrudStatus(t, err, http.StatusNotFound)
+
+	v, err := crud.Index(nil)
+	if notes := v.([]*CrudNote); err != nil || len(notes) != 1 || notes[0].Text != "first" {
+		t.Errorf("expected the table to be unchanged, got %v, %v", v, err)
+	}
+}
@@ -32,10 +32,17 @@ func NewHerokuDeploy(herokuName string, appName string) *HerokuDeploy {
 
 //GetQbsStore returns a Qbs store suitable for use with tihs application. The
 //implementation uses GetDSNOrDie which ends up looking for the environment
-//variable DATABASE_URL which must be set or we panic.
+//variable DATABASE_URL which must be set or we panic.  The pool of
+//connections is configured by PoolConfigFromEnv.
 func (self *HerokuDeploy) GetQbsStore() *QbsStore {
 	dsn := GetDSNOrDie()
-	return NewQbsStoreFromDSN(dsn)
+	store := NewQbsStoreFromDSN(dsn)
+	cfg, err := PoolConfigFromEnv(self)
+	if err != nil {
+		panic(err.Error())
+	}
+	store.SetPool(cfg)
+	return store
 }
 
 //IsTest returns true if the environment variable localname_TEST is set to
@@ -68,10 +75,25 @@ func (self *HerokuDeploy) RedirectHost() string {
 	return fmt.Sprintf(HEROKU_HOST, self.herokuName)
 }
 
+//GetAppValue returns the value of the environment variable localname_NAME,
+//where NAME is the upper case name given.
+func (self *HerokuDeploy) GetAppValue(name string) string {
+	return os.Getenv(strings.ToUpper(self.appName + "_" + name))
+}
+
+//MustAppValue is GetAppValue but panics if the value is not set.
+func (self *HerokuDeploy) MustAppValue(name string) string {
+	v := self.GetAppValue(name)
+	if v == "" {
+		panic(fmt.Sprintf("%s not defined", strings.ToUpper(self.appName+"_"+name)))
+	}
+	return v
+}
+
 // Url returns the string that points to the application itself.  Note that
 // this will not have a / on the end.
 func (self *HerokuDeploy) Url() string {
-	return "http://" + self.RedirectHost()
+	return self.RedirectHost()
 }
 
 //DeploymentEnvironment encodes information that cannot be obtained from the source code but can only
@@ -90,4 +112,9 @@ type DeploymentEnvironment interface {
 	//RedirectHost is needed in cases where you are using oauth because this must sent to the
 	//"other side" of the handshake without any extra knowlege.
 	RedirectHost() string
+	//GetAppValue returns a configuration value of the application, or ""
+	//if it has none.
+	GetAppValue(name string) string
+	//MustAppValue is GetAppValue but panics if the value is "".
+	MustAppValue(name string) string
 }
@@ -20,7 +20,8 @@ type Dispatcher interface {
 //on top of the existing "handler" abstraction in the net/http package.
 type ServeMux struct {
 	*http.ServeMux
-	err ErrorDispatcher
+	err      ErrorDispatcher
+	security *SecurityHeaders
 }
 
 //ErrorDispatcher is a special case of dispatcher that is only invoked when other Dispatchers return
@@ -38,7 +39,7 @@ type ErrorDispatcher interface {
 //handler, which may be nil.
 func NewServeMux() *ServeMux {
 	return &ServeMux{
-		http.NewServeMux(), nil,
+		http.NewServeMux(), nil, nil,
 	}
 }
 
@@ -50,9 +51,24 @@ func (self *ServeMux) SetErrorDispatcher(e ErrorDispatcher) {
 	self.err = e
 }
 
+//SetSecurityHeaders makes every response from the mux, including those of the
+//error dispatcher, carry the security headers of the policy; see
+//SecurityHandler.  Pass nil to turn this off.
+func (self *ServeMux) SetSecurityHeaders(p *SecurityHeaders) {
+	self.security = p
+}
+
 //ServeHTTP is a simple wrapper around the http.ServeMux method of the same name that incorporates
 //an error wrapper to allow it to implement the ErrorDispatcher protocol.
 func (self *ServeMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if self.security != nil {
+		serveSecurely(self.security, http.HandlerFunc(self.serveHTTP), w, r)
+		return
+	}
+	self.serveHTTP(w, r)
+}
+
+func (self *ServeMux) serveHTTP(w http.ResponseWriter, r *http.Request) {
 	if self.err != nil {
 		w = &ErrWrapper{w, r, self.err}
 	}
@@ -3,6 +3,8 @@ package seven5
 import (
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 //Error is a type that can be used by a resource that wants to send a particular
@@ -12,6 +14,9 @@ import (
 type Error struct {
 	StatusCode int
 	Msg        string
+	//RetryAfter, if set, is sent as the Retry-After header, usually with a
+	//503.
+	RetryAfter time.Duration
 }
 
 //error() makes this an implementation of the type error
@@ -20,7 +25,15 @@ func (self *Error) Error() string {
 }
 
 func HTTPError(code int, msg string) *Error {
-	return &Error{code, msg}
+	return &Error{StatusCode: code, Msg: msg}
+}
+
+//setHeaders sets the headers the error implies on the response.
+func (self *Error) setHeaders(w http.ResponseWriter) {
+	if self.RetryAfter > 0 {
+		secs := int64((self.RetryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	}
 }
 
 //WriteError returns an error to the client side.  If the err is of type
@@ -30,6 +43,7 @@ func HTTPError(code int, msg string) *Error {
 func WriteError(w http.ResponseWriter, err error) {
 	ourError, ok := err.(*Error)
 	if ok {
+		ourError.setHeaders(w)
 		http.Error(w, ourError.Msg, ourError.StatusCode)
 	} else {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
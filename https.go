@@ -0,0 +1,145 @@
+package seven5
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	HSTS_MAX_AGE = 365 * 24 * time.Hour
+)
+
+//JoinURL returns the absolute url of path on the host given, such as
+//DeploymentEnvironment.RedirectHost(), with exactly one / between them.  It is
+//how callback urls given to oauth providers are built.
+func JoinURL(host string, path string) string {
+	if path == "" {
+		return strings.TrimSuffix(host, "/")
+	}
+	return strings.TrimSuffix(host, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+//RequestIsHTTPS returns true if the request arrived over TLS or, if
+//trustProxy is true, if the proxy in front of us says in X-Forwarded-Proto
+//that the client used https.  Only trust the proxy if the application cannot
+//be reached except through it, as on Heroku.
+func RequestIsHTTPS(r *http.Request, trustProxy bool) bool {
+	if r.TLS != nil {
+		return true
+	}
+	if !trustProxy {
+		return false
+	}
+	proto := r.Header.Get("X-Forwarded-Proto")
+	//the first value is the one set by the proxy nearest the client
+	if comma := strings.Index(proto, ","); comma >= 0 {
+		proto = proto[:comma]
+	}
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
+//HTTPSHandler wraps the application's handler to enforce https when
+//deployed (DeploymentEnvironment.IsTest() is false).  Requests that are not
+//over https, or that are for a host other than that of RedirectHost(), are
+//redirected to the same path on RedirectHost(), which should be an https url.
+//Responses to https requests get a Strict-Transport-Security header.  When
+//testing, the handler does nothing.  The health endpoints of Server are not
+//redirected, since load balancers usually check them over plain http.
+type HTTPSHandler struct {
+	handler    http.Handler
+	env        DeploymentEnvironment
+	trustProxy bool
+	hsts       string
+	exempt     map[string]bool
+	canonical  *url.URL
+}
+
+//NewHTTPSHandler returns a handler that wraps h.  It trusts
+//X-Forwarded-Proto and sends HSTS with a max-age of HSTS_MAX_AGE and
+//includeSubDomains.  It panics if env is not a test environment and
+//RedirectHost() is not an absolute url.
+func NewHTTPSHandler(h http.Handler, env DeploymentEnvironment) *HTTPSHandler {
+	result := &HTTPSHandler{
+		handler:    h,
+		env:        env,
+		trustProxy: true,
+		exempt:     map[string]bool{HEALTH_LIVE_PATH: true, HEALTH_READY_PATH: true},
+	}
+	if !env.IsTest() {
+		canonical, err := url.Parse(env.RedirectHost())
+		if err != nil || canonical.Host == "" {
+			panic(fmt.Sprintf("unable to understand redirect host %q", env.RedirectHost()))
+		}
+		result.canonical = canonical
+	}
+	result.SetHSTS(HSTS_MAX_AGE, true, false)
+	return result
+}
+
+//SetTrustProxy sets whether X-Forwarded-Proto is believed; see RequestIsHTTPS.
+func (self *HTTPSHandler) SetTrustProxy(b bool) {
+	self.trustProxy = b
+}
+
+//SetHSTS changes the Strict-Transport-Security header.  A maxAge of zero
+//turns HSTS off.  Only set preload if the domain is (or will be) submitted
+//to the browsers' preload list.
+func (self *HTTPSHandler) SetHSTS(maxAge time.Duration, includeSubdomains bool, preload bool) {
+	if maxAge <= 0 {
+		self.hsts = ""
+		return
+	}
+	self.hsts = fmt.Sprintf("max-age=%d", int64(maxAge/time.Second))
+	if includeSubdomains {
+		self.hsts += "; includeSubDomains"
+	}
+	if preload {
+		self.hsts += "; preload"
+	}
+}
+
+//Exempt stops requests for the paths given from being redirected.
+func (self *HTTPSHandler) Exempt(path ...string) {
+	for _, p := range path {
+		self.exempt[p] = true
+	}
+}
+
+func sameHost(a string, b string) bool {
+	if h, _, err := net.SplitHostPort(a); err == nil {
+		a = h
+	}
+	if h, _, err := net.SplitHostPort(b); err == nil {
+		b = h
+	}
+	return strings.EqualFold(a, b)
+}
+
+func (self *HTTPSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if self.env.IsTest() || self.exempt[r.URL.Path] {
+		self.handler.ServeHTTP(w, r)
+		return
+	}
+	secure := RequestIsHTTPS(r, self.trustProxy)
+	if !secure || !sameHost(r.Host, self.canonical.Host) {
+		target := JoinURL(self.canonical.String(), r.URL.EscapedPath())
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		code := http.StatusMovedPermanently
+		if r.Method != "GET" && r.Method != "HEAD" {
+			//keeps the method and body
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, target, code)
+		return
+	}
+	if self.hsts != "" {
+		w.Header().Set("Strict-Transport-Security", self.hsts)
+	}
+	self.handler.ServeHTTP(w, r)
+}
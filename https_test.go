@@ -0,0 +1,92 @@
+package seven5
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type testProdDeploy struct {
+	testDeploy
+}
+
+func (t *testProdDeploy) RedirectHost() string { return "https://www.example.com" }
+
+type testBadHostDeploy struct {
+	testDeploy
+}
+
+func (t *testBadHostDeploy) RedirectHost() string { return "www.example.com" }
+
+func TestHTTPSHandler(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	h := NewHTTPSHandler(ok, &testProdDeploy{})
+
+	cases := []struct {
+		method, url, proto string
+		code               int
+		location           string
+		hsts               bool
+	}{
+		{"GET", "http://www.example.com/a/b?x=1", "", http.StatusMovedPermanently, "https://www.example.com/a/b?x=1", false},
+		{"GET", "http://www.example.com/a", "https", http.StatusOK, "", true},
+		{"GET", "http://www.example.com/a%2Fb%20c", "", http.StatusMovedPermanently, "https://www.example.com/a%2Fb%20c", false},
+		{"GET", "http://www.example.com/a", "http, https", http.StatusMovedPermanently, "https://www.example.com/a", false},
+		{"GET", "http://example.com/a", "https", http.StatusMovedPermanently, "https://www.example.com/a", false},
+		{"POST", "http://www.example.com/api", "", http.StatusPermanentRedirect, "https://www.example.com/api", false},
+		{"GET", "https://www.example.com:443/", "", http.StatusOK, "", true},
+		{"GET", "http://10.0.0.1" + HEALTH_READY_PATH, "", http.StatusOK, "", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.url, nil)
+		if c.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", c.proto)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.code || w.Header().Get("Location") != c.location {
+			t.Errorf("%s %s (%s): expected %d %s but got %d %s", c.method, c.url, c.proto, c.code, c.location, w.Code, w.Header().Get("Location"))
+		}
+		hsts := w.Header().Get("Strict-Transport-Security")
+		if c.hsts && hsts != "max-age=31536000; includeSubDomains" {
+			t.Errorf("%s: expected HSTS but got %q", c.url, hsts)
+		}
+		if !c.hsts && hsts != "" {
+			t.Errorf("%s: expected no HSTS but got %q", c.url, hsts)
+		}
+	}
+
+	h.SetTrustProxy(false)
+	r := httptest.NewRequest("GET", "http://www.example.com/a", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusMovedPermanently {
+		t.Errorf("expected untrusted X-Forwarded-Proto to be ignored, got %d", w.Code)
+	}
+
+	test := NewHTTPSHandler(ok, &testDeploy{true})
+	w = httptest.NewRecorder()
+	test.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080/a", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Strict-Transport-Security") != "" {
+		t.Errorf("expected nothing to happen when testing, got %d", w.Code)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected a redirect host without a scheme to be refused")
+			}
+		}()
+		NewHTTPSHandler(ok, &testBadHostDeploy{})
+	}()
+
+	if JoinURL("https://example.com/", "/cb") != "https://example.com/cb" || JoinURL("https://example.com", "cb") != "https://example.com/cb" {
+		t.Errorf("unexpected JoinURL result")
+	}
+	if NewHerokuDeploy("damp-sierra", "s5herokutest").Url() != "https://damp-sierra.herokuapp.com" {
+		t.Errorf("expected heroku url to be https, got %s", NewHerokuDeploy("damp-sierra", "s5herokutest").Url())
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"net/http"
 	"os"
 	"reflect"
-	"time"
 )
 
 //IOHook is an interface provided as a convenience to those who want to override
@@ -24,10 +23,12 @@ type IOHook interface {
 }
 
 //RawIOHook is the default implementation of the IOHook used by the RawDispatcher.
+//If Extractors is nil, the only credential understood is the cookie from CookieMap.
 type RawIOHook struct {
-	Dec       Decoder
-	Enc       Encoder
-	CookieMap CookieMapper
+	Dec        Decoder
+	Enc        Encoder
+	CookieMap  CookieMapper
+	Extractors []CredentialExtractor
 }
 
 //CookieMapper is exposed because other parts of the system may need access to the
@@ -46,6 +47,15 @@ func NewRawIOHook(d Decoder, e Encoder, c CookieMapper) *RawIOHook {
 	return &RawIOHook{Dec: d, Enc: e, CookieMap: c}
 }
 
+//CredentialExtractors returns the extractors consulted, in order, by BundleHook to
+//find the session associated with a request.
+func (self *RawIOHook) CredentialExtractors() []CredentialExtractor {
+	if self.Extractors != nil {
+		return self.Extractors
+	}
+	return DefaultCredentialExtractors(self.CookieMap, nil)
+}
+
 //BodyHook is called to create a wire object of the appopriate type and fill in the values
 //in that object from the request body.  BodyHook calls the decoder provided at creation time
 //take the bytes provided by the body and initialize the object that is ultimately returned.
@@ -84,48 +94,38 @@ func (self *RawIOHook) BodyHook(r *http.Request, obj *restShared) (interface{},
 //using cookies and sessions to compute the bundle.  Note that the ResponseWriter is passed
 //here but the BundleHook _must_ be careful to not force it out the server--it should only
 //add headers.  Note that the session manager may receive a call back if the consumer
-//of the pbundle does Update().
+//of the pbundle does Update().  The CredentialExtractors are consulted in order and the
+//first one that yields a live session wins; a stale cookie is removed from the browser.
 func (self *RawIOHook) BundleHook(w http.ResponseWriter, r *http.Request, sm SessionManager) (PBundle, error) {
 	var session Session
-	if self.CookieMap != nil {
-		var err error
-		id, err := self.CookieMap.Value(r)
-		if err != nil && err != NO_SUCH_COOKIE {
-			return nil, err
-		}
-		var findErr error
-		if sm != nil {
-			var sr *SessionReturn
-			if err != NO_SUCH_COOKIE {
-				sr, findErr = sm.Find(id)
-				if findErr != nil {
-					return nil, findErr
-				}
-				if sr == nil {
+	var found *Credential
+	if sm != nil {
+		for _, ex := range self.CredentialExtractors() {
+			cred, err := ex.Extract(r)
+			if err != nil {
+				return nil, err
+			}
+			if cred == nil {
+				continue
+			}
+			s, stale, err := ResolveCredential(sm, cred)
+			if err != nil {
+				return nil, err
+			}
+			if stale {
+				if cred.Source == CREDENTIAL_COOKIE && self.CookieMap != nil {
 					self.CookieMap.RemoveCookie(w)
 				}
-				if sr != nil {
-					if sr.UniqueId != "" {
-						//create a new one?
-						ud, genErr := sm.Generate(sr.UniqueId)
-						if genErr != nil {
-							return nil, genErr
-						} else if ud != nil {
-							var assignErr error
-							session, assignErr = sm.Assign(sr.UniqueId, ud, time.Time{})
-							if assignErr != nil {
-								return nil, assignErr
-							}
-						}
-					} else {
-						//we have a session
-						session = sr.Session
-					}
-				}
+				continue
+			}
+			session = s
+			if s != nil {
+				found = cred
 			}
+			break
 		}
 	}
-	pb, err := NewSimplePBundle(r, session, sm)
+	pb, err := NewSimplePBundleWithCredential(r, session, sm, found)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,218 @@
+package seven5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var (
+	BAD_MAIL_HEADER = errors.New("Mail header contains a line break")
+)
+
+//MailMessage is a single email.  Text is required, HTML is optional; if
+//both are present the message is sent as multipart/alternative.
+type MailMessage struct {
+	From    string
+	To      []string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+//Mailer delivers email.  SMTPMailer is the implementation for real deployments
+//and OutboxMailer is intended for tests and local development.
+type Mailer interface {
+	Send(msg *MailMessage) error
+}
+
+//Bytes returns the message in the wire format (RFC 5322) used by SMTP.
+func (self *MailMessage) Bytes() ([]byte, error) {
+	for _, h := range append([]string{self.From, self.Subject}, self.To...) {
+		if strings.ContainsAny(h, "\r\n") {
+			return nil, BAD_MAIL_HEADER
+		}
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", self.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(self.To, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", self.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	if self.HTML == "" {
+		fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		buf.WriteString(self.Text)
+		return buf.Bytes(), nil
+	}
+	var body bytes.Buffer
+	mp := multipart.NewWriter(&body)
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mp.Boundary())
+	for _, part := range []struct{ kind, content string }{{"text/plain", self.Text}, {"text/html", self.HTML}} {
+		w, err := mp.CreatePart(textproto.MIMEHeader{"Content-Type": {part.kind + "; charset=utf-8"}})
+		if err != nil {
+			return nil, err
+		}
+		w.Write([]byte(part.content))
+	}
+	if err := mp.Close(); err != nil {
+		return nil, err
+	}
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+//
+// SMTP
+//
+
+//SMTPMailer sends mail through an SMTP server, using STARTTLS if the server
+//supports it.
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+}
+
+//NewSMTPMailer returns a Mailer that sends through the SMTP server at host
+//and port.  If username is not "", PLAIN authentication is used; the smtp
+//package refuses to send the password unless the connection is encrypted
+//or to localhost.
+func NewSMTPMailer(host string, port int, username, password string) *SMTPMailer {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &SMTPMailer{addr: fmt.Sprintf("%s:%d", host, port), auth: auth}
+}
+
+func (self *SMTPMailer) Send(msg *MailMessage) error {
+	b, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(self.addr, self.auth, msg.From, msg.To, b)
+}
+
+//
+// OUTBOX
+//
+
+//OutboxMailer keeps the messages it is asked to send in memory, and also
+//writes each of them to a .eml file if it was given a directory.  This is
+//useful in tests and when developing locally without an SMTP server.
+type OutboxMailer struct {
+	dir      string
+	lock     sync.Mutex
+	messages []*MailMessage
+}
+
+//NewOutboxMailer returns an OutboxMailer.  If dir is "", messages are only
+//kept in memory.
+func NewOutboxMailer(dir string) *OutboxMailer {
+	return &OutboxMailer{dir: dir}
+}
+
+func (self *OutboxMailer) Send(msg *MailMessage) error {
+	b, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.messages = append(self.messages, msg)
+	if self.dir == "" {
+		return nil
+	}
+	name := fmt.Sprintf("%d-%03d.eml", time.Now().Unix(), len(self.messages))
+	return ioutil.WriteFile(filepath.Join(self.dir, name), b, 0600)
+}
+
+//Messages returns all the messages sent so far, oldest first.
+func (self *OutboxMailer) Messages() []*MailMessage {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	result := make([]*MailMessage, len(self.messages))
+	copy(result, self.messages)
+	return result
+}
+
+//Last returns the most recently sent message or nil.
+func (self *OutboxMailer) Last() *MailMessage {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.messages) == 0 {
+		return nil
+	}
+	return self.messages[len(self.messages)-1]
+}
+
+//Clear forgets all the messages sent so far.  Files already written are
+//not removed.
+func (self *OutboxMailer) Clear() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.messages = nil
+}
+
+//
+// TEMPLATES AND LINKS
+//
+
+//mailTemplate is the subject and body of an email as text/templates.
+type mailTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+func newMailTemplate(subject string, body string) (*mailTemplate, error) {
+	s, err := template.New("subject").Parse(subject)
+	if err != nil {
+		return nil, err
+	}
+	b, err := template.New("body").Parse(body)
+	if err != nil {
+		return nil, err
+	}
+	return &mailTemplate{subject: s, body: b}, nil
+}
+
+//message executes the templates with data to produce a plain text message.
+func (self *mailTemplate) message(from string, to string, data interface{}) (*MailMessage, error) {
+	var subject, body bytes.Buffer
+	if err := self.subject.Execute(&subject, data); err != nil {
+		return nil, err
+	}
+	if err := self.body.Execute(&body, data); err != nil {
+		return nil, err
+	}
+	return &MailMessage{
+		From:    from,
+		To:      []string{to},
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    body.String(),
+	}, nil
+}
+
+//signedLink returns base with a query parameter t that holds the payload
+//signed (and made to expire) by the codec.
+func signedLink(codec TokenCodec, base string, payload string, expires time.Time) (string, error) {
+	tok, err := codec.Encode(payload, expires)
+	if err != nil {
+		return "", err
+	}
+	sep := "?"
+	if strings.Contains(base, "?") {
+		sep = "&"
+	}
+	return base + sep + "t=" + url.QueryEscape(tok), nil
+}
@@ -0,0 +1,388 @@
+package migrate
+
+import (
+	"bytes"
+	"database/sql"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+//migratorConformance is the behavior every Migrator must have; open returns
+//a migrator on a database without the test's tables, the same database each
+//time.
+func migratorConformance(t *testing.T, open func(t *testing.T) Migrator) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, Migrator)
+	}{
+		{"NumberAtStart", testMigrateNumberAtStart},
+		{"UpDown", testMigrateNumberUpDown},
+		{"UpToDownTo", testMigrateUpToDownTo},
+		{"FailedStep", testMigrateFailedStep},
+		{"History", testMigrateHistory},
+		{"Drift", testMigrateDrift},
+		{"DryRun", testMigrateDryRun},
+		{"Schema", testMigrateSchema},
+		{"Lock", func(t *testing.T, m Migrator) {
+			other := open(t)
+			defer other.Close()
+			testMigrateLock(t, m, other)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := open(t)
+			//after the test, just get rid of the things we tested
+			defer func() {
+				db := testDB(m)
+				db.Exec("DROP TABLE foobar")
+				db.Exec("DROP TABLE " + MIGRATION_TABLE)
+				db.Exec("DROP TABLE IF EXISTS " + MIGRATION_LOCK_TABLE)
+				m.Close()
+			}()
+			if err := m.DestroyMigrationRecords(); err != nil {
+				t.Fatalf("unable to clear the migration records: %v", err)
+			}
+			test.fn(t, m)
+		})
+	}
+}
+
+func testDB(m Migrator) *sql.DB {
+	return m.(interface {
+		database() *sql.DB
+	}).database()
+}
+
+func checkMigrationApplication(t *testing.T, m Migrator, performed int, after int, fn func() (int, error)) {
+	p, err := fn()
+	if err != nil {
+		t.Fatalf("failed to perform migration: %v", err)
+	}
+	if p != performed {
+		t.Errorf("expected to have done %d migrations, but did %d", performed, p)
+	}
+	curr, err := m.CurrentMigrationNumber()
+	if err != nil {
+		t.Fatalf("could not check the current migration number: %v", err)
+	}
+	if curr != after {
+		t.Errorf("expected to be at migration %d but really at %d", after, curr)
+	}
+}
+
+func testMigrateNumberAtStart(t *testing.T, m Migrator) {
+	record, err := m.CurrentMigrationNumber()
+	if err != nil {
+		t.Fatalf("Unable to fetch migration number: %v", err)
+	}
+	if record != 0 {
+		t.Errorf("wrong migration found, expected 0 got %d", record)
+	}
+}
+
+func testMigrateNumberUpDown(t *testing.T, m Migrator) {
+	checkMigrationApplication(t, m, 2, 2, func() (int, error) {
+		return m.Up(migs.Up)
+	})
+
+	//hacky way to simulate some data
+	db := testDB(m)
+	if _, err := db.Exec("INSERT INTO foobar(i,t) VALUES (2,'blah'), (42,'answer')"); err != nil {
+		t.Fatalf("error during insert: %v", err)
+	}
+
+	//down 1 migration
+	checkMigrationApplication(t, m, 1, 1, func() (int, error) {
+		return m.DownTo(1, migs.Down)
+	})
+
+	//check the values got converted
+	var s1, s2 string
+	if err := db.QueryRow("SELECT s FROM foobar WHERE i = 2").Scan(&s1); err != nil {
+		t.Fatalf("error doing select of data converted (1): %v", err)
+	}
+	if s1 != "blah" {
+		t.Errorf("expected blah but got %s", s1)
+	}
+	if err := db.QueryRow("SELECT s FROM foobar WHERE i = 42").Scan(&s2); err != nil {
+		t.Fatalf("error doing select of data converted (2): %v", err)
+	}
+	if s2 != "answer" {
+		t.Errorf("expected answer but got %s", s2)
+	}
+
+	//run last migration
+	checkMigrationApplication(t, m, 1, 0, func() (int, error) {
+		return m.DownTo(0, migs.Down)
+	})
+}
+
+func testMigrateUpToDownTo(t *testing.T, m Migrator) {
+	checkMigrationApplication(t, m, 1, 1, func() (int, error) {
+		return m.UpTo(1, migs.Up)
+	})
+	//already there
+	checkMigrationApplication(t, m, 0, 1, func() (int, error) {
+		return m.UpTo(1, migs.Up)
+	})
+	checkMigrationApplication(t, m, 1, 2, func() (int, error) {
+		return m.Up(migs.Up)
+	})
+	checkMigrationApplication(t, m, 0, 2, func() (int, error) {
+		return m.DownTo(2, migs.Down)
+	})
+	checkMigrationApplication(t, m, 2, 0, func() (int, error) {
+		return m.Down(migs.Down)
+	})
+	checkMigrationApplication(t, m, 0, 0, func() (int, error) {
+		return m.Down(migs.Down)
+	})
+}
+
+func testMigrateFailedStep(t *testing.T, m Migrator) {
+	up := map[int]MigrationFunc{
+		1: oneUp,
+		2: twoUp,
+		//the table already exists, so this fails and is rolled back
+		3: func(tx *sql.Tx) error {
+			if _, err := tx.Exec("INSERT INTO foobar(i,t) VALUES (3,'three')"); err != nil {
+				return err
+			}
+			_, err := tx.Exec("CREATE TABLE foobar (i int)")
+			return err
+		},
+	}
+	n, err := m.Up(up)
+	if err == nil {
+		t.Fatalf("expected migration 3 to fail")
+	}
+	if n != 2 {
+		t.Errorf("expected 2 migrations to succeed but got %d", n)
+	}
+	curr, err := m.CurrentMigrationNumber()
+	if err != nil || curr != 2 {
+		t.Errorf("expected to be at migration 2 but got %d (%v)", curr, err)
+	}
+	var count int
+	if err := testDB(m).QueryRow("SELECT count(*) FROM foobar").Scan(&count); err != nil || count != 0 {
+		t.Errorf("expected the failed migration to be rolled back but found %d rows (%v)", count, err)
+	}
+}
+
+func testMigrateHistory(t *testing.T, m Migrator) {
+	if _, err := m.Up(migs.Up); err != nil {
+		t.Fatalf("failed to perform migration: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := m.DumpHistory(&buf); err != nil {
+		t.Fatalf("unable to get history: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "002 ") || !strings.HasPrefix(lines[1], "001 ") {
+		t.Errorf("unexpected history %q", buf.String())
+	}
+}
+
+func driftFiles(t *testing.T, two string) *Definitions {
+	fsys := fstest.MapFS{
+		"001_foobar.up.sql":   &fstest.MapFile{Data: []byte("CREATE TABLE foobar (i int)")},
+		"001_foobar.down.sql": &fstest.MapFile{Data: []byte("DROP TABLE foobar")},
+		"002_t.up.sql":        &fstest.MapFile{Data: []byte(two)},
+		"002_t.down.sql":      &fstest.MapFile{Data: []byte("ALTER TABLE foobar DROP COLUMN t")},
+	}
+	defn, err := LoadDefinitions(fsys, ".", nil)
+	if err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+	return defn
+}
+
+func testMigrateDrift(t *testing.T, m Migrator) {
+	defn := driftFiles(t, "ALTER TABLE foobar ADD COLUMN t text")
+	checkMigrationApplication(t, m, 1, 1, func() (int, error) {
+		return m.UpDefinitions(1, defn, false)
+	})
+	checkMigrationApplication(t, m, 1, 2, func() (int, error) {
+		return m.UpDefinitions(0, defn, false)
+	})
+	history, err := m.History()
+	if err != nil || len(history) != 2 || history[0].Name != "t" || history[0].Checksum != defn.Checksums[2] {
+		t.Fatalf("unexpected history %+v (%v)", history, err)
+	}
+	if err := m.Verify(defn); err != nil {
+		t.Errorf("unexpected drift: %v", err)
+	}
+
+	//someone edits migration 2 after it was performed
+	changed := driftFiles(t, "ALTER TABLE foobar ADD COLUMN t varchar(80)")
+	changed.Up[3] = SQLMigration("CREATE INDEX foobar_i ON foobar (i)")
+	changed.Down[3] = SQLMigration("DROP INDEX foobar_i")
+	err = m.Verify(changed)
+	if d, ok := err.(*DriftError); !ok || len(d.Problems) != 1 || !strings.HasPrefix(d.Problems[0], "002 t") {
+		t.Fatalf("expected drift of migration 2 but got %v", err)
+	}
+	if n, err := m.UpDefinitions(0, changed, false); n != 0 || err == nil {
+		t.Errorf("expected up to refuse to run with drift")
+	}
+	checkMigrationApplication(t, m, 1, 3, func() (int, error) {
+		return m.UpDefinitions(0, changed, true)
+	})
+
+	//migrations that are no longer defined are drift too
+	if _, ok := m.Verify(driftFiles(t, "ALTER TABLE foobar ADD COLUMN t text")).(*DriftError); !ok {
+		t.Errorf("expected drift for a migration that is not defined")
+	}
+	//and Go steps have no checksums to compare
+	if err := m.Verify(&Definitions{Up: map[int]MigrationFunc{1: oneUp, 2: twoUp, 3: oneUp}}); err != nil {
+		t.Errorf("unexpected drift: %v", err)
+	}
+}
+
+func testMigrateDryRun(t *testing.T, m Migrator) {
+	plan, err := m.DryRun(2, &migs)
+	if err != nil {
+		t.Fatalf("failed to dry run: %v", err)
+	}
+	if len(plan.Steps) != 2 || plan.Steps[0].N != 1 || plan.Steps[1].N != 2 {
+		t.Fatalf("unexpected plan %+v", plan)
+	}
+	if s := plan.Steps[0].Statements; len(s) != 1 || !strings.HasPrefix(s[0].SQL, "CREATE TABLE foobar") {
+		t.Errorf("unexpected statements of migration 1 %+v", s)
+	}
+	if len(plan.Steps[1].Statements) < 2 {
+		t.Errorf("expected the statements of migration 2 but got %+v", plan.Steps[1].Statements)
+	}
+	var buf bytes.Buffer
+	plan.Print(&buf)
+	if !strings.Contains(buf.String(), "-- UP 002") || !strings.Contains(buf.String(), "ALTER TABLE foobar ADD COLUMN t text;") {
+		t.Errorf("unexpected plan output %q", buf.String())
+	}
+	//nothing was performed
+	if curr, err := m.CurrentMigrationNumber(); err != nil || curr != 0 {
+		t.Errorf("expected to be at migration 0 after a dry run but got %d (%v)", curr, err)
+	}
+	if _, err := testDB(m).Exec("SELECT * FROM foobar"); err == nil {
+		t.Errorf("expected the dry run to be rolled back")
+	}
+
+	checkMigrationApplication(t, m, 2, 2, func() (int, error) {
+		return m.Up(migs.Up)
+	})
+	plan, err = m.DryRun(0, &migs)
+	if err != nil || len(plan.Steps) != 2 || !plan.Steps[0].Down || plan.Steps[0].N != 2 {
+		t.Fatalf("unexpected down plan %+v (%v)", plan, err)
+	}
+	if curr, err := m.CurrentMigrationNumber(); err != nil || curr != 2 {
+		t.Errorf("expected to be at migration 2 after a dry run but got %d (%v)", curr, err)
+	}
+
+	//a failure stops the plan
+	up := map[int]MigrationFunc{3: SQLMigration("CREATE TABLE foobar (i int)")}
+	plan, err = m.DryRun(3, &Definitions{Up: up})
+	if err == nil || len(plan.Steps) != 1 || plan.Steps[0].Err == nil || plan.Steps[0].Statements[0].Err == nil {
+		t.Errorf("expected the dry run to fail but got %+v (%v)", plan, err)
+	}
+}
+
+//the models of testMigrateSchema
+type foobar struct {
+	I    int64 `qbs:"index"`
+	T    string
+	Name string `qbs:"size:64,unique"`
+}
+
+type gizmo struct {
+	Id    int64
+	Label string `qbs:"notnull"`
+	Made  time.Time
+	Owner *foobar
+}
+
+func testMigrateSchema(t *testing.T, m Migrator) {
+	if _, err := m.Up(migs.Up); err != nil {
+		t.Fatalf("failed to perform migration: %v", err)
+	}
+	schema, err := m.Schema()
+	if err != nil {
+		t.Fatalf("unable to get the schema: %v", err)
+	}
+	if len(schema.Tables) != 1 || schema.Tables[0].Name != "foobar" || len(schema.Tables[0].Columns) != 2 ||
+		schema.Tables[0].Columns[0].Name != "i" || schema.Tables[0].Columns[1].Name != "t" {
+		t.Fatalf("unexpected schema %+v", schema.Tables)
+	}
+
+	models := []interface{}{&foobar{}, &gizmo{}}
+	diff, err := m.SchemaDiff(models)
+	if err != nil {
+		t.Fatalf("unable to diff: %v", err)
+	}
+	if len(diff.Tables) != 1 || diff.Tables[0].Name != "gizmo" || !diff.Tables[0].Columns[0].PK || len(diff.Tables[0].Columns) != 3 {
+		t.Errorf("expected the table gizmo but got %+v", diff.Tables)
+	}
+	if len(diff.Columns) != 1 || diff.Columns[0].Table != "foobar" || diff.Columns[0].Column.Name != "name" {
+		t.Errorf("expected the column foobar.name but got %+v", diff.Columns)
+	}
+	if len(diff.Indexes) != 2 || diff.Indexes[0].Name != "foobar_i_idx" || !diff.Indexes[1].Unique {
+		t.Errorf("expected the indexes of foobar but got %+v", diff.Indexes)
+	}
+
+	//the generated migration makes the schema the same as the models
+	defn := &Definitions{
+		Up:   map[int]MigrationFunc{1: oneUp, 2: twoUp, 3: SQLMigration(diff.Up())},
+		Down: map[int]MigrationFunc{1: oneDown, 2: twoDown, 3: SQLMigration(diff.Down())},
+	}
+	checkMigrationApplication(t, m, 1, 3, func() (int, error) {
+		return m.UpDefinitions(0, defn, false)
+	})
+	if after, err := m.SchemaDiff(models); err != nil || !after.Empty() {
+		t.Errorf("expected no differences after the migration but got %+v (%v)", after, err)
+	}
+	checkMigrationApplication(t, m, 1, 2, func() (int, error) {
+		return m.DownTo(2, defn.Down)
+	})
+	if after, err := m.SchemaDiff(models); err != nil || after.Up() != diff.Up() {
+		t.Errorf("expected the down migration to undo the up migration but got %+v (%v)", after, err)
+	}
+}
+
+func testMigrateLock(t *testing.T, m Migrator, other Migrator) {
+	unlock, err := m.(interface {
+		lock() (func(), error)
+	}).lock()
+	if err != nil {
+		t.Fatalf("unable to take the lock: %v", err)
+	}
+	other.SetLockTimeout(2 * MIGRATION_LOCK_POLL)
+	n, err := other.Up(migs.Up)
+	locked, ok := err.(*LockedError)
+	if !ok || n != 0 || locked.Holder == "" {
+		t.Fatalf("expected the other migrator to be locked out but got %d, %v", n, err)
+	}
+	if locked.Waited < 2*MIGRATION_LOCK_POLL {
+		t.Errorf("expected the other migrator to wait but it waited %v", locked.Waited)
+	}
+	unlock()
+
+	//both try at once, but the migrations are only performed once
+	other.SetLockTimeout(10 * time.Second)
+	results := make(chan int)
+	for _, mig := range []Migrator{m, other} {
+		go func(mig Migrator) {
+			n, err := mig.Up(migs.Up)
+			if err != nil {
+				t.Errorf("failed to perform migration: %v", err)
+			}
+			results <- n
+		}(mig)
+	}
+	total := <-results + <-results
+	if total != 2 {
+		t.Errorf("expected the 2 migrations to be performed once but %d were", total)
+	}
+	if curr, err := m.CurrentMigrationNumber(); err != nil || curr != 2 {
+		t.Errorf("expected to be at migration 2 but got %d (%v)", curr, err)
+	}
+}
@@ -0,0 +1,74 @@
+package migrate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Applied is the record of a migration that has been performed.  Migrations
+//performed by Up and UpTo, or before checksums were kept, have no name or
+//checksum.
+type Applied struct {
+	N        int
+	Name     string
+	Checksum string
+	T        time.Time
+}
+
+//DriftError is the error for migrations that have been performed but are
+//no longer the same in the Definitions, such as because someone edited the
+//file of an old migration.
+type DriftError struct {
+	Problems []string
+}
+
+func (e *DriftError) Error() string {
+	return "migrations have drifted from the database:\n\t" + strings.Join(e.Problems, "\n\t")
+}
+
+//Checksum returns the checksum of the content of a migration.
+func Checksum(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+//checksum returns the checksum of migration n, or "" if it has none.
+func (d *Definitions) checksum(n int) string {
+	if d.Checksums == nil {
+		return ""
+	}
+	return d.Checksums[n]
+}
+
+func (d *Definitions) name(n int) string {
+	if d.Names == nil {
+		return ""
+	}
+	return d.Names[n]
+}
+
+//drift compares the history with the definitions.
+func drift(history []Applied, defn *Definitions) error {
+	var problems []string
+	for _, a := range history {
+		if _, ok := defn.Up[a.N]; !ok {
+			problems = append(problems, fmt.Sprintf("%03d was performed but is not defined", a.N))
+			continue
+		}
+		if name := defn.name(a.N); a.Name != "" && name != "" && a.Name != name {
+			problems = append(problems, fmt.Sprintf("%03d was performed as %s but is now %s", a.N, a.Name, name))
+		}
+		if sum := defn.checksum(a.N); a.Checksum != "" && sum != "" && a.Checksum != sum {
+			problems = append(problems, fmt.Sprintf("%03d %s has changed since it was performed", a.N, defn.name(a.N)))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return &DriftError{Problems: problems}
+}
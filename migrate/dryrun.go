@@ -0,0 +1,284 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Statement is a statement a migration issued during a dry run.
+type Statement struct {
+	SQL      string
+	Args     []interface{}
+	Duration time.Duration
+	Err      error
+}
+
+//PlanStep is a migration performed during a dry run.
+type PlanStep struct {
+	N          int
+	Name       string
+	Down       bool
+	Statements []Statement
+	Duration   time.Duration
+	Err        error
+}
+
+//Plan is the result of a dry run: the migrations that would be performed
+//and the statements they issue.
+type Plan struct {
+	Steps []PlanStep
+}
+
+//Print writes the plan as SQL, with the timing of each statement and
+//migration in comments.
+func (p *Plan) Print(w io.Writer) {
+	for _, step := range p.Steps {
+		dir := "UP"
+		if step.Down {
+			dir = "DOWN"
+		}
+		fmt.Fprintf(w, "-- %s %03d %s (%v)\n", dir, step.N, step.Name, step.Duration)
+		for _, s := range step.Statements {
+			sql := strings.TrimRight(strings.TrimSpace(s.SQL), ";")
+			fmt.Fprintf(w, "%s; -- %v", sql, s.Duration)
+			if len(s.Args) > 0 {
+				fmt.Fprintf(w, " args %v", s.Args)
+			}
+			fmt.Fprintln(w)
+			if s.Err != nil {
+				fmt.Fprintf(w, "-- ERROR: %v\n", s.Err)
+			}
+		}
+		if step.Err != nil {
+			fmt.Fprintf(w, "-- FAILED: %v\n", step.Err)
+		}
+	}
+}
+
+//DryRun performs the migrations from the current one to target, up or down,
+//in one transaction that is always rolled back, and returns the statements
+//they issued.  The migrations table is not changed.  This is a way to
+//review migrations against a copy of a production database; note that
+//anything a migration does outside the transaction it is given is not
+//undone, and that an in memory sqlite database cannot be dry run since the
+//dry run has its own connection to the database.  If a migration fails, the
+//plan up to and including it is returned with the error.
+func (m *sqlMigrator) DryRun(target int, defn *Definitions) (*Plan, error) {
+	if m.dsn == "" {
+		return nil, fmt.Errorf("this database cannot be dry run")
+	}
+	curr, err := m.CurrentMigrationNumber()
+	if err != nil {
+		return nil, err
+	}
+	rec := &recorder{}
+	db := sql.OpenDB(&recordingConnector{driver: m.db.Driver(), dsn: m.dsn, rec: rec})
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var steps []int
+	down := target < curr
+	if down {
+		for i := curr; i > target; i-- {
+			steps = append(steps, i)
+		}
+	} else {
+		for i := curr + 1; i <= target; i++ {
+			steps = append(steps, i)
+		}
+	}
+	plan := &Plan{}
+	for _, n := range steps {
+		fn := defn.Up[n]
+		if down {
+			fn = defn.Down[n]
+		}
+		if fn == nil {
+			return plan, fmt.Errorf("there is no migration %03d", n)
+		}
+		fmt.Printf("[migrator] dry run of migration %03d\n", n)
+		rec.take()
+		start := time.Now()
+		err := fn(tx)
+		plan.Steps = append(plan.Steps, PlanStep{
+			N:          n,
+			Name:       defn.name(n),
+			Down:       down,
+			Statements: rec.take(),
+			Duration:   time.Since(start),
+			Err:        err,
+		})
+		if err != nil {
+			return plan, err
+		}
+	}
+	return plan, nil
+}
+
+//recorder keeps the statements issued through a recordingConnector.
+type recorder struct {
+	lock       sync.Mutex
+	statements []Statement
+}
+
+func (r *recorder) record(query string, args []driver.NamedValue, start time.Time, err error) {
+	s := Statement{SQL: query, Duration: time.Since(start), Err: err}
+	for _, a := range args {
+		s.Args = append(s.Args, a.Value)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.statements = append(r.statements, s)
+}
+
+//take returns the statements recorded since the last take.
+func (r *recorder) take() []Statement {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	result := r.statements
+	r.statements = nil
+	return result
+}
+
+//recordingConnector makes connections with another driver that record the
+//statements issued through them.
+type recordingConnector struct {
+	driver driver.Driver
+	dsn    string
+	rec    *recorder
+}
+
+func (c *recordingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	var conn driver.Conn
+	var err error
+	if dc, ok := c.driver.(driver.DriverContext); ok {
+		connector, cerr := dc.OpenConnector(c.dsn)
+		if cerr != nil {
+			return nil, cerr
+		}
+		conn, err = connector.Connect(ctx)
+	} else {
+		conn, err = c.driver.Open(c.dsn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &recordingConn{Conn: conn, rec: c.rec}, nil
+}
+
+func (c *recordingConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type recordingConn struct {
+	driver.Conn
+	rec *recorder
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *recordingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if pc, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = pc.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &recordingStmt{Stmt: stmt, query: query, rec: c.rec}, nil
+}
+
+func (c *recordingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if bc, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return bc.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *recordingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	ec, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	result, err := ec.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.rec.record(query, args, start, err)
+	}
+	return result, err
+}
+
+func (c *recordingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	qc, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := qc.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.rec.record(query, args, start, err)
+	}
+	return rows, err
+}
+
+func (c *recordingConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nc, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return nc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+type recordingStmt struct {
+	driver.Stmt
+	query string
+	rec   *recorder
+}
+
+func (s *recordingStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	var result driver.Result
+	var err error
+	if ec, ok := s.Stmt.(driver.StmtExecContext); ok {
+		result, err = ec.ExecContext(ctx, args)
+	} else {
+		result, err = s.Stmt.Exec(values(args))
+	}
+	s.rec.record(s.query, args, start, err)
+	return result, err
+}
+
+func (s *recordingStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	if qc, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = qc.QueryContext(ctx, args)
+	} else {
+		rows, err = s.Stmt.Query(values(args))
+	}
+	s.rec.record(s.query, args, start, err)
+	return rows, err
+}
+
+func values(args []driver.NamedValue) []driver.Value {
+	result := make([]driver.Value, len(args))
+	for i, a := range args {
+		result[i] = a.Value
+	}
+	return result
+}
@@ -0,0 +1,152 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//migrationFile is the form of the names of migration files, like
+//001_create_users.up.sql.
+var migrationFile = regexp.MustCompile(`^([0-9]+)_([A-Za-z0-9_\-]+)\.(up|down)\.sql$`)
+
+//SQLMigration returns a MigrationFunc that runs the SQL given, which may be
+//several statements separated by semicolons.  Empty SQL does nothing.
+func SQLMigration(script string) MigrationFunc {
+	return func(tx *sql.Tx) error {
+		if strings.TrimSpace(script) == "" {
+			return nil
+		}
+		_, err := tx.Exec(script)
+		return err
+	}
+}
+
+//LoadDefinitionsDir is LoadDefinitions for a directory on disk.
+func LoadDefinitionsDir(dir string, goSteps *Definitions) (*Definitions, error) {
+	return LoadDefinitions(os.DirFS(dir), ".", goSteps)
+}
+
+//LoadDefinitions returns the migrations in the directory dir of fsys, which
+//may be an embed.FS.  Each migration is a pair of files NNN_name.up.sql
+//and NNN_name.down.sql; NNN is the migration number and the leading zeros
+//are optional.  The migrations in goSteps, which may be nil, are added to
+//those of the files, so that migrations that need code can be written in
+//Go.  The result must be valid (see Validate) and a migration cannot be
+//both a file and a Go step.  Other files in the directory are ignored,
+//except for .sql files with the wrong form of name, which are an error.
+func LoadDefinitions(fsys fs.FS, dir string, goSteps *Definitions) (*Definitions, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	result := &Definitions{
+		Up:        make(map[int]MigrationFunc),
+		Down:      make(map[int]MigrationFunc),
+		Names:     make(map[int]string),
+		Checksums: make(map[int]string),
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".sql") {
+			continue
+		}
+		parts := migrationFile.FindStringSubmatch(e.Name())
+		if parts == nil {
+			return nil, fmt.Errorf("%s: migration files are named like 001_name.up.sql or 001_name.down.sql", e.Name())
+		}
+		n, _ := strconv.Atoi(parts[1])
+		if name, ok := result.Names[n]; ok && name != parts[2] {
+			return nil, fmt.Errorf("%s: migration %03d is already named %s", e.Name(), n, name)
+		}
+		steps := result.Up
+		if parts[3] == "down" {
+			steps = result.Down
+		}
+		if _, ok := steps[n]; ok {
+			return nil, fmt.Errorf("%s: there is already a %s migration %03d", e.Name(), parts[3], n)
+		}
+		b, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		steps[n] = SQLMigration(string(b))
+		result.Names[n] = parts[2]
+		if parts[3] == "up" {
+			result.Checksums[n] = Checksum(string(b))
+		}
+	}
+	if goSteps != nil {
+		if err := result.add(goSteps); err != nil {
+			return nil, err
+		}
+	}
+	if err := result.Validate(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//add adds the steps of other, which must not already be defined.
+func (d *Definitions) add(other *Definitions) error {
+	for _, pair := range []struct {
+		dest, src map[int]MigrationFunc
+		dir       string
+	}{{d.Up, other.Up, "up"}, {d.Down, other.Down, "down"}} {
+		for n, fn := range pair.src {
+			if _, ok := pair.dest[n]; ok {
+				return fmt.Errorf("%s migration %03d is both a file and a Go step", pair.dir, n)
+			}
+			pair.dest[n] = fn
+		}
+	}
+	for n, name := range other.Names {
+		if _, ok := d.Names[n]; !ok {
+			d.Names[n] = name
+		}
+	}
+	for n, sum := range other.Checksums {
+		if _, ok := d.Checksums[n]; !ok {
+			d.Checksums[n] = sum
+		}
+	}
+	return nil
+}
+
+//Validate checks that the migrations are numbered from 1 with no gaps and
+//that each has an up and a down step.  Main refuses to run migrations that
+//are not valid.
+func (d *Definitions) Validate() error {
+	var problems []string
+	for n, fn := range d.Up {
+		if fn == nil {
+			problems = append(problems, fmt.Sprintf("up migration %03d is nil", n))
+		}
+		if _, ok := d.Down[n]; !ok {
+			problems = append(problems, fmt.Sprintf("migration %03d has no down step", n))
+		}
+	}
+	for n, fn := range d.Down {
+		if fn == nil {
+			problems = append(problems, fmt.Sprintf("down migration %03d is nil", n))
+		}
+		if _, ok := d.Up[n]; !ok {
+			problems = append(problems, fmt.Sprintf("migration %03d has no up step", n))
+		}
+	}
+	for n := 1; n <= len(d.Up); n++ {
+		if _, ok := d.Up[n]; !ok {
+			problems = append(problems, fmt.Sprintf("migration %03d is missing (there are %d migrations)", n, len(d.Up)))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("bad migrations: %s", strings.Join(problems, "; "))
+}
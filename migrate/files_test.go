@@ -0,0 +1,77 @@
+package migrate
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func sqlFiles(names ...string) fstest.MapFS {
+	result := fstest.MapFS{
+		"migrations/README": &fstest.MapFile{Data: []byte("not a migration")},
+	}
+	for _, n := range names {
+		result["migrations/"+n] = &fstest.MapFile{Data: []byte("")}
+	}
+	return result
+}
+
+func TestLoadDefinitions(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/001_foobar.up.sql":   &fstest.MapFile{Data: []byte("CREATE TABLE foobar (i int, s varchar(255));\nINSERT INTO foobar(i,s) VALUES (1,'one');")},
+		"migrations/001_foobar.down.sql": &fstest.MapFile{Data: []byte("DROP TABLE foobar;")},
+		"migrations/3_index.up.sql":      &fstest.MapFile{Data: []byte("CREATE INDEX foobar_i ON foobar (i);")},
+		"migrations/3_index.down.sql":    &fstest.MapFile{Data: []byte("DROP INDEX foobar_i;")},
+	}
+	//the data conversion of migration 2 is easier in Go
+	defn, err := LoadDefinitions(fsys, "migrations", &Definitions{
+		Up:   map[int]MigrationFunc{2: twoUp},
+		Down: map[int]MigrationFunc{2: twoDown},
+	})
+	if err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+	if len(defn.Up) != 3 || defn.Names[1] != "foobar" || defn.Names[3] != "index" {
+		t.Fatalf("unexpected definitions %+v", defn)
+	}
+
+	m := openSqlite(t)
+	defer m.Close()
+	checkMigrationApplication(t, m, 3, 3, func() (int, error) {
+		return m.Up(defn.Up)
+	})
+	var s string
+	if err := testDB(m).QueryRow("SELECT t FROM foobar WHERE i = 1").Scan(&s); err != nil || s != "one" {
+		t.Errorf("expected the data to be converted but got %q (%v)", s, err)
+	}
+	checkMigrationApplication(t, m, 3, 0, func() (int, error) {
+		return m.Down(defn.Down)
+	})
+}
+
+func TestLoadDefinitionsErrors(t *testing.T) {
+	bad := map[string]fstest.MapFS{
+		"no down":    sqlFiles("001_a.up.sql", "001_a.down.sql", "002_b.up.sql"),
+		"no up":      sqlFiles("001_a.up.sql", "001_a.down.sql", "002_b.down.sql"),
+		"gap":        sqlFiles("001_a.up.sql", "001_a.down.sql", "003_c.up.sql", "003_c.down.sql"),
+		"bad name":   sqlFiles("001_a.up.sql", "001_a.down.sql", "two.up.sql"),
+		"names":      sqlFiles("001_a.up.sql", "001_b.down.sql"),
+		"duplicate":  sqlFiles("001_a.up.sql", "001_a.down.sql", "1_a.up.sql"),
+		"zero based": sqlFiles("000_a.up.sql", "000_a.down.sql"),
+	}
+	for name, fsys := range bad {
+		if _, err := LoadDefinitions(fsys, "migrations", nil); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	_, err := LoadDefinitions(sqlFiles("001_a.up.sql", "001_a.down.sql"), "migrations", &migs)
+	if err == nil || !strings.Contains(err.Error(), "both a file and a Go step") {
+		t.Errorf("expected an error for a migration defined twice but got %v", err)
+	}
+	if _, err := LoadDefinitions(sqlFiles("001_a.up.sql", "001_a.down.sql"), "migrations", nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := migs.Validate(); err != nil {
+		t.Errorf("unexpected error for the test migrations: %v", err)
+	}
+}
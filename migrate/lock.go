@@ -0,0 +1,93 @@
+package migrate
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	MIGRATION_LOCK_TIMEOUT = time.Minute
+	MIGRATION_LOCK_POLL    = 250 * time.Millisecond
+	MIGRATION_LOCK_TABLE   = "migration_lock"
+
+	//how often to say that we are still waiting for the lock
+	MIGRATION_LOCK_PROGRESS = 10 * time.Second
+
+	//the postgres advisory lock key, which is arbitrary but must be the same
+	//for every migrator of the database
+	MIGRATION_LOCK_KEY = 0x5e7e5
+)
+
+//LockedError is the error when another migrator holds the migration lock
+//for longer than the lock timeout.
+type LockedError struct {
+	//Holder describes the other migrator, if it is known.
+	Holder string
+	Waited time.Duration
+}
+
+func (e *LockedError) Error() string {
+	holder := "another migrator"
+	if e.Holder != "" {
+		holder = fmt.Sprintf("another migrator (%s)", e.Holder)
+	}
+	return fmt.Sprintf("%s is running migrations; gave up waiting for it after %v", holder, e.Waited)
+}
+
+//lockHolder describes this process, for the LockedErrors of others.
+func lockHolder() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s pid %d at %s", host, os.Getpid(), time.Now().Format(time.RFC3339Nano))
+}
+
+//SetLockTimeout sets how long Up, Down, UpTo, DownTo and UpDefinitions
+//wait for another migrator of the database to finish before they return a
+//*LockedError; 0 means not to wait.  The default is MIGRATION_LOCK_TIMEOUT.
+func (m *sqlMigrator) SetLockTimeout(d time.Duration) {
+	m.lockTimeout = d
+}
+
+//lock takes the migration lock, waiting for it up to the lock timeout, and
+//returns the function that releases it.
+func (m *sqlMigrator) lock() (func(), error) {
+	start := time.Now()
+	var reported time.Time
+	for {
+		unlock, holder, err := m.dialect.tryLock(m.db)
+		if err != nil {
+			return nil, err
+		}
+		if unlock != nil {
+			return unlock, nil
+		}
+		waited := time.Since(start)
+		if waited >= m.lockTimeout {
+			return nil, &LockedError{Holder: holder, Waited: waited}
+		}
+		if reported.IsZero() {
+			if holder == "" {
+				holder = "another migrator"
+			}
+			fmt.Printf("[migrator] waiting up to %v for the migration lock, held by %s\n", m.lockTimeout, holder)
+			reported = time.Now()
+		} else if time.Since(reported) >= MIGRATION_LOCK_PROGRESS {
+			fmt.Printf("[migrator] still waiting for the migration lock after %v\n", waited.Round(time.Second))
+			reported = time.Now()
+		}
+		time.Sleep(MIGRATION_LOCK_POLL)
+	}
+}
+
+//locked runs fn with the migration lock held.
+func (m *sqlMigrator) locked(fn func() (int, error)) (int, error) {
+	unlock, err := m.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	return fn()
+}
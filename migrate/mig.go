@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 )
 
 const MIGRATION_TABLE = "migrations"
@@ -26,6 +27,13 @@ type Migrator interface {
 	UpTo(int, map[int]MigrationFunc) (int, error)
 	DownTo(int, map[int]MigrationFunc) (int, error)
 	DumpHistory(io.Writer) error
+	History() ([]Applied, error)
+	Verify(*Definitions) error
+	UpDefinitions(target int, defn *Definitions, force bool) (int, error)
+	SetLockTimeout(time.Duration)
+	DryRun(target int, defn *Definitions) (*Plan, error)
+	Schema() (*Schema, error)
+	SchemaDiff(models []interface{}) (*SchemaDiff, error)
 }
 
 //This is the function type that the Migrator operates on.  The implementors
@@ -34,23 +42,44 @@ type Migrator interface {
 type MigrationFunc func(*sql.Tx) error
 
 //Definitions is a convenient way to hold the up and down migrations in a
-//struct.
+//struct.  They can also be loaded from SQL files with LoadDefinitions.
 type Definitions struct {
 	Up   map[int]MigrationFunc
 	Down map[int]MigrationFunc
+	//Names, which is optional, are the names of the migrations, such as
+	//from their files.
+	Names map[int]string
+	//Checksums, which is optional, are the checksums (see Checksum) of the
+	//content of the up migrations, such as their files.  Migrations with
+	//checksums are checked for changes after they have been performed.
+	Checksums map[int]string
+	//Models, which is optional, are pointers to the qbs model structs whose
+	//tables the migrations create, for generating migrations (see
+	//SchemaDiff).
+	Models []interface{}
 }
 
 //Main should be called from user-level code's main() function to process
 //the arguments and run migrations provided. It reads the arguments provided
 //on the command line.
 func Main(defn *Definitions, m Migrator) {
-	var up, down, history bool
+	var up, down, history, verify, force, dryRun bool
 	var step int
+	var lockTimeout time.Duration
+	var schema, generate, dir string
 	flag.BoolVar(&up, "up", false, "indicates up migrations are desired, with no step specified all possible up migrations are run")
 	flag.BoolVar(&down, "down", false, "indicates down migrations are desired, with no step specified all possible down migrations are run")
 	flag.BoolVar(&history, "history", false, "dumps the migration history to the terminal")
+	flag.BoolVar(&verify, "verify", false, "checks that the migrations performed have not changed since, exiting with status 1 if they have")
+	flag.BoolVar(&force, "force", false, "perform up migrations even if the migrations performed have changed")
+	flag.BoolVar(&dryRun, "dry-run", false, "print the statements the migrations would issue, and their timing, then roll them back")
+	flag.DurationVar(&lockTimeout, "lock-timeout", MIGRATION_LOCK_TIMEOUT, "how long to wait for another migrator to finish")
+	flag.StringVar(&schema, "schema", "", "writes the schema of the database to the file given, - for the terminal, to be checked in")
+	flag.StringVar(&generate, "generate", "", "writes the next migration, with the name given, to add the tables, columns and indexes the models lack")
+	flag.StringVar(&dir, "dir", "migrations", "the directory -generate writes migration files to")
 	flag.IntVar(&step, "step", 0, "number of steps to proceed, dont set this if you want all migrations performed")
 	flag.Parse()
+	m.SetLockTimeout(lockTimeout)
 
 	current, err := m.CurrentMigrationNumber()
 	if err != nil {
@@ -58,6 +87,42 @@ func Main(defn *Definitions, m Migrator) {
 		return
 	}
 
+	if verify {
+		if err := m.Verify(defn); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			//so that a deploy script or CI job can stop
+			os.Exit(1)
+		}
+		fmt.Printf("migrations up to %03d are unchanged\n", current)
+		return
+	}
+
+	if schema != "" {
+		dumpSchema(m, schema)
+		return
+	}
+	if generate != "" {
+		if current != len(defn.Up) {
+			fmt.Fprintf(os.Stderr, "at migration %03d, not the last one %03d: perform the up migrations before generating another\n", current, len(defn.Up))
+			return
+		}
+		diff, err := m.SchemaDiff(defn.Models)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to compare the schema with the models: %v\n", err)
+			return
+		}
+		if diff.Empty() {
+			fmt.Printf("the schema has everything in the models, nothing to do\n")
+			return
+		}
+		if err := diff.WriteFiles(dir, current+1, generate); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to write migration: %v\n", err)
+			return
+		}
+		fmt.Printf("wrote migration %03d_%s to %s, edit it before performing it\n", current+1, generate, dir)
+		return
+	}
+
 	if !up && !down {
 		fmt.Printf("current migration number is %03d\n", current)
 		if history {
@@ -72,6 +137,12 @@ func Main(defn *Definitions, m Migrator) {
 		fmt.Fprintf(os.Stderr, "negative steps don't make sense, use --down and a positive step value\n")
 		return
 	}
+	//only the migrations that are to be performed need to make sense, the
+	//history and the schema can be looked at regardless
+	if err := defn.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
 
 	var n int
 	if up {
@@ -83,14 +154,22 @@ func Main(defn *Definitions, m Migrator) {
 			fmt.Fprintf(os.Stderr, "maximum migration number is %d (not %d), no migrations performed\n", len(defn.Up), current+step)
 			return
 		}
+		if dryRun {
+			target := len(defn.Up)
+			if step > 0 {
+				target = current + step
+			}
+			printDryRun(m, target, defn)
+			return
+		}
 		if step == 0 {
-			n, err = m.Up(defn.Up)
+			n, err = m.UpDefinitions(0, defn, force)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "failed to do up migrations: %v\n", err)
 				return
 			}
 		} else {
-			n, err = m.UpTo(current+step, defn.Up)
+			n, err = m.UpDefinitions(current+step, defn, force)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "failed to do up migrations: %v\n", err)
 				return
@@ -108,6 +187,14 @@ func Main(defn *Definitions, m Migrator) {
 		fmt.Fprintf(os.Stderr, "earliest migration number is 0 (not %d), no migrations performed\n", current-step)
 		return
 	}
+	if dryRun {
+		target := 0
+		if step > 0 {
+			target = current - step
+		}
+		printDryRun(m, target, defn)
+		return
+	}
 	if step == 0 {
 		n, err = m.Down(defn.Down)
 		if err != nil {
@@ -123,3 +210,40 @@ func Main(defn *Definitions, m Migrator) {
 	}
 	fmt.Printf("%03d DOWN migrations performed\n", n)
 }
+
+//printDryRun prints the plan of the migrations to target, without
+//performing them.
+func printDryRun(m Migrator, target int, defn *Definitions) {
+	plan, err := m.DryRun(target, defn)
+	if plan != nil {
+		plan.Print(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dry run failed: %v\n", err)
+		return
+	}
+	fmt.Printf("%03d migrations rolled back, none performed\n", len(plan.Steps))
+}
+
+//dumpSchema writes the schema of the database to the file given, or the
+//terminal for "-".
+func dumpSchema(m Migrator, path string) {
+	schema, err := m.Schema()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to get the schema: %v\n", err)
+		return
+	}
+	w := io.Writer(os.Stdout)
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := schema.Dump(w); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to write the schema: %v\n", err)
+	}
+}
@@ -1,30 +1,15 @@
 package migrate
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"github.com/lib/pq"
-	"io"
-	"time"
+	"reflect"
 )
 
 type postgresMigrator struct {
-	db *sql.DB
-}
-
-//DestroyMigrationRecords destroys the records kept about migrations. This
-//is almost certanily a bad idea anywhere except in a test.
-func (m *postgresMigrator) DestroyMigrationRecords() error {
-	_, err := m.db.Exec(m.deleteAll())
-	return err
-}
-
-//Close severs the db connection, if it exists.
-func (m *postgresMigrator) Close() error {
-	if m.db != nil {
-		return m.db.Close()
-	}
-	return nil
+	*sqlMigrator
 }
 
 //NewPostgresMigrator returns a new migrator capable of performing a sequence
@@ -44,177 +29,166 @@ func NewPostgresMigrator(url string) (Migrator, error) {
 	if err != nil {
 		return nil, err
 	}
-	result := &postgresMigrator{
-		db: db,
-	}
-	if err := result.createTableIfNotExists(); err != nil {
+	m, err := newSqlMigrator(db, postgresDialect{}, opts)
+	if err != nil {
 		return nil, err
 	}
-	return result, nil
+	return &postgresMigrator{m}, nil
 }
 
-//createTableIfNotExists creates the table if it doesn't yet exist
-//otherwise does nothing.
-func (m *postgresMigrator) createTableIfNotExists() error {
-	_, err := m.db.Exec(m.createTable())
-	return err
+type postgresDialect struct{}
+
+//make it easier to port to other DB
+func (d postgresDialect) createTable() string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (n INTEGER, t TIMESTAMP WITH TIME ZONE DEFAULT current_timestamp, name TEXT, checksum TEXT)",
+		MIGRATION_TABLE)
 }
 
-//CurrentMigration returns the current migration number found in the
-//migrations table. If no migrations have been performed, this returns
-//zero.
-func (m *postgresMigrator) CurrentMigrationNumber() (int, error) {
-	curr := -9018
-	row := m.db.QueryRow(m.numQuery())
-	err := row.Scan(&curr)
-	if err != nil && err != sql.ErrNoRows {
-		return -1917, err
-	}
-	if err == sql.ErrNoRows {
-		return 0, nil
+func (d postgresDialect) upgradeTable(db *sql.DB) error {
+	for _, col := range []string{"name", "checksum"} {
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s TEXT", MIGRATION_TABLE, col)); err != nil {
+			return err
+		}
 	}
-	return curr, nil
+	return nil
 }
 
-//Goes up to the last known migration. Returns the number of migrations
-//successfully performed.  Migrations are done in a transaction.  This
-//is shorthand for UpTo(len(migrations),migrations).
-func (m *postgresMigrator) Up(migrations map[int]MigrationFunc) (int, error) {
-	return m.UpTo(len(migrations), migrations)
+//make it easier to port to other DB
+func (d postgresDialect) numQuery() string {
+	return fmt.Sprintf("SELECT n FROM %s ORDER BY t DESC LIMIT 1", MIGRATION_TABLE)
 }
 
-//Goes Up to the migration given.Returns the number of migrations
-//successfully performed.  Migrations are done in a transaction. If
-//the current migration level is equal to or greater than the target
-//this is a noop.  Note that you pass where you want to BE after this
-//is done, not the migration to be performed.  For example, passing
-//1 as target implies running migration 1.
-func (m *postgresMigrator) UpTo(target int, migrations map[int]MigrationFunc) (int, error) {
-
-	curr, err := m.CurrentMigrationNumber()
-	if err != nil {
-		return 0, err
-	}
-	success := 0
-	for i := 0; i < target; i++ {
-		if i < curr {
-			continue
-		}
-		fmt.Printf("[migrator] attempting migration UP %03d\n", i+1)
-		err := m.step(migrations[i+1])
-		if err != nil {
-			return success, err
-		}
-		success++
-		_, err = m.db.Exec(m.insertRow(i + 1))
-		if err != nil {
-			return success, err
-		}
-	}
-	return success, nil
+//make it easier to port to other DB
+func (d postgresDialect) historyQuery() string {
+	return fmt.Sprintf("SELECT n,COALESCE(name,''),COALESCE(checksum,''),t FROM %s ORDER BY t DESC", MIGRATION_TABLE)
 }
 
-//Goes down to zero. Returns the number of number migrations done successfully.
-//Migrations are done in a transaction.  This is short for
-//DownTo(0,migrations).
-func (m *postgresMigrator) Down(migrations map[int]MigrationFunc) (int, error) {
-	return m.DownTo(0, migrations)
+func (d postgresDialect) param(i int) string {
+	return fmt.Sprintf("$%d", i)
 }
 
-//Goes down to zero. Returns the number of number migrations done successfully.
-//Migrations are done in a transaction. Note that you pass the destination
-//migration number.  You pass 1 to mean that you want migrations 2 to current
-//run in reverse order.
-func (m *postgresMigrator) DownTo(target int, migrations map[int]MigrationFunc) (int, error) {
-	curr, err := m.CurrentMigrationNumber()
+//advisory locks belong to a session, so the lock keeps a connection of its
+//own until it is released
+func (d postgresDialect) tryLock(db *sql.DB) (func(), string, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
 	if err != nil {
-		return 0, err
-	}
-	success := 0
-	for i := curr; i > target; i-- {
-		fmt.Printf("[migrator] attempting migration DOWN %03d\n", i)
-		err := m.step(migrations[i])
-		if err != nil {
-			return success, err
-		}
-		success++
-		_, err = m.db.Exec(m.deleteRow(i))
+		return nil, "", err
+	}
+	var ok bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", MIGRATION_LOCK_KEY).Scan(&ok); err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	if !ok {
+		defer conn.Close()
+		var pid int
+		err := conn.QueryRowContext(ctx, "SELECT pid FROM pg_locks WHERE locktype = 'advisory' AND objid = $1 AND granted",
+			MIGRATION_LOCK_KEY).Scan(&pid)
 		if err != nil {
-			return success, err
+			return nil, "", nil
 		}
+		return nil, fmt.Sprintf("postgres backend pid %d", pid), nil
 	}
-	return success, nil
-}
-
-//Single step, given a function.  There is no need for f
-func (m *postgresMigrator) step(fn MigrationFunc) error {
-	if fn == nil {
-		panic("step called but no function!")
-	}
-	tx, err := m.db.Begin()
+	return func() {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", MIGRATION_LOCK_KEY); err != nil {
+			fmt.Printf("[migrator] unable to release the migration lock: %v\n", err)
+		}
+		conn.Close()
+	}, "", nil
+}
+
+func (d postgresDialect) schema(db *sql.DB) (*Schema, error) {
+	result := &Schema{}
+	rows, err := db.Query(`SELECT c.table_name, c.column_name, c.data_type, c.character_maximum_length,
+		c.is_nullable = 'NO', COALESCE(c.column_default, ''),
+		EXISTS (SELECT 1 FROM information_schema.table_constraints tc
+			JOIN information_schema.key_column_usage k ON k.constraint_name = tc.constraint_name
+				AND k.table_schema = tc.table_schema AND k.table_name = tc.table_name
+			WHERE tc.constraint_type = 'PRIMARY KEY' AND tc.table_schema = c.table_schema
+				AND tc.table_name = c.table_name AND k.column_name = c.column_name)
+		FROM information_schema.columns c
+		JOIN information_schema.tables t ON t.table_schema = c.table_schema AND t.table_name = c.table_name
+		WHERE c.table_schema = current_schema() AND t.table_type = 'BASE TABLE'
+		ORDER BY c.table_name, c.ordinal_position`)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if err := fn(tx); err != nil {
-		fmt.Printf("got an error trying to run a step: %v", err)
-		if err := tx.Rollback(); err != nil {
-			panic(fmt.Sprintf("unable to rollback migration transaction:%v", err))
+	defer rows.Close()
+	for rows.Next() {
+		var table string
+		var length sql.NullInt64
+		var c Column
+		if err := rows.Scan(&table, &c.Name, &c.Type, &length, &c.NotNull, &c.Default, &c.PK); err != nil {
+			return nil, err
 		}
-		return err
+		if length.Valid {
+			c.Type = fmt.Sprintf("%s(%d)", c.Type, length.Int64)
+		}
+		t := result.add(table)
+		t.Columns = append(t.Columns, c)
 	}
-	if err := tx.Commit(); err != nil {
-		panic(fmt.Sprintf("unable to commit migration transaction:%v", err))
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
-	return nil
-}
-
-func (m *postgresMigrator) DumpHistory(writer io.Writer) error {
-	rows, err := m.db.Query(m.historyQuery())
+	rows.Close()
+
+	rows, err = db.Query(`SELECT t.relname, i.relname, ix.indisunique, a.attname
+		FROM pg_index ix
+		JOIN pg_class t ON t.oid = ix.indrelid
+		JOIN pg_class i ON i.oid = ix.indexrelid
+		JOIN pg_namespace n ON n.oid = t.relnamespace
+		JOIN LATERAL unnest(ix.indkey) WITH ORDINALITY AS k(attnum, ord) ON true
+		JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = k.attnum
+		WHERE n.nspname = current_schema() AND NOT ix.indisprimary
+		ORDER BY t.relname, i.relname, k.ord`)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
-		var n int
-		var t time.Time
-
-		err := rows.Scan(&n, &t)
-		if err != nil {
-			return err
+		var table, index, column string
+		var unique bool
+		if err := rows.Scan(&table, &index, &unique, &column); err != nil {
+			return nil, err
+		}
+		if t := result.table(table); t != nil {
+			t.addIndexColumn(index, unique, column)
 		}
-		fmt.Fprintf(writer, "%03d %v\n", n, t)
-	}
-	if rows.Err() != nil {
-		return rows.Err()
 	}
-	return nil
+	return result, rows.Err()
 }
 
-//make it easier to port to other DB
-func (m *postgresMigrator) createTable() string {
-	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (n INTEGER, t TIMESTAMP WITH TIME ZONE DEFAULT current_timestamp)",
-		MIGRATION_TABLE)
-}
-
-//make it easier to port to other DB
-func (m *postgresMigrator) numQuery() string {
-	return fmt.Sprintf("SELECT n FROM %s ORDER BY t DESC LIMIT 1", MIGRATION_TABLE)
-}
-
-//make it easier to port to other DB
-func (m *postgresMigrator) historyQuery() string {
-	return fmt.Sprintf("SELECT n,t FROM %s ORDER BY t DESC", MIGRATION_TABLE)
-}
-
-//make it easier to port to other DB
-func (m *postgresMigrator) deleteAll() string {
-	return fmt.Sprintf("DELETE FROM %s", MIGRATION_TABLE)
-}
-
-//make it easier to port to other DB
-func (m *postgresMigrator) insertRow(i int) string {
-	return fmt.Sprintf("INSERT INTO %s (n) VALUES(%d)", MIGRATION_TABLE, i)
-}
-
-func (m *postgresMigrator) deleteRow(i int) string {
-	return fmt.Sprintf("DELETE FROM %s WHERE n = %d", MIGRATION_TABLE, i)
+//the types qbs uses for postgres
+func (d postgresDialect) columnType(t reflect.Type, size int, pk bool) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		if pk {
+			return "serial"
+		}
+		return "integer"
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		if pk {
+			return "bigserial"
+		}
+		return "bigint"
+	case reflect.Float32, reflect.Float64:
+		return "double precision"
+	case reflect.String:
+		if size > 0 && size < 65532 {
+			return fmt.Sprintf("varchar(%d)", size)
+		}
+		return "text"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytea"
+		}
+	case reflect.Struct:
+		if t == timeType {
+			return "timestamp with time zone"
+		}
+	}
+	return ""
 }
@@ -121,91 +121,14 @@ func TestOpen(t *testing.T) {
 	}
 }
 
-func TestMigrateNumberAtStart(t *testing.T) {
+func openPostgres(t *testing.T) Migrator {
 	m, err := NewPostgresMigrator(DB_NAME)
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
-	defer m.Close()
-	if err := m.DestroyMigrationRecords(); err != nil {
-		t.Fatalf("Unable to clear migration records for test: %v", err)
-	}
-	record, err := m.CurrentMigrationNumber()
-	if err != nil {
-		t.Fatalf("Unable to fetch migration number: %v", err)
-	}
-	if record != 0 {
-		t.Errorf("wrong migration found, expected 0 got %d", record)
-	}
+	return m
 }
 
-func checkMigrationApplication(t *testing.T, m Migrator, performed int, after int, fn func() (int, error)) {
-	p, err := fn()
-	if err != nil {
-		t.Fatalf("failed to perform migration: %v", err)
-	}
-	if p != performed {
-		t.Errorf("expected to have done %d migrations, but did %d", performed, p)
-	}
-	curr, err := m.CurrentMigrationNumber()
-	if err != nil {
-		t.Fatalf("could not check the current migration number: %v", err)
-	}
-	if curr != after {
-		t.Errorf("expected to be at migration %d but really at %d", after, curr)
-	}
-}
-
-func TestMigrateNumberUpDown(t *testing.T) {
-	m, err := NewPostgresMigrator(DB_NAME)
-	if err != nil {
-		t.Fatalf("%v", err)
-	}
-
-	//after the test, just get rid of the things we tested
-	defer func() {
-		m.(*postgresMigrator).db.Exec("DROP TABLE foobar")
-		m.(*postgresMigrator).db.Exec("DROP TABLE migrations")
-		m.Close()
-	}()
-
-	if err := m.DestroyMigrationRecords(); err != nil {
-		t.Fatalf("unable to clear the migration records: %v", err)
-	}
-
-	checkMigrationApplication(t, m, 2, 2, func() (int, error) {
-		return m.Up(migs.Up)
-	})
-
-	//hacky way to simulate some data
-	db := m.(*postgresMigrator).db
-	if _, err = db.Exec("INSERT INTO foobar(i,t) VALUES (2,'blah'), (42,'answer')"); err != nil {
-		t.Fatalf("error during insert: %v", err)
-	}
-
-	//down 1 migration
-	checkMigrationApplication(t, m, 1, 1, func() (int, error) {
-		return m.DownTo(1, migs.Down)
-	})
-
-	//check the values got converted
-	var s1, s2 string
-	if err = db.QueryRow("SELECT s FROM foobar WHERE i = 2").Scan(&s1); err != nil {
-		t.Fatalf("error doing select of data converted (1): %v", err)
-	}
-	if s1 != "blah" {
-		t.Errorf("expected blah but got %s", s1)
-	}
-	if err = db.QueryRow("SELECT s FROM foobar WHERE i = 42").Scan(&s2); err != nil {
-		t.Fatalf("error doing select of data converted (2): %v", err)
-	}
-	if s2 != "answer" {
-		t.Errorf("expected answer but got %s", s2)
-	}
-
-	//run last migration
-	checkMigrationApplication(t, m, 1, 0, func() (int, error) {
-		return m.DownTo(0, migs.Down)
-	})
-
+func TestPostgresConformance(t *testing.T) {
+	migratorConformance(t, openPostgres)
 }
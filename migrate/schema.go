@@ -0,0 +1,414 @@
+package migrate
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+//Schema is the tables of a database, without the tables kept by the
+//migrator itself.
+type Schema struct {
+	Tables []*Table
+}
+
+//Table is a table of a Schema; its columns are in order and its indexes
+//are sorted by name.
+type Table struct {
+	Name    string
+	Columns []Column
+	Indexes []Index
+}
+
+//Column is a column of a Table.  Type is as the database gives it, or for
+//a model, the type to create it with.
+type Column struct {
+	Name    string
+	Type    string
+	NotNull bool
+	PK      bool
+	Default string
+}
+
+//Index is an index of a Table, other than its primary key.
+type Index struct {
+	Name    string
+	Table   string
+	Columns []string
+	Unique  bool
+}
+
+//AddedColumn is a column to add to a table that exists.
+type AddedColumn struct {
+	Table  string
+	Column Column
+}
+
+//SchemaDiff is what is needed for the schema of a database to have the
+//tables, columns and indexes of the models.  It only adds things: tables
+//and columns the models do not have are left alone, as are the types of
+//columns.
+type SchemaDiff struct {
+	Tables  []*Table
+	Columns []AddedColumn
+	Indexes []Index
+}
+
+//table returns the table with the name given, or nil.
+func (s *Schema) table(name string) *Table {
+	for _, t := range s.Tables {
+		if strings.EqualFold(t.Name, name) {
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *Schema) sort() {
+	sort.Slice(s.Tables, func(i, j int) bool { return s.Tables[i].Name < s.Tables[j].Name })
+	for _, t := range s.Tables {
+		sort.Slice(t.Indexes, func(i, j int) bool { return t.Indexes[i].Name < t.Indexes[j].Name })
+	}
+}
+
+//add returns the table with the name given, adding it if needed.
+func (s *Schema) add(name string) *Table {
+	if t := s.table(name); t != nil {
+		return t
+	}
+	t := &Table{Name: name}
+	s.Tables = append(s.Tables, t)
+	return t
+}
+
+//addIndexColumn adds the column to the index named, adding the index if it
+//is not the last one of the table.
+func (t *Table) addIndexColumn(name string, unique bool, column string) {
+	if n := len(t.Indexes); n > 0 && t.Indexes[n-1].Name == name {
+		t.Indexes[n-1].Columns = append(t.Indexes[n-1].Columns, column)
+		return
+	}
+	t.Indexes = append(t.Indexes, Index{Name: name, Table: t.Name, Columns: []string{column}, Unique: unique})
+}
+
+func (t *Table) column(name string) *Column {
+	for i := range t.Columns {
+		if strings.EqualFold(t.Columns[i].Name, name) {
+			return &t.Columns[i]
+		}
+	}
+	return nil
+}
+
+//index returns the index on the same columns with the same uniqueness as
+//ix, or nil; the names of indexes are not compared since the database may
+//have named it.
+func (t *Table) index(ix Index) *Index {
+	for i := range t.Indexes {
+		other := &t.Indexes[i]
+		if other.Unique == ix.Unique && strings.EqualFold(strings.Join(other.Columns, ","), strings.Join(ix.Columns, ",")) {
+			return other
+		}
+	}
+	return nil
+}
+
+//isMigratorTable is true of the tables the migrator keeps.
+func isMigratorTable(name string) bool {
+	return name == MIGRATION_TABLE || name == MIGRATION_LOCK_TABLE
+}
+
+//Dump writes the schema as SQL, sorted so that the same schema is always
+//written the same way.  It is meant to be checked in with the migrations,
+//so that changes to the schema are seen in review.
+func (s *Schema) Dump(w io.Writer) error {
+	for _, t := range s.Tables {
+		if _, err := fmt.Fprintf(w, "%s;\n", createTable(t)); err != nil {
+			return err
+		}
+		for _, ix := range t.Indexes {
+			if _, err := fmt.Fprintf(w, "%s;\n", createIndex(ix)); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+func columnDefinition(c Column) string {
+	result := c.Name + " " + c.Type
+	if c.PK {
+		result += " PRIMARY KEY"
+	} else if c.NotNull {
+		result += " NOT NULL"
+	}
+	if c.Default != "" {
+		result += " DEFAULT " + c.Default
+	}
+	return result
+}
+
+func createTable(t *Table) string {
+	cols := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		cols[i] = "\t" + columnDefinition(c)
+	}
+	return fmt.Sprintf("CREATE TABLE %s (\n%s\n)", t.Name, strings.Join(cols, ",\n"))
+}
+
+func createIndex(ix Index) string {
+	unique := ""
+	if ix.Unique {
+		unique = "UNIQUE "
+	}
+	return fmt.Sprintf("CREATE %sINDEX %s ON %s (%s)", unique, ix.Name, ix.Table, strings.Join(ix.Columns, ", "))
+}
+
+//Empty is true if the schema already has everything in the models.
+func (d *SchemaDiff) Empty() bool {
+	return len(d.Tables) == 0 && len(d.Columns) == 0 && len(d.Indexes) == 0
+}
+
+//Up is the SQL of a migration that makes the differences.
+func (d *SchemaDiff) Up() string {
+	var stmts []string
+	for _, t := range d.Tables {
+		stmts = append(stmts, createTable(t))
+	}
+	for _, c := range d.Columns {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", c.Table, columnDefinition(c.Column)))
+	}
+	for _, ix := range d.Indexes {
+		stmts = append(stmts, createIndex(ix))
+	}
+	return script(stmts)
+}
+
+//Down is the SQL of a migration that undoes Up.
+func (d *SchemaDiff) Down() string {
+	var stmts []string
+	for i := len(d.Indexes) - 1; i >= 0; i-- {
+		stmts = append(stmts, "DROP INDEX "+d.Indexes[i].Name)
+	}
+	for i := len(d.Columns) - 1; i >= 0; i-- {
+		c := d.Columns[i]
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", c.Table, c.Column.Name))
+	}
+	for i := len(d.Tables) - 1; i >= 0; i-- {
+		stmts = append(stmts, "DROP TABLE "+d.Tables[i].Name)
+	}
+	return script(stmts)
+}
+
+func script(stmts []string) string {
+	if len(stmts) == 0 {
+		return ""
+	}
+	return strings.Join(stmts, ";\n\n") + ";\n"
+}
+
+//WriteFiles writes Up and Down as the files of migration n with the name
+//given, NNN_name.up.sql and NNN_name.down.sql in dir, for LoadDefinitions.
+//They are a skeleton to be edited before they are performed, such as to
+//fill in the data of new NOT NULL columns.  Files that exist are not
+//overwritten.
+func (d *SchemaDiff) WriteFiles(dir string, n int, name string) error {
+	base := fmt.Sprintf("%03d_%s", n, name)
+	if !migrationFile.MatchString(base + ".up.sql") {
+		return fmt.Errorf("%s is not a name for a migration file", name)
+	}
+	for _, f := range []struct{ suffix, content string }{{".up.sql", d.Up()}, {".down.sql", d.Down()}} {
+		path := filepath.Join(dir, base+f.suffix)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(file, f.content)
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//diffSchema returns what have lacks of want.
+func diffSchema(have, want *Schema) *SchemaDiff {
+	result := &SchemaDiff{}
+	for _, t := range want.Tables {
+		existing := have.table(t.Name)
+		if existing == nil {
+			result.Tables = append(result.Tables, t)
+			result.Indexes = append(result.Indexes, t.Indexes...)
+			continue
+		}
+		for _, c := range t.Columns {
+			if existing.column(c.Name) == nil {
+				result.Columns = append(result.Columns, AddedColumn{Table: t.Name, Column: c})
+			}
+		}
+		for _, ix := range t.Indexes {
+			if existing.index(ix) == nil {
+				result.Indexes = append(result.Indexes, ix)
+			}
+		}
+	}
+	return result
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+//modelSchema returns the schema qbs would create for the models, which are
+//pointers to structs, with the column types of the dialect.  As with qbs,
+//the table and column names come from qbs.StructNameToTableName and
+//qbs.FieldNameToColumnName, so a mapper the application installs is honored,
+//and the tags pk, notnull, index, unique, size and default, and - to
+//ignore a field, are understood.  A field Id of type int64 is the primary
+//key if no field is tagged pk.  Fields that are structs, other than
+//time.Time, or pointers to them are joins and have no column.
+func modelSchema(d dialect, models []interface{}) (*Schema, error) {
+	result := &Schema{}
+	for _, model := range models {
+		t := reflect.TypeOf(model)
+		if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+			return nil, fmt.Errorf("model %T is not a pointer to a struct", model)
+		}
+		table, err := modelTable(d, t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		if result.table(table.Name) != nil {
+			return nil, fmt.Errorf("model %T: there is already a model of table %s", model, table.Name)
+		}
+		result.Tables = append(result.Tables, table)
+	}
+	result.sort()
+	return result, nil
+}
+
+func modelTable(d dialect, t reflect.Type) (*Table, error) {
+	table := &Table{Name: qbs.StructNameToTableName(t.Name())}
+	id := -1
+	hasPK := false
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("qbs")
+		if f.PkgPath != "" || tag == "-" {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && ft != timeType {
+			continue
+		}
+		col := Column{Name: qbs.FieldNameToColumnName(f.Name)}
+		size, index, unique := 0, false, false
+		for _, opt := range strings.Split(tag, ",") {
+			key, value := opt, ""
+			if j := strings.Index(opt, ":"); j >= 0 {
+				key, value = opt[:j], opt[j+1:]
+			}
+			switch strings.TrimSpace(key) {
+			case "pk":
+				col.PK = true
+			case "notnull":
+				col.NotNull = true
+			case "index":
+				index = true
+			case "unique":
+				unique = true
+			case "size":
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, fmt.Errorf("%s.%s: bad size %q", t.Name(), f.Name, value)
+				}
+				size = n
+			case "default":
+				col.Default = value
+			}
+		}
+		col.Type = d.columnType(ft, size, col.PK)
+		if col.Type == "" {
+			return nil, fmt.Errorf("%s.%s: qbs has no column type for %v", t.Name(), f.Name, f.Type)
+		}
+		hasPK = hasPK || col.PK
+		table.Columns = append(table.Columns, col)
+		if col.Name == "id" && ft.Kind() == reflect.Int64 {
+			id = len(table.Columns) - 1
+		}
+		if (index || unique) && !col.PK {
+			suffix := "idx"
+			if unique {
+				suffix = "key"
+			}
+			table.Indexes = append(table.Indexes, Index{
+				Name:    fmt.Sprintf("%s_%s_%s", table.Name, col.Name, suffix),
+				Table:   table.Name,
+				Columns: []string{col.Name},
+				Unique:  unique,
+			})
+		}
+	}
+	if !hasPK && id >= 0 {
+		table.Columns[id].PK = true
+		table.Columns[id].Type = d.columnType(reflect.TypeOf(int64(0)), 0, true)
+		//an index of id is now the primary key
+		var indexes []Index
+		for _, ix := range table.Indexes {
+			if ix.Columns[0] != "id" {
+				indexes = append(indexes, ix)
+			}
+		}
+		table.Indexes = indexes
+	}
+	if len(table.Columns) == 0 {
+		return nil, fmt.Errorf("model %s has no columns", t.Name())
+	}
+	return table, nil
+}
+
+//Schema returns the schema of the database as it is now.
+func (m *sqlMigrator) Schema() (*Schema, error) {
+	result, err := m.dialect.schema(m.db)
+	if err != nil {
+		return nil, err
+	}
+	var tables []*Table
+	for _, t := range result.Tables {
+		if !isMigratorTable(t.Name) {
+			tables = append(tables, t)
+		}
+	}
+	result.Tables = tables
+	result.sort()
+	return result, nil
+}
+
+//SchemaDiff compares the schema of the database with the tables qbs would
+//create for the models, which are pointers to structs, and returns the
+//tables, columns and indexes that a migration must add.  Use WriteFiles of
+//the result to start that migration.
+func (m *sqlMigrator) SchemaDiff(models []interface{}) (*SchemaDiff, error) {
+	want, err := modelSchema(m.dialect, models)
+	if err != nil {
+		return nil, err
+	}
+	have, err := m.Schema()
+	if err != nil {
+		return nil, err
+	}
+	return diffSchema(have, want), nil
+}
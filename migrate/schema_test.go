@@ -0,0 +1,120 @@
+package migrate
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+type UserAccount struct {
+	Key      string `qbs:"pk,size:36"`
+	Email    string `qbs:"size:255,unique,notnull"`
+	Id       int64  `qbs:"index"`
+	Verified bool   `qbs:"default:false"`
+	Avatar   []byte
+	Ignored  string `qbs:"-"`
+	Created  time.Time
+	hidden   int
+}
+
+type APIToken struct {
+	Id      int64
+	OwnerID int64
+}
+
+//the names must be those qbs uses for its queries, whatever they look like
+func TestModelSchemaNames(t *testing.T) {
+	schema, err := modelSchema(sqliteDialect{}, []interface{}{&APIToken{}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	table := schema.Tables[0]
+	if table.Name != qbs.StructNameToTableName("APIToken") || table.Columns[1].Name != qbs.FieldNameToColumnName("OwnerID") {
+		t.Errorf("expected the names qbs uses, got %s %+v", table.Name, table.Columns)
+	}
+}
+
+func TestModelSchema(t *testing.T) {
+	schema, err := modelSchema(sqliteDialect{}, []interface{}{&gizmo{}, &UserAccount{}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(schema.Tables) != 2 || schema.Tables[0].Name != "gizmo" || schema.Tables[1].Name != "user_account" {
+		t.Fatalf("unexpected tables %+v", schema.Tables)
+	}
+	var buf bytes.Buffer
+	if err := schema.Dump(&buf); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := `CREATE TABLE gizmo (
+	id integer PRIMARY KEY,
+	label text NOT NULL,
+	made timestamp
+);
+
+CREATE TABLE user_account (
+	key varchar(36) PRIMARY KEY,
+	email varchar(255) NOT NULL,
+	id integer,
+	verified integer DEFAULT false,
+	avatar blob,
+	created timestamp
+);
+CREATE UNIQUE INDEX user_account_email_key ON user_account (email);
+CREATE INDEX user_account_id_idx ON user_account (id);
+
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected dump:\n%s", buf.String())
+	}
+
+	for _, bad := range []interface{}{gizmo{}, "gizmo", &struct{ C chan int }{}} {
+		if _, err := modelSchema(sqliteDialect{}, []interface{}{bad}); err == nil {
+			t.Errorf("expected %T to be refused", bad)
+		}
+	}
+	if _, err := modelSchema(sqliteDialect{}, []interface{}{&gizmo{}, &gizmo{}}); err == nil {
+		t.Errorf("expected two models of the same table to be refused")
+	}
+}
+
+func TestSchemaDiffWriteFiles(t *testing.T) {
+	want, err := modelSchema(postgresDialect{}, []interface{}{&gizmo{}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	diff := diffSchema(&Schema{}, want)
+	if !strings.Contains(diff.Up(), "id bigserial PRIMARY KEY") || diff.Down() != "DROP TABLE gizmo;\n" {
+		t.Errorf("unexpected migration %q %q", diff.Up(), diff.Down())
+	}
+	if !diffSchema(want, want).Empty() {
+		t.Errorf("expected no differences of a schema with itself")
+	}
+
+	dir := t.TempDir()
+	if err := diff.WriteFiles(dir, 3, "gizmo"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defn, err := LoadDefinitionsDir(dir, &Definitions{
+		Up:   map[int]MigrationFunc{1: oneUp, 2: twoUp},
+		Down: map[int]MigrationFunc{1: oneDown, 2: twoDown},
+	})
+	if err != nil || len(defn.Up) != 3 || defn.Names[3] != "gizmo" {
+		t.Fatalf("unable to load the migration written: %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "003_gizmo.up.sql"))
+	if err != nil || string(b) != diff.Up() {
+		t.Errorf("unexpected up migration %q (%v)", b, err)
+	}
+	if err := diff.WriteFiles(dir, 3, "gizmo"); err == nil {
+		t.Errorf("expected the files not to be overwritten")
+	}
+	if err := diff.WriteFiles(dir, 4, "bad name"); err == nil {
+		t.Errorf("expected a bad name to be refused")
+	}
+}
@@ -0,0 +1,283 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+)
+
+//dialect is the SQL that differs between databases for the MIGRATION_TABLE.
+type dialect interface {
+	createTable() string
+	//upgradeTable adds the columns that tables made by older versions lack
+	upgradeTable(*sql.DB) error
+	numQuery() string
+	//historyQuery selects n, name, checksum and t, the latest first
+	historyQuery() string
+	param(i int) string
+	//tryLock takes the migration lock and returns the function to release
+	//it, or returns a nil function and the holder if it is held
+	tryLock(*sql.DB) (func(), string, error)
+	//schema introspects the tables of the database
+	schema(*sql.DB) (*Schema, error)
+	//columnType is the type of a column for a field of a qbs model, or ""
+	//if there is none
+	columnType(t reflect.Type, size int, pk bool) string
+}
+
+//sqlMigrator is the implementation of Migrator shared by the databases, over
+//database/sql.
+type sqlMigrator struct {
+	db          *sql.DB
+	dialect     dialect
+	lockTimeout time.Duration
+	//dsn is the data source name db was opened with, for DryRun, or empty
+	//if the database cannot be opened again
+	dsn string
+}
+
+func newSqlMigrator(db *sql.DB, d dialect, dsn string) (*sqlMigrator, error) {
+	result := &sqlMigrator{
+		db:          db,
+		dialect:     d,
+		dsn:         dsn,
+		lockTimeout: MIGRATION_LOCK_TIMEOUT,
+	}
+	if err := result.createTableIfNotExists(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return result, nil
+}
+
+//DestroyMigrationRecords destroys the records kept about migrations. This
+//is almost certanily a bad idea anywhere except in a test.
+func (m *sqlMigrator) DestroyMigrationRecords() error {
+	_, err := m.db.Exec(m.deleteAll())
+	return err
+}
+
+//Close severs the db connection, if it exists.
+func (m *sqlMigrator) Close() error {
+	if m.db != nil {
+		return m.db.Close()
+	}
+	return nil
+}
+
+//database is the connection, for tests.
+func (m *sqlMigrator) database() *sql.DB {
+	return m.db
+}
+
+//createTableIfNotExists creates the table if it doesn't yet exist
+//otherwise does nothing.
+func (m *sqlMigrator) createTableIfNotExists() error {
+	if _, err := m.db.Exec(m.dialect.createTable()); err != nil {
+		return err
+	}
+	return m.dialect.upgradeTable(m.db)
+}
+
+//CurrentMigration returns the current migration number found in the
+//migrations table. If no migrations have been performed, this returns
+//zero.
+func (m *sqlMigrator) CurrentMigrationNumber() (int, error) {
+	curr := -9018
+	row := m.db.QueryRow(m.dialect.numQuery())
+	err := row.Scan(&curr)
+	if err != nil && err != sql.ErrNoRows {
+		return -1917, err
+	}
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return curr, nil
+}
+
+//Goes up to the last known migration. Returns the number of migrations
+//successfully performed.  Migrations are done in a transaction.  This
+//is shorthand for UpTo(len(migrations),migrations).
+func (m *sqlMigrator) Up(migrations map[int]MigrationFunc) (int, error) {
+	return m.UpTo(len(migrations), migrations)
+}
+
+//Goes Up to the migration given.Returns the number of migrations
+//successfully performed.  Migrations are done in a transaction. If
+//the current migration level is equal to or greater than the target
+//this is a noop.  Note that you pass where you want to BE after this
+//is done, not the migration to be performed.  For example, passing
+//1 as target implies running migration 1.  Like the other methods that
+//perform migrations, it holds the migration lock (see SetLockTimeout) so
+//that other migrators of the database wait for it.
+func (m *sqlMigrator) UpTo(target int, migrations map[int]MigrationFunc) (int, error) {
+	return m.locked(func() (int, error) {
+		return m.upTo(target, migrations, nil)
+	})
+}
+
+//UpDefinitions goes up to the migration given, or the last one if target
+//is 0, as UpTo does, but also records the name and checksum of each
+//migration so that Verify can notice if they change.  It does nothing and
+//returns a *DriftError if Verify finds drift, unless force is true.
+func (m *sqlMigrator) UpDefinitions(target int, defn *Definitions, force bool) (int, error) {
+	return m.locked(func() (int, error) {
+		if err := m.Verify(defn); err != nil {
+			if _, ok := err.(*DriftError); !ok || !force {
+				return 0, err
+			}
+			fmt.Printf("[migrator] ignoring drift: %v\n", err)
+		}
+		if target == 0 {
+			target = len(defn.Up)
+		}
+		return m.upTo(target, defn.Up, defn)
+	})
+}
+
+//Verify compares the migrations that have been performed with the
+//definitions and returns a *DriftError if any performed migration is no
+//longer defined, or has a different name or checksum.  Migrations without
+//a recorded or defined checksum, such as Go steps, are only checked by
+//number.
+func (m *sqlMigrator) Verify(defn *Definitions) error {
+	history, err := m.History()
+	if err != nil {
+		return err
+	}
+	return drift(history, defn)
+}
+
+//History returns the migrations that have been performed, the latest first.
+func (m *sqlMigrator) History() ([]Applied, error) {
+	rows, err := m.db.Query(m.dialect.historyQuery())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Applied
+	for rows.Next() {
+		var a Applied
+		if err := rows.Scan(&a.N, &a.Name, &a.Checksum, &a.T); err != nil {
+			return nil, err
+		}
+		result = append(result, a)
+	}
+	return result, rows.Err()
+}
+
+//upTo runs the up migrations; defn, if not nil, gives their names and
+//checksums.
+func (m *sqlMigrator) upTo(target int, migrations map[int]MigrationFunc, defn *Definitions) (int, error) {
+	curr, err := m.CurrentMigrationNumber()
+	if err != nil {
+		return 0, err
+	}
+	success := 0
+	for i := 0; i < target; i++ {
+		if i < curr {
+			continue
+		}
+		fmt.Printf("[migrator] attempting migration UP %03d\n", i+1)
+		err := m.step(migrations[i+1])
+		if err != nil {
+			return success, err
+		}
+		success++
+		var name, sum string
+		if defn != nil {
+			name, sum = defn.name(i+1), defn.checksum(i+1)
+		}
+		_, err = m.db.Exec(m.insertRow(), i+1, name, sum)
+		if err != nil {
+			return success, err
+		}
+	}
+	return success, nil
+}
+
+//Goes down to zero. Returns the number of number migrations done successfully.
+//Migrations are done in a transaction.  This is short for
+//DownTo(0,migrations).
+func (m *sqlMigrator) Down(migrations map[int]MigrationFunc) (int, error) {
+	return m.DownTo(0, migrations)
+}
+
+//Goes down to zero. Returns the number of number migrations done successfully.
+//Migrations are done in a transaction. Note that you pass the destination
+//migration number.  You pass 1 to mean that you want migrations 2 to current
+//run in reverse order.
+func (m *sqlMigrator) DownTo(target int, migrations map[int]MigrationFunc) (int, error) {
+	return m.locked(func() (int, error) {
+		return m.downTo(target, migrations)
+	})
+}
+
+func (m *sqlMigrator) downTo(target int, migrations map[int]MigrationFunc) (int, error) {
+	curr, err := m.CurrentMigrationNumber()
+	if err != nil {
+		return 0, err
+	}
+	success := 0
+	for i := curr; i > target; i-- {
+		fmt.Printf("[migrator] attempting migration DOWN %03d\n", i)
+		err := m.step(migrations[i])
+		if err != nil {
+			return success, err
+		}
+		success++
+		_, err = m.db.Exec(m.deleteRow(i))
+		if err != nil {
+			return success, err
+		}
+	}
+	return success, nil
+}
+
+//Single step, given a function.  There is no need for f
+func (m *sqlMigrator) step(fn MigrationFunc) error {
+	if fn == nil {
+		panic("step called but no function!")
+	}
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		fmt.Printf("got an error trying to run a step: %v", err)
+		if err := tx.Rollback(); err != nil {
+			panic(fmt.Sprintf("unable to rollback migration transaction:%v", err))
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		panic(fmt.Sprintf("unable to commit migration transaction:%v", err))
+	}
+	return nil
+}
+
+func (m *sqlMigrator) DumpHistory(writer io.Writer) error {
+	history, err := m.History()
+	if err != nil {
+		return err
+	}
+	for _, a := range history {
+		fmt.Fprintf(writer, "%03d %v %s\n", a.N, a.T, a.Name)
+	}
+	return nil
+}
+
+func (m *sqlMigrator) deleteAll() string {
+	return fmt.Sprintf("DELETE FROM %s", MIGRATION_TABLE)
+}
+
+func (m *sqlMigrator) insertRow() string {
+	return fmt.Sprintf("INSERT INTO %s (n, name, checksum) VALUES(%s, %s, %s)", MIGRATION_TABLE,
+		m.dialect.param(1), m.dialect.param(2), m.dialect.param(3))
+}
+
+func (m *sqlMigrator) deleteRow(i int) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE n = %d", MIGRATION_TABLE, i)
+}
@@ -0,0 +1,224 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+type sqliteMigrator struct {
+	*sqlMigrator
+}
+
+//NewSqliteMigrator returns a migrator for the sqlite database in the file
+//given, which is created if needed; ":memory:" is a private, in memory
+//database.  It behaves as the postgres one does, so migrations can be
+//tried locally, as long as they only use SQL both databases understand.
+//The program must be linked with the sqlite3 driver, such as by
+//importing _ "github.com/mattn/go-sqlite3".
+func NewSqliteMigrator(path string) (Migrator, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	//one connection, so that an in memory database is the same database
+	//throughout, and a file is not locked against ourselves
+	db.SetMaxOpenConns(1)
+	//wait for other migrators of a file, rather than failing, when they
+	//are writing
+	if _, err := db.Exec("PRAGMA busy_timeout = 5000"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	//an in memory database is private to its connection
+	dsn := path
+	if strings.Contains(path, ":memory:") || strings.Contains(path, "mode=memory") {
+		dsn = ""
+	}
+	m, err := newSqlMigrator(db, sqliteDialect{}, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteMigrator{m}, nil
+}
+
+type sqliteDialect struct{}
+
+//timestamps are kept to the millisecond (current_timestamp is to the
+//second) and ties, within the same millisecond, go to the later row
+func (d sqliteDialect) createTable() string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (n INTEGER, t TIMESTAMP DEFAULT (strftime('%%Y-%%m-%%d %%H:%%M:%%f', 'now')), name TEXT, checksum TEXT)",
+		MIGRATION_TABLE)
+}
+
+//sqlite has no ADD COLUMN IF NOT EXISTS
+func (d sqliteDialect) upgradeTable(db *sql.DB) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", MIGRATION_TABLE))
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var def sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &def, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		have[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, col := range []string{"name", "checksum"} {
+		if have[col] {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s TEXT", MIGRATION_TABLE, col)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d sqliteDialect) numQuery() string {
+	return fmt.Sprintf("SELECT n FROM %s ORDER BY t DESC, rowid DESC LIMIT 1", MIGRATION_TABLE)
+}
+
+func (d sqliteDialect) historyQuery() string {
+	return fmt.Sprintf("SELECT n,COALESCE(name,''),COALESCE(checksum,''),t FROM %s ORDER BY t DESC, rowid DESC", MIGRATION_TABLE)
+}
+
+func (d sqliteDialect) param(i int) string {
+	return "?"
+}
+
+//sqlite has no advisory locks, so the lock is a row of MIGRATION_LOCK_TABLE.
+//If a migrator dies holding it, delete the row by hand.
+func (d sqliteDialect) tryLock(db *sql.DB) (func(), string, error) {
+	create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id INTEGER PRIMARY KEY CHECK (id = 1), holder TEXT)", MIGRATION_LOCK_TABLE)
+	if _, err := db.Exec(create); err != nil {
+		return nil, "", err
+	}
+	me := lockHolder()
+	result, err := db.Exec(fmt.Sprintf("INSERT OR IGNORE INTO %s (id, holder) VALUES (1, ?)", MIGRATION_LOCK_TABLE), me)
+	if err != nil {
+		return nil, "", err
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		var holder string
+		db.QueryRow(fmt.Sprintf("SELECT holder FROM %s WHERE id = 1", MIGRATION_LOCK_TABLE)).Scan(&holder)
+		return nil, holder, err
+	}
+	return func() {
+		if _, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = 1 AND holder = ?", MIGRATION_LOCK_TABLE), me); err != nil {
+			fmt.Printf("[migrator] unable to release the migration lock: %v\n", err)
+		}
+	}, "", nil
+}
+
+func (d sqliteDialect) schema(db *sql.DB) (*Schema, error) {
+	//there is one connection, so each query is read before the next
+	var names []string
+	err := queryEach(db, func(scan func(...interface{}) error) error {
+		var name string
+		if err := scan(&name); err != nil {
+			return err
+		}
+		names = append(names, name)
+		return nil
+	}, "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	result := &Schema{}
+	for _, name := range names {
+		t := result.add(name)
+		err := queryEach(db, func(scan func(...interface{}) error) error {
+			var c Column
+			var pk int
+			if err := scan(&c.Name, &c.Type, &c.NotNull, &c.Default, &pk); err != nil {
+				return err
+			}
+			c.PK = pk > 0
+			t.Columns = append(t.Columns, c)
+			return nil
+		}, `SELECT name, type, "notnull", COALESCE(dflt_value, ''), pk FROM pragma_table_info(?) ORDER BY cid`, name)
+		if err != nil {
+			return nil, err
+		}
+		type index struct {
+			name   string
+			unique bool
+		}
+		var indexes []index
+		err = queryEach(db, func(scan func(...interface{}) error) error {
+			var ix index
+			if err := scan(&ix.name, &ix.unique); err != nil {
+				return err
+			}
+			indexes = append(indexes, ix)
+			return nil
+		}, `SELECT name, "unique" FROM pragma_index_list(?) WHERE origin != 'pk' ORDER BY name`, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ix := range indexes {
+			err := queryEach(db, func(scan func(...interface{}) error) error {
+				var column string
+				if err := scan(&column); err != nil {
+					return err
+				}
+				t.addIndexColumn(ix.name, ix.unique, column)
+				return nil
+			}, "SELECT name FROM pragma_index_info(?) ORDER BY seqno", ix.name)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+//queryEach calls fn with the scan of each row of the query.
+func queryEach(db *sql.DB, fn func(scan func(...interface{}) error) error, query string, args ...interface{}) error {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows.Scan); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+//the types qbs uses for sqlite; an integer primary key is the rowid
+func (d sqliteDialect) columnType(t reflect.Type, size int, pk bool) string {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "real"
+	case reflect.String:
+		if size > 0 {
+			return fmt.Sprintf("varchar(%d)", size)
+		}
+		return "text"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "blob"
+		}
+	case reflect.Struct:
+		if t == timeType {
+			return "timestamp"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,86 @@
+package migrate
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openSqlite(t *testing.T) Migrator {
+	m, err := NewSqliteMigrator(":memory:")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return m
+}
+
+func TestSqliteConformance(t *testing.T) {
+	//a file, so that the suite can open it more than once
+	path := filepath.Join(t.TempDir(), "conformance.db")
+	migratorConformance(t, func(t *testing.T) Migrator {
+		m, err := NewSqliteMigrator(path)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return m
+	})
+}
+
+func TestSqliteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mig.db")
+	m, err := NewSqliteMigrator(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := m.Up(migs.Up); err != nil {
+		t.Fatalf("failed to perform migration: %v", err)
+	}
+	m.Close()
+
+	//the records are kept with the database
+	m, err = NewSqliteMigrator(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer m.Close()
+	curr, err := m.CurrentMigrationNumber()
+	if err != nil || curr != 2 {
+		t.Errorf("expected to be at migration 2 after reopening but got %d (%v)", curr, err)
+	}
+}
+
+func TestSqliteMemoryDryRun(t *testing.T) {
+	m := openSqlite(t)
+	defer m.Close()
+	if _, err := m.DryRun(2, &migs); err == nil {
+		t.Errorf("expected an in memory database to refuse a dry run")
+	}
+}
+
+func TestSqliteUpgradeTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	//the table as it was before names and checksums
+	if _, err := db.Exec("CREATE TABLE migrations (n INTEGER, t TIMESTAMP DEFAULT current_timestamp); INSERT INTO migrations (n) VALUES (1)"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	db.Close()
+
+	m, err := NewSqliteMigrator(path)
+	if err != nil {
+		t.Fatalf("unable to open an old database: %v", err)
+	}
+	defer m.Close()
+	history, err := m.History()
+	if err != nil || len(history) != 1 || history[0].N != 1 || history[0].Checksum != "" {
+		t.Errorf("unexpected history %+v (%v)", history, err)
+	}
+	if err := m.Verify(driftFiles(t, "ALTER TABLE foobar ADD COLUMN t text")); err != nil {
+		t.Errorf("unexpected drift: %v", err)
+	}
+}
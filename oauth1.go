@@ -0,0 +1,145 @@
+package seven5
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	oauth1 "github.com/garyburd/go-oauth/oauth"
+)
+
+//Oauth1Endpoints describes an oauth1a provider.  The three urls are those of
+//the oauth1a handshake.  UserInfoURL and IdField are as for Oauth2Endpoints.
+type Oauth1Endpoints struct {
+	RequestTokenURL string
+	AuthorizeURL    string
+	AccessTokenURL  string
+	UserInfoURL     string
+	IdField         string
+}
+
+//Oauth1Connector is an OauthConnector for oauth1a providers.  Phase1 gets
+//temporary credentials, which are remembered until Phase2 (for at most
+//OAUTH2_STATE_TTL).  The state is passed through the callback url since
+//oauth1a has no state parameter.
+type Oauth1Connector struct {
+	name         string
+	endpoints    Oauth1Endpoints
+	client       oauth1.Client
+	redirectHost string
+	httpClient   *http.Client
+
+	lock    sync.Mutex
+	pending map[string]*oauth1Pending
+}
+
+type oauth1Pending struct {
+	creds   *oauth1.Credentials
+	expires time.Time
+}
+
+//NewOauth1Connector returns a connector for the provider with the given
+//endpoints.  The other parameters are as for NewOauth2Connector.
+func NewOauth1Connector(name string, ep Oauth1Endpoints, detail OauthClientDetail, redirectHost string) *Oauth1Connector {
+	return &Oauth1Connector{
+		name:      name,
+		endpoints: ep,
+		client: oauth1.Client{
+			Credentials: oauth1.Credentials{
+				Token:  detail.ClientId(name),
+				Secret: detail.ClientSecret(name),
+			},
+			TemporaryCredentialRequestURI: ep.RequestTokenURL,
+			ResourceOwnerAuthorizationURI: ep.AuthorizeURL,
+			TokenRequestURI:               ep.AccessTokenURL,
+		},
+		redirectHost: strings.TrimSuffix(redirectHost, "/"),
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+		pending:      make(map[string]*oauth1Pending),
+	}
+}
+
+//SetHTTPClient replaces the client used to talk to the provider.
+func (self *Oauth1Connector) SetHTTPClient(c *http.Client) {
+	self.httpClient = c
+}
+
+func (self *Oauth1Connector) Name() string                 { return self.name }
+func (self *Oauth1Connector) ClientTokenValueName() string { return "oauth_token" }
+func (self *Oauth1Connector) CodeValueName() string        { return "oauth_verifier" }
+func (self *Oauth1Connector) ErrorValueName() string       { return "denied" }
+func (self *Oauth1Connector) StateValueName() string       { return "state" }
+
+//Phase1 gets temporary credentials from the provider.
+func (self *Oauth1Connector) Phase1(state string, callbackPath string) (OauthCred, error) {
+	callback := JoinURL(self.redirectHost, callbackPath) + "?" + url.Values{"state": {state}}.Encode()
+	creds, err := self.client.RequestTemporaryCredentials(self.httpClient, callback, nil)
+	if err != nil {
+		return nil, err
+	}
+	self.lock.Lock()
+	for k, v := range self.pending {
+		if v.expires.Before(time.Now()) {
+			delete(self.pending, k)
+		}
+	}
+	self.pending[creds.Token] = &oauth1Pending{creds, time.Now().Add(OAUTH2_STATE_TTL)}
+	self.lock.Unlock()
+	return &SimpleOauthCred{creds}, nil
+}
+
+func (self *Oauth1Connector) UserInteractionURL(p1creds OauthCred, state string, callbackPath string) string {
+	return self.client.AuthorizationURL(&oauth1.Credentials{Token: p1creds.Token(), Secret: p1creds.Secret()}, nil)
+}
+
+//Phase2 exchanges the temporary credentials named by clientToken, and the
+//verifier, for token credentials.
+func (self *Oauth1Connector) Phase2(clientToken string, code string) (OauthConnection, error) {
+	self.lock.Lock()
+	p, ok := self.pending[clientToken]
+	delete(self.pending, clientToken)
+	self.lock.Unlock()
+	if !ok || p.expires.Before(time.Now()) {
+		return nil, BAD_OAUTH_STATE
+	}
+	creds, _, err := self.client.RequestToken(self.httpClient, p.creds, code)
+	if err != nil {
+		return nil, err
+	}
+	return &Oauth1Connection{client: &self.client, creds: creds, httpClient: self.httpClient}, nil
+}
+
+//UserInfo fetches the UserInfoURL of the provider with the connection.
+func (self *Oauth1Connector) UserInfo(conn OauthConnection) (map[string]interface{}, error) {
+	return oauthUserInfo(self.name, self.endpoints.UserInfoURL, conn)
+}
+
+//UniqueInfo returns the user's id at the provider, prefixed with the name of
+//the connector, suitable for use as the uniqueInfo of a session.
+func (self *Oauth1Connector) UniqueInfo(conn OauthConnection) (string, error) {
+	info, err := self.UserInfo(conn)
+	if err != nil {
+		return "", err
+	}
+	return oauthUniqueInfo(self.name, self.endpoints.IdField, info)
+}
+
+//Oauth1Connection is the OauthConnection returned by Oauth1Connector.  It
+//signs each request with the token credentials.
+type Oauth1Connection struct {
+	client     *oauth1.Client
+	creds      *oauth1.Credentials
+	httpClient *http.Client
+}
+
+//Credentials returns the token credentials from the provider.
+func (self *Oauth1Connection) Credentials() OauthCred {
+	return &SimpleOauthCred{self.creds}
+}
+
+func (self *Oauth1Connection) SendAuthenticated(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", self.client.AuthorizationHeader(self.creds, req.Method, req.URL, nil))
+	return self.httpClient.Do(req)
+}
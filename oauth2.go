@@ -0,0 +1,314 @@
+package seven5
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OAUTH2_STATE_TTL = 10 * time.Minute
+)
+
+var (
+	BAD_OAUTH_STATE      = errors.New("Oauth state is unknown or has expired")
+	OAUTH_LOGIN_DECLINED = errors.New("Oauth login was declined by the application")
+)
+
+//Oauth2Endpoints describes an oauth2 provider.  AuthURL is where the user is
+//sent to log in and TokenURL is where the code is exchanged for a token.
+//UserInfoURL, if not "", returns a JSON object describing the user, whose
+//IdField is the user's (stable) id at the provider.
+type Oauth2Endpoints struct {
+	AuthURL     string
+	TokenURL    string
+	UserInfoURL string
+	IdField     string
+	Scopes      []string
+}
+
+var (
+	GOOGLE_OAUTH2 = Oauth2Endpoints{
+		AuthURL:     "https://accounts.google.com/o/oauth2/v2/auth",
+		TokenURL:    "https://oauth2.googleapis.com/token",
+		UserInfoURL: "https://openidconnect.googleapis.com/v1/userinfo",
+		IdField:     "sub",
+		Scopes:      []string{"openid", "email", "profile"},
+	}
+	GITHUB_OAUTH2 = Oauth2Endpoints{
+		AuthURL:     "https://github.com/login/oauth/authorize",
+		TokenURL:    "https://github.com/login/oauth/access_token",
+		UserInfoURL: "https://api.github.com/user",
+		IdField:     "id",
+		Scopes:      []string{"read:user", "user:email"},
+	}
+	MICROSOFT_OAUTH2 = Oauth2Endpoints{
+		AuthURL:     "https://login.microsoftonline.com/common/oauth2/v2.0/authorize",
+		TokenURL:    "https://login.microsoftonline.com/common/oauth2/v2.0/token",
+		UserInfoURL: "https://graph.microsoft.com/oidc/userinfo",
+		IdField:     "sub",
+		Scopes:      []string{"openid", "email", "profile"},
+	}
+)
+
+//EnvOauthClientDetail is an OauthClientDetail that reads the client id and
+//secret of a service from the environment variables SERVICE_CLIENT_ID and
+//SERVICE_CLIENT_SECRET, where SERVICE is the upper case service name.
+type EnvOauthClientDetail struct {
+}
+
+func (self *EnvOauthClientDetail) ClientId(serviceName string) string {
+	return os.Getenv(strings.ToUpper(serviceName) + "_CLIENT_ID")
+}
+
+func (self *EnvOauthClientDetail) ClientSecret(serviceName string) string {
+	return os.Getenv(strings.ToUpper(serviceName) + "_CLIENT_SECRET")
+}
+
+//Oauth2Token is the response of a provider's token endpoint.
+type Oauth2Token struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	IdToken      string `json:"id_token"`
+	Scope        string `json:"scope"`
+}
+
+type oauth2Pending struct {
+	verifier    string
+	redirectURI string
+	expires     time.Time
+}
+
+//Oauth2Connector is an OauthConnector for the oauth2 authorization code flow
+//with PKCE (RFC 7636).  Each call to UserInteractionURL remembers a code
+//verifier for the state given, and Phase2 must be called with that same state
+//as its clientToken; the state can be used only once and only for
+//OAUTH2_STATE_TTL.  Phase1 does nothing for oauth2.
+type Oauth2Connector struct {
+	name         string
+	endpoints    Oauth2Endpoints
+	clientId     string
+	clientSecret string
+	redirectHost string
+	client       *http.Client
+
+	lock    sync.Mutex
+	pending map[string]*oauth2Pending
+}
+
+//NewOauth2Connector returns a connector for the provider with the given
+//endpoints.  The client id and secret are found via the detail using the name
+//of the connector.  The redirectHost, usually DeploymentEnvironment.RedirectHost(),
+//is prefixed to callback paths to form the redirect uri registered with the
+//provider.
+func NewOauth2Connector(name string, ep Oauth2Endpoints, detail OauthClientDetail, redirectHost string) *Oauth2Connector {
+	return &Oauth2Connector{
+		name:         name,
+		endpoints:    ep,
+		clientId:     detail.ClientId(name),
+		clientSecret: detail.ClientSecret(name),
+		redirectHost: strings.TrimSuffix(redirectHost, "/"),
+		client:       &http.Client{Timeout: 30 * time.Second},
+		pending:      make(map[string]*oauth2Pending),
+	}
+}
+
+//SetHTTPClient replaces the client used to talk to the provider.
+func (self *Oauth2Connector) SetHTTPClient(c *http.Client) {
+	self.client = c
+}
+
+//Endpoints returns the provider description given to NewOauth2Connector.
+func (self *Oauth2Connector) Endpoints() Oauth2Endpoints {
+	return self.endpoints
+}
+
+func (self *Oauth2Connector) Name() string                 { return self.name }
+func (self *Oauth2Connector) ClientTokenValueName() string { return "" }
+func (self *Oauth2Connector) CodeValueName() string        { return "code" }
+func (self *Oauth2Connector) ErrorValueName() string       { return "error" }
+func (self *Oauth2Connector) StateValueName() string       { return "state" }
+
+func (self *Oauth2Connector) Phase1(state string, callbackPath string) (OauthCred, error) {
+	return nil, nil
+}
+
+//pkceChallenge is the S256 code challenge for the verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+//UserInteractionURL returns the url at the provider where the user should be
+//sent to log in.
+func (self *Oauth2Connector) UserInteractionURL(ignored OauthCred, state string, callbackPath string) string {
+	p := &oauth2Pending{
+		verifier:    randomHex(32),
+		redirectURI: JoinURL(self.redirectHost, callbackPath),
+		expires:     time.Now().Add(OAUTH2_STATE_TTL),
+	}
+	self.lock.Lock()
+	for k, v := range self.pending {
+		if v.expires.Before(time.Now()) {
+			delete(self.pending, k)
+		}
+	}
+	self.pending[state] = p
+	self.lock.Unlock()
+
+	v := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {self.clientId},
+		"redirect_uri":          {p.redirectURI},
+		"state":                 {state},
+		"code_challenge":        {pkceChallenge(p.verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	if len(self.endpoints.Scopes) > 0 {
+		v.Set("scope", strings.Join(self.endpoints.Scopes, " "))
+	}
+	sep := "?"
+	if strings.Contains(self.endpoints.AuthURL, "?") {
+		sep = "&"
+	}
+	return self.endpoints.AuthURL + sep + v.Encode()
+}
+
+//Phase2 exchanges the code for a token.  For oauth2 the clientToken must be
+//the state that was given to UserInteractionURL.
+func (self *Oauth2Connector) Phase2(state string, code string) (OauthConnection, error) {
+	self.lock.Lock()
+	p, ok := self.pending[state]
+	delete(self.pending, state)
+	self.lock.Unlock()
+	if !ok || p.expires.Before(time.Now()) {
+		return nil, BAD_OAUTH_STATE
+	}
+	tok, err := self.exchange(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURI},
+		"client_id":     {self.clientId},
+		"client_secret": {self.clientSecret},
+		"code_verifier": {p.verifier},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Oauth2Connection{token: tok, client: self.client}, nil
+}
+
+//exchange posts the form to the token endpoint.
+func (self *Oauth2Connector) exchange(form url.Values) (*Oauth2Token, error) {
+	req, err := http.NewRequest("POST", self.endpoints.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Oauth2Token
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("unable to understand token response (%d) from %s: %v", resp.StatusCode, self.name, err)
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("%s refused token request: %s %s", self.name, result.Error, result.Description)
+	}
+	if resp.StatusCode != http.StatusOK || result.AccessToken == "" {
+		return nil, fmt.Errorf("%s returned no access token (%d)", self.name, resp.StatusCode)
+	}
+	return &result.Oauth2Token, nil
+}
+
+//UserInfo fetches the UserInfoURL of the provider with the connection.
+func (self *Oauth2Connector) UserInfo(conn OauthConnection) (map[string]interface{}, error) {
+	return oauthUserInfo(self.name, self.endpoints.UserInfoURL, conn)
+}
+
+//UniqueInfo returns the user's id at the provider, prefixed with the name of
+//the connector, suitable for use as the uniqueInfo of a session.
+func (self *Oauth2Connector) UniqueInfo(conn OauthConnection) (string, error) {
+	info, err := self.UserInfo(conn)
+	if err != nil {
+		return "", err
+	}
+	return oauthUniqueInfo(self.name, self.endpoints.IdField, info)
+}
+
+//oauthUserInfo fetches the JSON object describing the user from a provider.
+func oauthUserInfo(name string, userInfoURL string, conn OauthConnection) (map[string]interface{}, error) {
+	if userInfoURL == "" {
+		return nil, fmt.Errorf("%s has no user info endpoint", name)
+	}
+	req, err := http.NewRequest("GET", userInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := conn.SendAuthenticated(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s user info returned %d", name, resp.StatusCode)
+	}
+	result := make(map[string]interface{})
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//oauthUniqueInfo returns the idField of the user info, prefixed with the name
+//of the connector.
+func oauthUniqueInfo(name string, idField string, info map[string]interface{}) (string, error) {
+	id, ok := info[idField]
+	if !ok || id == nil || fmt.Sprint(id) == "" {
+		return "", fmt.Errorf("%s user info has no %s", name, idField)
+	}
+	if f, ok := id.(float64); ok { //json numbers
+		return fmt.Sprintf("%s:%.0f", name, f), nil
+	}
+	return fmt.Sprintf("%s:%v", name, id), nil
+}
+
+//Oauth2Connection is the OauthConnection returned by Oauth2Connector.  It
+//sends requests with the access token as a bearer token.
+type Oauth2Connection struct {
+	token  *Oauth2Token
+	client *http.Client
+}
+
+//Token returns the token response from the provider.
+func (self *Oauth2Connection) Token() *Oauth2Token {
+	return self.token
+}
+
+func (self *Oauth2Connection) SendAuthenticated(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+self.token.AccessToken)
+	return self.client.Do(req)
+}
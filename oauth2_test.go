@@ -0,0 +1,130 @@
+package seven5
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type testClientDetail struct{}
+
+func (self *testClientDetail) ClientId(string) string     { return "client" }
+func (self *testClientDetail) ClientSecret(string) string { return "shh" }
+
+//a provider that issues a code for any authorize request and insists on PKCE
+func testOauth2Provider(t *testing.T) *httptest.Server {
+	challenges := make(map[string]string)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("code_challenge_method") != "S256" {
+			t.Errorf("expected S256 challenge")
+		}
+		code := randomHex(8)
+		challenges[code] = q.Get("code_challenge")
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code="+code+"&state="+q.Get("state"), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		c, ok := challenges[r.Form.Get("code")]
+		delete(challenges, r.Form.Get("code"))
+		if !ok || pkceChallenge(r.Form.Get("code_verifier")) != c || r.Form.Get("client_secret") != "shh" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "at-" + c, "token_type": "bearer"})
+	})
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer at-") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": 1234, "login": "fred"})
+	})
+	return httptest.NewServer(mux)
+}
+
+//follow runs the request through the handler and returns the redirect
+func follow(t *testing.T, h http.HandlerFunc, r *http.Request) (*url.URL, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected redirect, got %d", w.Code)
+	}
+	u, _ := url.Parse(w.Header().Get("Location"))
+	return u, w
+}
+
+func TestOauth2Login(t *testing.T) {
+	provider := testOauth2Provider(t)
+	defer provider.Close()
+	ep := Oauth2Endpoints{
+		AuthURL:     provider.URL + "/authorize",
+		TokenURL:    provider.URL + "/token",
+		UserInfoURL: provider.URL + "/user",
+		IdField:     "id",
+	}
+	conn := NewOauth2Connector("test", ep, &testClientDetail{}, "http://localhost:8080")
+	sm := NewDumbSessionManager()
+	sm.generator = &testGen{}
+	pm := NewSimplePageMapper("/error", "/welcome", "/bye")
+	h := NewOauthHandler(conn, sm, NewSimpleCookieMapper("myapp"), pm, "/auth/test/callback")
+
+	authorize, w := follow(t, h.LoginHandler, httptest.NewRequest("GET", "/auth/test/login", nil))
+	stateCookie := setCookieFromRecorder(t, w)
+	client := provider.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(authorize.String())
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected the provider to redirect to our callback: %v", err)
+	}
+	resp.Body.Close()
+	callback := resp.Header.Get("Location")
+
+	//without the browser's state cookie, the callback is refused
+	u, _ := follow(t, h.CallbackHandler, httptest.NewRequest("GET", callback, nil))
+	if u.Path != "/error" {
+		t.Errorf("expected login without state cookie to fail, got %s", u)
+	}
+
+	r := httptest.NewRequest("GET", callback, nil)
+	r.AddCookie(stateCookie)
+	u, w = follow(t, h.CallbackHandler, r)
+	if u.Path != "/welcome" {
+		t.Fatalf("expected login to succeed, got %s", u)
+	}
+	var session *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name != stateCookie.Name {
+			session = c
+		}
+	}
+	s, _, _ := ResolveCredential(sm, &Credential{SessionId: session.Value})
+	if s == nil || s.UserData() != "test:1234" {
+		t.Errorf("expected session for test:1234, got %v", s)
+	}
+
+	//state can only be used once
+	u, _ = follow(t, h.CallbackHandler, r)
+	if u.Path != "/error" {
+		t.Errorf("expected replayed callback to fail, got %s", u)
+	}
+}
+
+func TestOauthStateCookieSecure(t *testing.T) {
+	conn := NewOauth2Connector("test", Oauth2Endpoints{}, &testClientDetail{}, "http://localhost:8080")
+	h := NewOauthHandler(conn, NewDumbSessionManager(), NewSimpleCookieMapper("myapp"), NewSimplePageMapper("/error", "/welcome", "/bye"), "/auth/test/callback")
+	r := httptest.NewRequest("GET", "/auth/test/login", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	if !h.stateCookie(r, "x", 1).Secure {
+		t.Errorf("expected a trusted proxy's https to make the cookie secure")
+	}
+	h.SetTrustProxy(false)
+	if h.stateCookie(r, "x", 1).Secure {
+		t.Errorf("expected an untrusted X-Forwarded-Proto to be ignored")
+	}
+}
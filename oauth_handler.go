@@ -0,0 +1,163 @@
+package seven5
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	s5OauthStateCookie = "s5-oauth-state-"
+)
+
+//OauthIdentity turns a connection, just returned from Phase2, into the unique
+//id of the user that is given to the SessionManager.
+type OauthIdentity func(OauthConnector, OauthConnection) (string, error)
+
+//OauthUniqueInfo is implemented by connectors, such as Oauth2Connector, that
+//know how to ask their provider who the user is.
+type OauthUniqueInfo interface {
+	UniqueInfo(OauthConnection) (string, error)
+}
+
+//DefaultOauthIdentity uses the connector's UniqueInfo, if it has one.
+func DefaultOauthIdentity(conn OauthConnector, oc OauthConnection) (string, error) {
+	u, ok := conn.(OauthUniqueInfo)
+	if !ok {
+		return "", fmt.Errorf("connector %s cannot identify users, provide an OauthIdentity", conn.Name())
+	}
+	return u.UniqueInfo(oc)
+}
+
+//OauthHandler drives the login with an OauthConnector.  LoginHandler sends the
+//user to the provider, which sends them back to CallbackHandler (which must be
+//bound to the callbackPath).  The callback checks that the state is the one
+//given to this browser, calls Phase2, identifies the user and assigns them a
+//session.  The user then lands on the pages given by the PageMapper.
+type OauthHandler struct {
+	connector    OauthConnector
+	sm           SessionManager
+	cm           CookieMapper
+	pm           PageMapper
+	callbackPath string
+	identity     OauthIdentity
+	trustProxy   bool
+}
+
+//NewOauthHandler returns a handler for the connector.  The callbackPath, such
+//as "/auth/google/callback", is the path part of the redirect uri registered
+//with the provider.
+func NewOauthHandler(conn OauthConnector, sm SessionManager, cm CookieMapper, pm PageMapper, callbackPath string) *OauthHandler {
+	return &OauthHandler{
+		connector:    conn,
+		sm:           sm,
+		cm:           cm,
+		pm:           pm,
+		callbackPath: callbackPath,
+		identity:     DefaultOauthIdentity,
+		trustProxy:   true,
+	}
+}
+
+//SetIdentity replaces the function that identifies users after Phase2.
+func (self *OauthHandler) SetIdentity(id OauthIdentity) {
+	self.identity = id
+}
+
+//SetTrustProxy sets whether X-Forwarded-Proto is believed when deciding if
+//the state cookie must be Secure; see RequestIsHTTPS.  The default is true,
+//as for HTTPSHandler.
+func (self *OauthHandler) SetTrustProxy(b bool) {
+	self.trustProxy = b
+}
+
+func (self *OauthHandler) stateCookie(r *http.Request, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     s5OauthStateCookie + self.connector.Name(),
+		Value:    value,
+		Path:     self.callbackPath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   RequestIsHTTPS(r, self.trustProxy),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (self *OauthHandler) fail(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("[OAUTH] %s login failed: %v", self.connector.Name(), err)
+	http.Redirect(w, r, self.pm.ErrorPage(self.connector, err.Error()), http.StatusFound)
+}
+
+//LoginHandler starts the login by redirecting the user to the provider.
+func (self *OauthHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	state := randomHex(16)
+	creds, err := self.connector.Phase1(state, self.callbackPath)
+	if err != nil {
+		self.fail(w, r, err)
+		return
+	}
+	http.SetCookie(w, self.stateCookie(r, state, int(OAUTH2_STATE_TTL/time.Second)))
+	http.Redirect(w, r, self.connector.UserInteractionURL(creds, state, self.callbackPath), http.StatusFound)
+}
+
+//CallbackHandler finishes the login when the provider sends the user back.
+func (self *OauthHandler) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if e := q.Get(self.connector.ErrorValueName()); e != "" {
+		self.fail(w, r, errors.New(e))
+		return
+	}
+	state := q.Get(self.connector.StateValueName())
+	c, err := r.Cookie(s5OauthStateCookie + self.connector.Name())
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(c.Value), []byte(state)) != 1 {
+		self.fail(w, r, BAD_OAUTH_STATE)
+		return
+	}
+	http.SetCookie(w, self.stateCookie(r, "", -1))
+
+	clientToken := state
+	if name := self.connector.ClientTokenValueName(); name != "" {
+		clientToken = q.Get(name)
+	}
+	code := q.Get(self.connector.CodeValueName())
+	conn, err := self.connector.Phase2(clientToken, code)
+	if err != nil {
+		self.fail(w, r, err)
+		return
+	}
+	uniq, err := self.identity(self.connector, conn)
+	if err != nil {
+		self.fail(w, r, err)
+		return
+	}
+	ud, err := self.sm.Generate(uniq)
+	if err != nil {
+		self.fail(w, r, err)
+		return
+	}
+	if ud == nil {
+		//as in ResolveCredential, no user data means the Generator declines
+		self.fail(w, r, OAUTH_LOGIN_DECLINED)
+		return
+	}
+	session, err := self.sm.Assign(uniq, ud, time.Time{})
+	if err != nil {
+		self.fail(w, r, err)
+		return
+	}
+	self.cm.AssociateCookie(w, session)
+	log.Printf("[OAUTH] user %s logged in with %s", uniq, self.connector.Name())
+	http.Redirect(w, r, self.pm.LoginLandingPage(self.connector, state, code), http.StatusFound)
+}
+
+//LogoutHandler destroys the user's session and sends them to the logout page.
+func (self *OauthHandler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if val, err := self.cm.Value(r); err == nil {
+		self.sm.Destroy(val)
+	}
+	self.cm.RemoveCookie(w)
+	http.Redirect(w, r, self.pm.LogoutLandingPage(self.connector), http.StatusFound)
+}
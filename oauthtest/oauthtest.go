@@ -0,0 +1,481 @@
+//Package oauthtest has a fake oauth2, oauth1a and OpenID Connect provider for
+//testing logins through seven5.OauthHandler, without a network or real
+//accounts.  It is only for tests; applications should not import it.
+package oauthtest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/seven5/seven5"
+)
+
+//CLIENT_ID and CLIENT_SECRET are the only client credentials a Provider
+//accepts; the Provider gives them to connectors as their OauthClientDetail.
+const (
+	CLIENT_ID     = "fake-client"
+	CLIENT_SECRET = "fake-secret"
+)
+
+//Failure selects how a Provider misbehaves.
+type Failure int
+
+const (
+	FAIL_NONE         Failure = iota
+	FAIL_DENY                 //user refuses at the authorize page
+	FAIL_BAD_CODE             //token endpoint refuses the code or verifier
+	FAIL_SERVER_ERROR         //token endpoint returns 500
+	FAIL_BAD_USER             //user info endpoint refuses the token
+	FAIL_BAD_ID_TOKEN         //ID tokens are signed with the wrong key
+)
+
+//User is the user that a Provider logs in.  The user info
+//endpoints return it as a JSON object with the fields id (and, like OIDC, sub),
+//login and email.
+type User struct {
+	Id    string
+	Login string
+	Email string
+}
+
+type oauth2Grant struct {
+	challenge   string
+	redirectURI string
+	nonce       string
+	openid      bool
+}
+
+type oauth1Temp struct {
+	callback string
+	verifier string
+}
+
+//Provider is an in-process oauth2 and oauth1a provider for tests.  It
+//approves every login as the configured user (unless told to fail) and
+//checks the client id and secret, state, PKCE and the tokens it issued.  It
+//does _not_ check oauth1a signatures.  The oauth2 side is also an OpenID
+//Connect provider, whose issuer is URL(), that signs ID tokens with ES256 when
+//the openid scope is requested.  The provider is also the OauthClientDetail
+//for connectors that talk to it; see NewOauth2Connector and
+//NewOauth1Connector.  Use Login to run a whole login through an OauthHandler.
+type Provider struct {
+	server *httptest.Server
+
+	lock    sync.Mutex
+	user    User
+	failure Failure
+	grants  map[string]*oauth2Grant //oauth2 code
+	tokens  map[string]bool         //oauth2 access token
+	temp    map[string]*oauth1Temp  //oauth1 request token
+	access  map[string]bool         //oauth1 access token
+	key     *ecdsa.PrivateKey
+}
+
+//NewProvider starts a provider that logs in the user "fred".  Call
+//Close when done.
+func NewProvider() *Provider {
+	result := &Provider{
+		user:   User{Id: "1234", Login: "fred", Email: "fred@example.com"},
+		grants: make(map[string]*oauth2Grant),
+		tokens: make(map[string]bool),
+		temp:   make(map[string]*oauth1Temp),
+		access: make(map[string]bool),
+		key:    newSigningKey(),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", result.oidcDiscovery)
+	mux.HandleFunc("/oauth2/jwks", result.oidcJwks)
+	mux.HandleFunc("/oauth2/authorize", result.oauth2Authorize)
+	mux.HandleFunc("/oauth2/token", result.oauth2Token)
+	mux.HandleFunc("/oauth2/userinfo", result.oauth2UserInfo)
+	mux.HandleFunc("/oauth1/request_token", result.oauth1RequestToken)
+	mux.HandleFunc("/oauth1/authorize", result.oauth1Authorize)
+	mux.HandleFunc("/oauth1/access_token", result.oauth1AccessToken)
+	mux.HandleFunc("/oauth1/userinfo", result.oauth1UserInfo)
+	result.server = httptest.NewServer(mux)
+	return result
+}
+
+//URL returns the base url of the provider.
+func (self *Provider) URL() string {
+	return self.server.URL
+}
+
+//Close shuts down the provider.
+func (self *Provider) Close() {
+	self.server.Close()
+}
+
+//SetUser changes the user that is logged in.
+func (self *Provider) SetUser(u User) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.user = u
+}
+
+//Fail makes the provider fail in the way given, until Fail(FAIL_NONE).
+func (self *Provider) Fail(f Failure) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.failure = f
+}
+
+func (self *Provider) ClientId(string) string     { return CLIENT_ID }
+func (self *Provider) ClientSecret(string) string { return CLIENT_SECRET }
+
+//Oauth2Endpoints returns the oauth2 side of the provider.
+func (self *Provider) Oauth2Endpoints() seven5.Oauth2Endpoints {
+	return seven5.Oauth2Endpoints{
+		AuthURL:     self.server.URL + "/oauth2/authorize",
+		TokenURL:    self.server.URL + "/oauth2/token",
+		UserInfoURL: self.server.URL + "/oauth2/userinfo",
+		IdField:     "id",
+	}
+}
+
+//Oauth1Endpoints returns the oauth1a side of the provider.
+func (self *Provider) Oauth1Endpoints() seven5.Oauth1Endpoints {
+	return seven5.Oauth1Endpoints{
+		RequestTokenURL: self.server.URL + "/oauth1/request_token",
+		AuthorizeURL:    self.server.URL + "/oauth1/authorize",
+		AccessTokenURL:  self.server.URL + "/oauth1/access_token",
+		UserInfoURL:     self.server.URL + "/oauth1/userinfo",
+		IdField:         "id",
+	}
+}
+
+//NewOauth2Connector returns an Oauth2Connector that uses this provider.
+func (self *Provider) NewOauth2Connector(name string, redirectHost string) *seven5.Oauth2Connector {
+	return seven5.NewOauth2Connector(name, self.Oauth2Endpoints(), self, redirectHost)
+}
+
+//NewOauth1Connector returns an Oauth1Connector that uses this provider.
+func (self *Provider) NewOauth1Connector(name string, redirectHost string) *seven5.Oauth1Connector {
+	return seven5.NewOauth1Connector(name, self.Oauth1Endpoints(), self, redirectHost)
+}
+
+//NewOIDCConnector returns an OIDCConnector that discovers this provider.
+func (self *Provider) NewOIDCConnector(name string, redirectHost string) (*seven5.OIDCConnector, error) {
+	return seven5.NewOIDCConnector(name, self.server.URL, self, redirectHost)
+}
+
+//Login plays the part of the browser in a login through h: it calls the
+//LoginHandler, visits the provider and brings the result back to the
+//CallbackHandler.  It returns the url of the landing page (from the
+//PageMapper) and the cookies set by the callback.  The error is only for
+//failures to talk to the provider; a refused login lands on the error page.
+func (self *Provider) Login(h *seven5.OauthHandler) (*url.URL, []*http.Cookie, error) {
+	w := httptest.NewRecorder()
+	h.LoginHandler(w, httptest.NewRequest("GET", "/login", nil))
+	loc := w.Header().Get("Location")
+	if !strings.HasPrefix(loc, self.server.URL) {
+		//never got to the provider
+		u, err := url.Parse(loc)
+		return u, w.Result().Cookies(), err
+	}
+	client := self.server.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(loc)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		return nil, nil, fmt.Errorf("fake provider returned %d", resp.StatusCode)
+	}
+	r := httptest.NewRequest("GET", resp.Header.Get("Location"), nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	h.CallbackHandler(w, r)
+	u, err := url.Parse(w.Header().Get("Location"))
+	return u, w.Result().Cookies(), err
+}
+
+func (self *Provider) sendUser(w http.ResponseWriter) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":    self.user.Id,
+		"sub":   self.user.Id,
+		"login": self.user.Login,
+		"email": self.user.Email,
+	})
+}
+
+func addQuery(base string, v url.Values) string {
+	if strings.Contains(base, "?") {
+		return base + "&" + v.Encode()
+	}
+	return base + "?" + v.Encode()
+}
+
+//
+// OAUTH2
+//
+
+func (self *Provider) oauth2Authorize(w http.ResponseWriter, r *http.Request) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	q := r.URL.Query()
+	redirect := q.Get("redirect_uri")
+	if q.Get("client_id") != CLIENT_ID || redirect == "" {
+		http.Error(w, "bad client", http.StatusBadRequest)
+		return
+	}
+	if self.failure == FAIL_DENY {
+		http.Redirect(w, r, addQuery(redirect, url.Values{"error": {"access_denied"}, "state": {q.Get("state")}}), http.StatusFound)
+		return
+	}
+	code := randomHex(16)
+	self.grants[code] = &oauth2Grant{
+		challenge:   q.Get("code_challenge"),
+		redirectURI: redirect,
+		nonce:       q.Get("nonce"),
+		openid:      containsString(strings.Fields(q.Get("scope")), "openid"),
+	}
+	http.Redirect(w, r, addQuery(redirect, url.Values{"code": {code}, "state": {q.Get("state")}}), http.StatusFound)
+}
+
+func (self *Provider) oauth2Token(w http.ResponseWriter, r *http.Request) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	r.ParseForm()
+	if self.failure == FAIL_SERVER_ERROR {
+		http.Error(w, "oops", http.StatusInternalServerError)
+		return
+	}
+	code := r.Form.Get("code")
+	g, ok := self.grants[code]
+	delete(self.grants, code)
+	refuse := !ok || self.failure == FAIL_BAD_CODE ||
+		r.Form.Get("client_id") != CLIENT_ID || r.Form.Get("client_secret") != CLIENT_SECRET ||
+		r.Form.Get("redirect_uri") != g.redirectURI ||
+		(g.challenge != "" && pkceChallenge(r.Form.Get("code_verifier")) != g.challenge)
+	w.Header().Set("Content-Type", "application/json")
+	if refuse {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	tok := randomHex(16)
+	self.tokens[tok] = true
+	result := map[string]interface{}{"access_token": tok, "token_type": "bearer", "expires_in": 3600}
+	if g.openid {
+		result["id_token"] = self.idToken(g.nonce)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (self *Provider) oauth2UserInfo(w http.ResponseWriter, r *http.Request) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	auth := r.Header.Get("Authorization")
+	if self.failure == FAIL_BAD_USER || !strings.HasPrefix(auth, "Bearer ") || !self.tokens[auth[7:]] {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	self.sendUser(w)
+}
+
+//
+// OAUTH1A
+//
+
+//oauth1Params returns the oauth_ parameters of the Authorization header.
+func oauth1Params(r *http.Request) map[string]string {
+	result := make(map[string]string)
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "OAuth ") {
+		return result
+	}
+	for _, part := range strings.Split(h[6:], ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v, err := url.QueryUnescape(strings.Trim(kv[1], `"`))
+		if err == nil {
+			result[kv[0]] = v
+		}
+	}
+	return result
+}
+
+func (self *Provider) oauth1RequestToken(w http.ResponseWriter, r *http.Request) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	p := oauth1Params(r)
+	if p["oauth_consumer_key"] != CLIENT_ID || p["oauth_callback"] == "" {
+		http.Error(w, "bad client", http.StatusUnauthorized)
+		return
+	}
+	tok := randomHex(16)
+	self.temp[tok] = &oauth1Temp{callback: p["oauth_callback"]}
+	w.Write([]byte(url.Values{
+		"oauth_token":              {tok},
+		"oauth_token_secret":       {randomHex(16)},
+		"oauth_callback_confirmed": {"true"},
+	}.Encode()))
+}
+
+func (self *Provider) oauth1Authorize(w http.ResponseWriter, r *http.Request) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	tok := r.URL.Query().Get("oauth_token")
+	t, ok := self.temp[tok]
+	if !ok {
+		http.Error(w, "unknown token", http.StatusBadRequest)
+		return
+	}
+	if self.failure == FAIL_DENY {
+		delete(self.temp, tok)
+		http.Redirect(w, r, addQuery(t.callback, url.Values{"denied": {tok}}), http.StatusFound)
+		return
+	}
+	t.verifier = randomHex(8)
+	http.Redirect(w, r, addQuery(t.callback, url.Values{"oauth_token": {tok}, "oauth_verifier": {t.verifier}}), http.StatusFound)
+}
+
+func (self *Provider) oauth1AccessToken(w http.ResponseWriter, r *http.Request) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.failure == FAIL_SERVER_ERROR {
+		http.Error(w, "oops", http.StatusInternalServerError)
+		return
+	}
+	p := oauth1Params(r)
+	t, ok := self.temp[p["oauth_token"]]
+	delete(self.temp, p["oauth_token"])
+	if !ok || self.failure == FAIL_BAD_CODE || p["oauth_consumer_key"] != CLIENT_ID ||
+		t.verifier == "" || p["oauth_verifier"] != t.verifier {
+		http.Error(w, "bad verifier", http.StatusUnauthorized)
+		return
+	}
+	tok := randomHex(16)
+	self.access[tok] = true
+	w.Write([]byte(url.Values{"oauth_token": {tok}, "oauth_token_secret": {randomHex(16)}}.Encode()))
+}
+
+func (self *Provider) oauth1UserInfo(w http.ResponseWriter, r *http.Request) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	p := oauth1Params(r)
+	if self.failure == FAIL_BAD_USER || !self.access[p["oauth_token"]] {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	self.sendUser(w)
+}
+
+//
+// OPENID CONNECT
+//
+
+const signingKid = "fake-1"
+
+func newSigningKey() *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("unable to generate key: %v", err))
+	}
+	return key
+}
+
+func (self *Provider) oidcDiscovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(&seven5.OIDCDiscovery{
+		Issuer:                self.server.URL,
+		AuthorizationEndpoint: self.server.URL + "/oauth2/authorize",
+		TokenEndpoint:         self.server.URL + "/oauth2/token",
+		UserinfoEndpoint:      self.server.URL + "/oauth2/userinfo",
+		JwksURI:               self.server.URL + "/oauth2/jwks",
+		ScopesSupported:       []string{"openid", "email", "profile"},
+	})
+}
+
+func (self *Provider) oidcJwks(w http.ResponseWriter, r *http.Request) {
+	pub := self.key.PublicKey
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []*jsonWebKey{{
+			Kty: "EC",
+			Kid: signingKid,
+			Use: "sig",
+			Crv: "P-256",
+			X:   base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, 32))),
+			Y:   base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, 32))),
+		}},
+	})
+}
+
+//idToken returns a signed ID token for the user; the lock must be held.
+func (self *Provider) idToken(nonce string) string {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": signingKid, "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":            self.server.URL,
+		"sub":            self.user.Id,
+		"aud":            CLIENT_ID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          nonce,
+		"email":          self.user.Email,
+		"email_verified": true,
+		"name":           self.user.Login,
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	key := self.key
+	if self.failure == FAIL_BAD_ID_TOKEN {
+		key = newSigningKey()
+	}
+	sum := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+	if err != nil {
+		panic(fmt.Sprintf("unable to sign: %v", err))
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+//jsonWebKey is a key of the JWKS document, as seven5 reads it.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to read the random stream: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+//pkceChallenge is the S256 code challenge of the verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func containsString(list []string, s string) bool {
+	for _, candidate := range list {
+		if candidate == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package oauthtest
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/seven5/seven5"
+)
+
+//userGen logs in every user, with their unique id as the user data.
+type userGen struct{}
+
+func (g *userGen) Generate(uniq string) (interface{}, error) {
+	return uniq, nil
+}
+
+func newSessionManager() *seven5.SimpleSessionManager {
+	os.Setenv("SERVER_SESSION_KEY", strings.Repeat("0", 32))
+	return seven5.NewSimpleSessionManager(&userGen{})
+}
+
+func TestProvider(t *testing.T) {
+	provider := NewProvider()
+	defer provider.Close()
+	sm := newSessionManager()
+	cm := seven5.NewSimpleCookieMapper("myapp")
+	pm := seven5.NewSimplePageMapper("/error", "/welcome", "/bye")
+
+	connectors := []seven5.OauthConnector{
+		provider.NewOauth2Connector("two", "http://localhost:8080"),
+		provider.NewOauth1Connector("one", "http://localhost:8080"),
+	}
+	for _, conn := range connectors {
+		h := seven5.NewOauthHandler(conn, sm, cm, pm, "/auth/"+conn.Name()+"/callback")
+
+		landing, cookies, err := provider.Login(h)
+		if err != nil {
+			t.Fatalf("%s: unable to login: %v", conn.Name(), err)
+		}
+		if landing.Path != "/welcome" {
+			t.Fatalf("%s: expected login to succeed, got %s", conn.Name(), landing)
+		}
+		var session seven5.Session
+		for _, c := range cookies {
+			if c.Name == cm.CookieName() {
+				session, _, _ = seven5.ResolveCredential(sm, &seven5.Credential{SessionId: c.Value})
+			}
+		}
+		if session == nil || session.UserData() != conn.Name()+":1234" {
+			t.Errorf("%s: expected session for user 1234, got %v", conn.Name(), session)
+		}
+
+		for _, f := range []Failure{FAIL_DENY, FAIL_BAD_CODE, FAIL_SERVER_ERROR, FAIL_BAD_USER} {
+			provider.Fail(f)
+			landing, _, err := provider.Login(h)
+			if err != nil {
+				t.Fatalf("%s: unable to login: %v", conn.Name(), err)
+			}
+			if landing.Path != "/error" {
+				t.Errorf("%s: expected failure %d to land on the error page, got %s", conn.Name(), f, landing)
+			}
+		}
+		provider.Fail(FAIL_NONE)
+	}
+}
+
+func TestOauthLoginDeclined(t *testing.T) {
+	provider := NewProvider()
+	defer provider.Close()
+	//no Generator, so Generate declines everyone
+	sm := seven5.NewDumbSessionManager()
+	cm := seven5.NewSimpleCookieMapper("myapp")
+	h := seven5.NewOauthHandler(provider.NewOauth2Connector("two", "http://localhost:8080"), sm, cm,
+		seven5.NewSimplePageMapper("/error", "/welcome", "/bye"), "/auth/two/callback")
+	landing, cookies, err := provider.Login(h)
+	if err != nil {
+		t.Fatalf("unable to login: %v", err)
+	}
+	if landing.Path != "/error" {
+		t.Errorf("expected a declined login to land on the error page, got %s", landing)
+	}
+	for _, c := range cookies {
+		if c.Name == cm.CookieName() && c.Value != "" {
+			t.Errorf("did not expect a session cookie for a declined login")
+		}
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider := NewProvider()
+	defer provider.Close()
+	sm := newSessionManager()
+	cm := seven5.NewSimpleCookieMapper("myapp")
+	pm := seven5.NewSimplePageMapper("/error", "/welcome", "/bye")
+
+	conn, err := provider.NewOIDCConnector("oidc", "http://localhost:8080")
+	if err != nil {
+		t.Fatalf("unable to discover provider: %v", err)
+	}
+	h := seven5.NewOauthHandler(conn, sm, cm, pm, "/auth/oidc/callback")
+	landing, cookies, err := provider.Login(h)
+	if err != nil {
+		t.Fatalf("unable to login: %v", err)
+	}
+	if landing.Path != "/welcome" {
+		t.Fatalf("expected login to succeed, got %s", landing)
+	}
+	var session seven5.Session
+	for _, c := range cookies {
+		if c.Name == cm.CookieName() {
+			session, _, _ = seven5.ResolveCredential(sm, &seven5.Credential{SessionId: c.Value})
+		}
+	}
+	if session == nil || session.UserData() != "oidc:1234" {
+		t.Errorf("expected session for user 1234, got %v", session)
+	}
+
+	conn.SetClaimsMapper(seven5.OIDCEmailUniqueInfo)
+	landing, cookies, err = provider.Login(h)
+	if err != nil || landing.Path != "/welcome" {
+		t.Fatalf("expected login by email to succeed, got %s (%v)", landing, err)
+	}
+	session = nil
+	for _, c := range cookies {
+		if c.Name == cm.CookieName() {
+			session, _, _ = seven5.ResolveCredential(sm, &seven5.Credential{SessionId: c.Value})
+		}
+	}
+	if session == nil || session.UserData() != "fred@example.com" {
+		t.Errorf("expected session for fred@example.com, got %v", session)
+	}
+
+	provider.Fail(FAIL_BAD_ID_TOKEN)
+	landing, _, err = provider.Login(h)
+	if err != nil {
+		t.Fatalf("unable to login: %v", err)
+	}
+	if landing.Path != "/error" {
+		t.Errorf("expected badly signed ID token to land on the error page, got %s", landing)
+	}
+}
@@ -0,0 +1,473 @@
+package seven5
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OIDC_JWKS_TTL         = time.Hour
+	OIDC_JWKS_MIN_REFRESH = time.Minute //don't refetch for unknown kids more often
+	OIDC_CLOCK_SKEW       = 2 * time.Minute
+)
+
+var (
+	BAD_ID_TOKEN = errors.New("ID token is malformed or its signature is wrong")
+)
+
+//OIDCDiscovery is the part of a provider's discovery document
+//(/.well-known/openid-configuration) that we use.
+type OIDCDiscovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	UserinfoEndpoint      string   `json:"userinfo_endpoint"`
+	JwksURI               string   `json:"jwks_uri"`
+	ScopesSupported       []string `json:"scopes_supported"`
+}
+
+//DiscoverOIDC fetches and checks the discovery document of the issuer, such as
+//"https://accounts.google.com".
+func DiscoverOIDC(client *http.Client, issuer string) (*OIDCDiscovery, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+	resp, err := client.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery for %s returned %d", issuer, resp.StatusCode)
+	}
+	var result OIDCDiscovery
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("unable to understand discovery for %s: %v", issuer, err)
+	}
+	if strings.TrimSuffix(result.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery for %s claims to be for %s", issuer, result.Issuer)
+	}
+	if result.AuthorizationEndpoint == "" || result.TokenEndpoint == "" || result.JwksURI == "" {
+		return nil, fmt.Errorf("discovery for %s is missing required endpoints", issuer)
+	}
+	return &result, nil
+}
+
+//
+// JWKS
+//
+
+//jwksCache holds the signing keys of a provider, by key id.  Keys are
+//refetched after OIDC_JWKS_TTL or when a token names a key we don't have,
+//which is how providers rotate keys.
+type jwksCache struct {
+	uri    string
+	client *http.Client
+
+	lock    sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func b64Int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+//publicKey returns the key, or nil if it is of a type we don't use.
+func (self *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch self.Kty {
+	case "RSA":
+		n, err := b64Int(self.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64Int(self.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if self.Crv != "P-256" {
+			return nil, nil
+		}
+		x, err := b64Int(self.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64Int(self.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+func (self *jwksCache) fetch() error {
+	resp, err := self.client.Get(self.uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("jwks %s returned %d", self.uri, resp.StatusCode)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			return fmt.Errorf("bad key %s in jwks: %v", k.Kid, err)
+		}
+		if pub != nil {
+			keys[k.Kid] = pub
+		}
+	}
+	self.keys = keys
+	self.fetched = time.Now()
+	return nil
+}
+
+//key returns the public key with the given id.
+func (self *jwksCache) key(kid string) (crypto.PublicKey, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	age := time.Since(self.fetched)
+	if _, ok := self.keys[kid]; self.keys == nil || age > OIDC_JWKS_TTL || (!ok && age > OIDC_JWKS_MIN_REFRESH) {
+		if err := self.fetch(); err != nil {
+			return nil, err
+		}
+	}
+	k, ok := self.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("no key %q in jwks", kid)
+	}
+	return k, nil
+}
+
+//
+// ID TOKENS
+//
+
+//OIDCClaims are the claims of a verified ID token.  Raw holds all of them,
+//including any not broken out here.
+type OIDCClaims struct {
+	Issuer        string
+	Subject       string
+	Audience      []string
+	Expires       time.Time
+	IssuedAt      time.Time
+	Nonce         string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Raw           map[string]interface{}
+}
+
+//audience claims may be a string or an array of strings
+type oidcAudience []string
+
+func (self *oidcAudience) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*self = []string{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*self = many
+	return nil
+}
+
+//verifySignature checks the signature of a compact JWS with the key.
+func verifySignature(alg string, key crypto.PublicKey, signed string, sig []byte) bool {
+	sum := sha256.Sum256([]byte(signed))
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) == nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, sum[:], r, s)
+	}
+	return false
+}
+
+//verifyIdToken checks the signature and the standard claims of an ID token.
+//Only RS256 and ES256 are accepted; in particular "none" and the HMAC
+//algorithms are refused.
+func verifyIdToken(keys *jwksCache, issuer string, clientId string, nonce string, token string) (*OIDCClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, BAD_ID_TOKEN
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(raw, &header) != nil {
+		return nil, BAD_ID_TOKEN
+	}
+	if header.Alg != "RS256" && header.Alg != "ES256" {
+		return nil, fmt.Errorf("ID token algorithm %q is not allowed", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, BAD_ID_TOKEN
+	}
+	key, err := keys.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if !verifySignature(header.Alg, key, parts[0]+"."+parts[1], sig) {
+		return nil, BAD_ID_TOKEN
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, BAD_ID_TOKEN
+	}
+	var c struct {
+		Iss           string       `json:"iss"`
+		Sub           string       `json:"sub"`
+		Aud           oidcAudience `json:"aud"`
+		Azp           string       `json:"azp"`
+		Exp           int64        `json:"exp"`
+		Iat           int64        `json:"iat"`
+		Nonce         string       `json:"nonce"`
+		Email         string       `json:"email"`
+		EmailVerified interface{}  `json:"email_verified"`
+		Name          string       `json:"name"`
+	}
+	all := make(map[string]interface{})
+	if json.Unmarshal(payload, &c) != nil || json.Unmarshal(payload, &all) != nil {
+		return nil, BAD_ID_TOKEN
+	}
+	now := time.Now()
+	switch {
+	case strings.TrimSuffix(c.Iss, "/") != strings.TrimSuffix(issuer, "/"):
+		return nil, fmt.Errorf("ID token issuer %q is not %q", c.Iss, issuer)
+	case c.Sub == "":
+		return nil, errors.New("ID token has no subject")
+	case !containsString(c.Aud, clientId):
+		return nil, errors.New("ID token is not for this client")
+	case len(c.Aud) > 1 && c.Azp != "" && c.Azp != clientId:
+		return nil, errors.New("ID token was issued to another party")
+	case time.Unix(c.Exp, 0).Before(now.Add(-OIDC_CLOCK_SKEW)):
+		return nil, errors.New("ID token has expired")
+	case time.Unix(c.Iat, 0).After(now.Add(OIDC_CLOCK_SKEW)):
+		return nil, errors.New("ID token was issued in the future")
+	case subtle.ConstantTimeCompare([]byte(c.Nonce), []byte(nonce)) != 1:
+		return nil, errors.New("ID token nonce does not match")
+	}
+	return &OIDCClaims{
+		Issuer:        c.Iss,
+		Subject:       c.Sub,
+		Audience:      c.Aud,
+		Expires:       time.Unix(c.Exp, 0),
+		IssuedAt:      time.Unix(c.Iat, 0),
+		Nonce:         c.Nonce,
+		Email:         c.Email,
+		EmailVerified: c.EmailVerified == true || c.EmailVerified == "true",
+		Name:          c.Name,
+		Raw:           all,
+	}, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, candidate := range list {
+		if candidate == s {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// CONNECTOR
+//
+
+//OIDCClaimsMapper turns the verified claims of a user into the uniqueInfo
+//given to the SessionManager (and so to the Generator).
+type OIDCClaimsMapper func(name string, claims *OIDCClaims) (string, error)
+
+//OIDCSubjectUniqueInfo is the default OIDCClaimsMapper.  It returns the name of
+//the connector and the subject, which the provider promises never changes.
+func OIDCSubjectUniqueInfo(name string, claims *OIDCClaims) (string, error) {
+	return name + ":" + claims.Subject, nil
+}
+
+//OIDCEmailUniqueInfo is an OIDCClaimsMapper that returns the user's email
+//address, refusing the login if the provider has not verified it.
+func OIDCEmailUniqueInfo(name string, claims *OIDCClaims) (string, error) {
+	if claims.Email == "" || !claims.EmailVerified {
+		return "", fmt.Errorf("%s has not verified the user's email address", name)
+	}
+	return strings.ToLower(claims.Email), nil
+}
+
+//OIDCConnector is an Oauth2Connector that also asks for, and verifies, an ID
+//token.  Each login has its own nonce, which must appear in the ID token.  It
+//implements OauthUniqueInfo from the verified claims, so it can be given
+//directly to an OauthHandler.
+type OIDCConnector struct {
+	*Oauth2Connector
+	discovery *OIDCDiscovery
+	keys      *jwksCache
+	mapper    OIDCClaimsMapper
+
+	lock   sync.Mutex
+	nonces map[string]*oidcNonce
+}
+
+type oidcNonce struct {
+	nonce   string
+	expires time.Time
+}
+
+//NewOIDCConnector discovers the provider at issuer and returns a connector for
+//it.  The other parameters are as for NewOauth2Connector.
+func NewOIDCConnector(name string, issuer string, detail OauthClientDetail, redirectHost string) (*OIDCConnector, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	d, err := DiscoverOIDC(client, issuer)
+	if err != nil {
+		return nil, err
+	}
+	ep := Oauth2Endpoints{
+		AuthURL:     d.AuthorizationEndpoint,
+		TokenURL:    d.TokenEndpoint,
+		UserInfoURL: d.UserinfoEndpoint,
+		IdField:     "sub",
+		Scopes:      []string{"openid", "email", "profile"},
+	}
+	return &OIDCConnector{
+		Oauth2Connector: NewOauth2Connector(name, ep, detail, redirectHost),
+		discovery:       d,
+		keys:            &jwksCache{uri: d.JwksURI, client: client},
+		mapper:          OIDCSubjectUniqueInfo,
+		nonces:          make(map[string]*oidcNonce),
+	}, nil
+}
+
+//SetClaimsMapper replaces the function that turns claims into uniqueInfo.
+func (self *OIDCConnector) SetClaimsMapper(m OIDCClaimsMapper) {
+	self.mapper = m
+}
+
+//Discovery returns the provider's discovery document.
+func (self *OIDCConnector) Discovery() *OIDCDiscovery {
+	return self.discovery
+}
+
+//SetHTTPClient replaces the client used to talk to the provider.
+func (self *OIDCConnector) SetHTTPClient(c *http.Client) {
+	self.Oauth2Connector.SetHTTPClient(c)
+	self.keys.lock.Lock()
+	self.keys.client = c
+	self.keys.lock.Unlock()
+}
+
+func (self *OIDCConnector) UserInteractionURL(ignored OauthCred, state string, callbackPath string) string {
+	n := &oidcNonce{nonce: randomHex(16), expires: time.Now().Add(OAUTH2_STATE_TTL)}
+	self.lock.Lock()
+	for k, v := range self.nonces {
+		if v.expires.Before(time.Now()) {
+			delete(self.nonces, k)
+		}
+	}
+	self.nonces[state] = n
+	self.lock.Unlock()
+	return self.Oauth2Connector.UserInteractionURL(ignored, state, callbackPath) + "&nonce=" + n.nonce
+}
+
+//Phase2 exchanges the code for tokens, as Oauth2Connector does, and verifies
+//the ID token.  The connection returned is an *OIDCConnection.
+func (self *OIDCConnector) Phase2(state string, code string) (OauthConnection, error) {
+	self.lock.Lock()
+	n, ok := self.nonces[state]
+	delete(self.nonces, state)
+	self.lock.Unlock()
+	if !ok || n.expires.Before(time.Now()) {
+		return nil, BAD_OAUTH_STATE
+	}
+	conn, err := self.Oauth2Connector.Phase2(state, code)
+	if err != nil {
+		return nil, err
+	}
+	oc := conn.(*Oauth2Connection)
+	if oc.Token().IdToken == "" {
+		return nil, fmt.Errorf("%s did not return an ID token", self.Name())
+	}
+	claims, err := self.VerifyIdToken(oc.Token().IdToken, n.nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &OIDCConnection{Oauth2Connection: oc, claims: claims}, nil
+}
+
+//VerifyIdToken checks the signature and claims of an ID token issued to us.
+func (self *OIDCConnector) VerifyIdToken(token string, nonce string) (*OIDCClaims, error) {
+	return verifyIdToken(self.keys, self.discovery.Issuer, self.clientId, nonce, token)
+}
+
+//UniqueInfo maps the verified claims of the connection to uniqueInfo.
+func (self *OIDCConnector) UniqueInfo(conn OauthConnection) (string, error) {
+	oc, ok := conn.(*OIDCConnection)
+	if !ok {
+		return "", fmt.Errorf("%s connection has no verified claims", self.Name())
+	}
+	return self.mapper(self.Name(), oc.Claims())
+}
+
+//OIDCConnection is an Oauth2Connection with the verified claims of the user.
+type OIDCConnection struct {
+	*Oauth2Connection
+	claims *OIDCClaims
+}
+
+//Claims returns the verified claims of the ID token.
+func (self *OIDCConnection) Claims() *OIDCClaims {
+	return self.claims
+}
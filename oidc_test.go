@@ -0,0 +1,95 @@
+package seven5
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRS256(t *testing.T, key *rsa.PrivateKey, alg string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": "rsa-1"})
+	body, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	if alg == "none" {
+		return signed + "."
+	}
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatalf("unable to sign: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCVerifyIdToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []*jsonWebKey{{
+				Kty: "RSA",
+				Kid: "rsa-1",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	defer jwks.Close()
+	keys := &jwksCache{uri: jwks.URL, client: jwks.Client()}
+
+	now := time.Now()
+	good := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":   "https://issuer.example.com",
+			"sub":   "abc",
+			"aud":   []string{"me"},
+			"exp":   now.Add(time.Hour).Unix(),
+			"iat":   now.Unix(),
+			"nonce": "n0nce",
+		}
+	}
+	claims, err := verifyIdToken(keys, "https://issuer.example.com", "me", "n0nce", testRS256(t, key, "RS256", good()))
+	if err != nil {
+		t.Fatalf("expected good token to verify: %v", err)
+	}
+	if claims.Subject != "abc" || !containsString(claims.Audience, "me") {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	bad := map[string]func(map[string]interface{}){
+		"wrong audience": func(c map[string]interface{}) { c["aud"] = "someone-else" },
+		"expired":        func(c map[string]interface{}) { c["exp"] = now.Add(-time.Hour).Unix() },
+		"wrong issuer":   func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		"wrong nonce":    func(c map[string]interface{}) { c["nonce"] = "other" },
+	}
+	for name, change := range bad {
+		c := good()
+		change(c)
+		if _, err := verifyIdToken(keys, "https://issuer.example.com", "me", "n0nce", testRS256(t, key, "RS256", c)); err == nil {
+			t.Errorf("expected token with %s to be refused", name)
+		}
+	}
+	if _, err := verifyIdToken(keys, "https://issuer.example.com", "me", "n0nce", testRS256(t, key, "none", good())); err == nil {
+		t.Errorf("expected unsigned token to be refused")
+	}
+	tampered := testRS256(t, key, "RS256", good())
+	parts := strings.Split(tampered, ".")
+	c := good()
+	c["sub"] = "root"
+	body, _ := json.Marshal(c)
+	parts[1] = base64.RawURLEncoding.EncodeToString(body)
+	if _, err := verifyIdToken(keys, "https://issuer.example.com", "me", "n0nce", strings.Join(parts, ".")); err != BAD_ID_TOKEN {
+		t.Errorf("expected tampered token to fail signature check, got %v", err)
+	}
+}
@@ -41,11 +41,18 @@ func (po PagegenOpts) readAll(path string) string {
 	return string(b)
 }
 
+//newTemplate returns a template with the Funcs and cspNonce, which writes
+//CSP_NONCE_PLACEHOLDER for use like <script nonce="{{cspNonce}}">.  The
+//placeholder is replaced by the nonce of each request when the page is served
+//by SimpleStaticFilesServer or SimpleComponentMatcher behind a SecurityHandler.
 func (po PagegenOpts) newTemplate(s string) *template.Template {
+	t := template.New(s).Funcs(template.FuncMap{
+		"cspNonce": func() string { return CSP_NONCE_PLACEHOLDER },
+	})
 	if len(po.Funcs) > 0 {
-		return template.New(s).Funcs(po.Funcs)
+		return t.Funcs(po.Funcs)
 	}
-	return template.New(s)
+	return t
 }
 
 func (po PagegenOpts) confirmDir(path string) {
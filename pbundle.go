@@ -21,6 +21,23 @@ type PBundle interface {
 	IntQueryParameter(string, int64) int64
 }
 
+//CredentialBundle is implemented by PBundles that know the credential their
+//session was found with, as the ones created by the library do.  It is
+//separate from PBundle so that other implementations of PBundle, such as
+//mocks, need not have it; use CredentialOf rather than asserting it.
+type CredentialBundle interface {
+	Credential() *Credential
+}
+
+//CredentialOf returns the credential of the bundle, or nil if there is none
+//or the bundle does not implement CredentialBundle.
+func CredentialOf(pb PBundle) *Credential {
+	if cb, ok := pb.(CredentialBundle); ok {
+		return cb.Credential()
+	}
+	return nil
+}
+
 type simplePBundle struct {
 	h      map[string]string
 	q      map[string]string
@@ -28,6 +45,7 @@ type simplePBundle struct {
 	mgr    SessionManager
 	out    map[string]string
 	parent map[reflect.Type]interface{}
+	cred   *Credential
 }
 
 //ReturnHeaders gets all the header _keys_ that should be returned the client.
@@ -86,6 +104,13 @@ func (self *simplePBundle) DestroySession() error {
 	return self.mgr.Destroy(self.s.SessionId())
 }
 
+//Credential returns the credential that was used to find the session for
+//this request, or nil if there is no session or the bundle was not created
+//from a request.
+func (self *simplePBundle) Credential() *Credential {
+	return self.cred
+}
+
 //ParentValue returns a parent resource's contribution a child resource. So, for
 //a url like /rest/foo/23/bar/98 the child resource at bar/98 can find the information
 //about the parent resource at foo/23 with ParentValue(foosWireType).
@@ -122,6 +147,13 @@ func (self *simplePBundle) IntQueryParameter(name string, def int64) int64 {
 //as the session because it must be able to update the information stored
 //about a particular sesison.
 func NewSimplePBundle(r *http.Request, s Session, mgr SessionManager) (PBundle, error) {
+	return NewSimplePBundleWithCredential(r, s, mgr, nil)
+}
+
+//NewSimplePBundleWithCredential is the same as NewSimplePBundle but also
+//records the credential that was used to find the session, so resources can
+//check things like api key scopes (see HasScope).
+func NewSimplePBundleWithCredential(r *http.Request, s Session, mgr SessionManager, cred *Credential) (PBundle, error) {
 	if err := r.ParseForm(); err != nil {
 		return nil, err
 	}
@@ -133,6 +165,7 @@ func NewSimplePBundle(r *http.Request, s Session, mgr SessionManager) (PBundle,
 		mgr:    mgr,
 		out:    make(map[string]string),
 		parent: make(map[reflect.Type]interface{}),
+		cred:   cred,
 	}, nil
 }
 
@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,6 +17,11 @@ const (
 	AUTH_OP_LOGOUT        = "logout"
 	AUTH_OP_PWD_RESET     = "pwdreset"
 	AUTH_OP_PWD_RESET_REQ = "pwdresetreq"
+	AUTH_OP_TOTP_ENROLL   = "totpenroll"
+	AUTH_OP_TOTP_CONFIRM  = "totpconfirm"
+	AUTH_OP_TOTP_VERIFY   = "totpverify"
+	AUTH_OP_SIGNUP        = "signup"
+	AUTH_OP_VERIFY        = "verify"
 )
 
 //PasswordAuthParameters is passed from client to server to request login, login
@@ -27,6 +33,26 @@ type PasswordAuthParameters struct {
 	ResetRequestUdid string
 	UserUdid         string
 	Op               string
+	Code             string
+	RecoveryCode     string
+	ResetToken       string
+	Email            string
+	VerifyToken      string
+}
+
+//PasswordAuthResult is returned to the client after a successful login when
+//the SimplePasswordHandler has a TokenCodec.  Clients that cannot keep
+//cookies should send the Token back in an "Authorization: Bearer" header.
+//Expires is in seconds since the epoch.  If SecondFactorRequired is true, the
+//password was correct but the user must still send a TOTP code (or recovery
+//code) with AUTH_OP_TOTP_VERIFY before they are logged in.  If
+//VerificationRequired is true, the account was created by AUTH_OP_SIGNUP but
+//the user must follow the link in the verification email before logging in.
+type PasswordAuthResult struct {
+	Token                string
+	Expires              int64
+	SecondFactorRequired bool
+	VerificationRequired bool
 }
 
 //Valdating session manager is one that can also check the validity of a
@@ -35,7 +61,12 @@ type PasswordAuthParameters struct {
 //login attempt and use the error for something more serious, like the database
 //cannot be reached.  If the first returned value from ValidateCredentials is
 //not "" it should be a unique id, both of the first two returned values will be
-//sent to the (nested) session manager's Assign.
+//sent to the (nested) session manager's Assign.  Implementations should store
+//passwords hashed with a PasswordHasher and use CheckPassword to verify them;
+//when CheckPassword returns an upgraded hash, ValidateCredentials must store
+//it in place of the old one, since nothing else will.
+//UseResetRequest must only succeed once for each reset request id, since it
+//is the only thing that stops a reset link being used again.
 type ValidatingSessionManager interface {
 	SessionManager
 	ValidateCredentials(username, password string) (string, interface{}, error)
@@ -48,8 +79,19 @@ type ValidatingSessionManager interface {
 //checks.  It expects to be given a SessionManager that it will work in combination
 //with.
 type SimplePasswordHandler struct {
-	vsm ValidatingSessionManager
-	cm  CookieMapper
+	vsm    ValidatingSessionManager
+	cm     CookieMapper
+	codec  TokenCodec
+	policy *PasswordPolicy
+	issuer string
+	resets *PasswordResetMailer
+
+	verifier   *VerificationMailer
+	mustVerify bool
+
+	lock      sync.Mutex
+	enrolling map[string]*pendingEnrollment
+	totpSteps map[string]int64
 }
 
 //
@@ -59,25 +101,126 @@ type SimplePasswordHandler struct {
 //
 func NewSimplePasswordHandler(vsm ValidatingSessionManager, cm CookieMapper) *SimplePasswordHandler {
 	return &SimplePasswordHandler{
-		vsm: vsm,
-		cm:  cm,
+		vsm:       vsm,
+		cm:        cm,
+		enrolling: make(map[string]*pendingEnrollment),
+		totpSteps: make(map[string]int64),
 	}
 }
 
+//
+// NewSimplePasswordHandlerWithTokens returns a password handler that, in
+// addition to setting a cookie, returns a token (see PasswordAuthResult) on
+// each successful login.  The token is created with the codec provided and
+// is accepted by MeHandler, AuthHandler (for logout) and by dispatchers
+// created with NewBaseDispatcherWithTokens using the same codec.
+//
+func NewSimplePasswordHandlerWithTokens(vsm ValidatingSessionManager, cm CookieMapper, codec TokenCodec) *SimplePasswordHandler {
+	result := NewSimplePasswordHandler(vsm, cm)
+	result.codec = codec
+	return result
+}
+
+//
+// SetPasswordPolicy sets the policy that new passwords must meet when they are
+// set with AUTH_OP_PWD_RESET or AUTH_OP_SIGNUP.  If the policy is nil, which is
+// the default, any password is accepted.
+//
+func (self *SimplePasswordHandler) SetPasswordPolicy(p *PasswordPolicy) {
+	self.policy = p
+}
+
+//
+// SetTOTPIssuer sets the name of the application shown in users' authenticator
+// apps when they enroll with AUTH_OP_TOTP_ENROLL.  The default is the host name
+// of the request.
+//
+func (self *SimplePasswordHandler) SetTOTPIssuer(issuer string) {
+	self.issuer = issuer
+}
+
+//
+// sessionId returns the session id presented by the client, first looking
+// for the cookie and then, if we have a codec, for a bearer token.  It
+// returns NO_SUCH_COOKIE if neither is present.
+//
+func (self *SimplePasswordHandler) sessionId(r *http.Request) (string, error) {
+	val, err := self.cm.Value(r)
+	if err != NO_SUCH_COOKIE || self.codec == nil {
+		return val, err
+	}
+	tok := BearerToken(r)
+	if tok == "" {
+		return "", NO_SUCH_COOKIE
+	}
+	sid, err := self.codec.Decode(tok)
+	if err != nil {
+		return "", HTTPError(http.StatusUnauthorized, err.Error())
+	}
+	return sid, nil
+}
+
 //
 // Check verifies that the username and password provided are the ones we expect
 // via a calle the ValidatingSessionManager. It returns nil,nil in the case of a
-// failed check on the password provided.
+// failed check on the password provided.  It applies the same rules as a login
+// with AuthHandler: if the user must verify their email address and has not, the
+// error is a 403, and if the user has a second factor the session returned is
+// half-authenticated (see IsPendingSecondFactor) until the client completes the
+// login with AUTH_OP_TOTP_VERIFY.
 //
 func (self *SimplePasswordHandler) Check(username, pwd string) (Session, error) {
+	session, _, err := self.authenticate(username, pwd)
+	return session, err
+}
+
+//
+// authenticate checks the username and password and returns the session of the
+// user, which is half-authenticated if the second return value is true.  It
+// returns nil,false,nil if the username or password is wrong.
+//
+func (self *SimplePasswordHandler) authenticate(username, pwd string) (Session, bool, error) {
 	uniq, userData, err := self.vsm.ValidateCredentials(username, pwd)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	if uniq == "" {
-		return nil, nil
+		return nil, false, nil
+	}
+	if self.mustVerify {
+		verified, err := self.vsm.(SignupSessionManager).IsVerified(uniq)
+		if err != nil {
+			log.Printf("[AUTH] unable to check verification of %s: %v", username, err)
+			return nil, false, err
+		}
+		if !verified {
+			log.Printf("[AUTH] user %s has not verified their email address", username)
+			return nil, false, HTTPError(http.StatusForbidden, "email address has not been verified")
+		}
+	}
+	if tf, ok := self.vsm.(TwoFactorSessionManager); ok {
+		secret, err := tf.TOTPSecret(uniq)
+		if err != nil {
+			log.Printf("[AUTH] unable to read TOTP secret for %s: %v", username, err)
+			return nil, false, err
+		}
+		if secret != "" {
+			pending := &PendingSecondFactor{UniqueId: uniq, UserData: userData}
+			session, err := self.vsm.Assign(s5PendingPrefix+uniq, pending, time.Now().Add(SECOND_FACTOR_TIMEOUT))
+			if err != nil {
+				log.Printf("[AUTH] unable to create pending session for %s: %v", username, err)
+				return nil, false, err
+			}
+			log.Printf("[AUTH] user %s needs a second factor", username)
+			return session, true, nil
+		}
 	}
-	return self.vsm.Assign(uniq, userData, time.Time{})
+	session, err := self.vsm.Assign(uniq, userData, time.Time{})
+	if err != nil {
+		return nil, false, err
+	}
+	log.Printf("[AUTH] user %s is authenticated", username)
+	return session, false, nil
 }
 
 //
@@ -87,42 +230,27 @@ func (self *SimplePasswordHandler) MeHandler(w http.ResponseWriter, r *http.Requ
 	w.Header().Add("Cache-Control", "no-cache, must-revalidate") //HTTP 1.1
 	w.Header().Add("Pragma", "no-cache")                         //HTTP 1.0
 
-	val, err := self.cm.Value(r)
+	val, err := self.sessionId(r)
 	if err != nil && err != NO_SUCH_COOKIE {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		WriteError(w, err)
 		return
 	}
 	if err != nil { //no cookie
 		http.Error(w, "no cookie", http.StatusUnauthorized)
 		return
 	}
-	sr, err := self.vsm.Find(strings.TrimSpace(val))
+	session, err := self.fullSession(strings.TrimSpace(val))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("unable to recover session: %v", err), http.StatusInternalServerError)
 		return
 	}
-	if sr == nil {
+	if session == nil {
 		http.Error(w, "no session", http.StatusUnauthorized)
 		return
 	}
-
-	if sr.Session != nil {
-		if err := self.vsm.SendUserDetails(sr.Session.UserData(), w); err != nil {
-			log.Printf("failed to send user data: %v", err)
-		}
-		return
-	}
-	i, err := self.vsm.Generate(sr.UniqueId)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("unable to recover session: %v", err), http.StatusInternalServerError)
-		return
-	}
-	recovered, err := self.vsm.Assign(sr.UniqueId, i, time.Time{})
-	if err := self.vsm.SendUserDetails(recovered.UserData(), w); err != nil {
+	if err := self.vsm.SendUserDetails(session.UserData(), w); err != nil {
 		log.Printf("failed to send user data: %v", err)
 	}
-	return
-
 }
 
 func (self *SimplePasswordHandler) AuthHandler(w http.ResponseWriter, r *http.Request) {
@@ -147,9 +275,9 @@ func (self *SimplePasswordHandler) AuthHandler(w http.ResponseWriter, r *http.Re
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	val, err := self.cm.Value(r)
+	val, err := self.sessionId(r)
 	if err != nil && err != NO_SUCH_COOKIE {
-		w.WriteHeader(http.StatusInternalServerError)
+		WriteError(w, err)
 		return
 	}
 
@@ -157,6 +285,10 @@ func (self *SimplePasswordHandler) AuthHandler(w http.ResponseWriter, r *http.Re
 	//PW RESET REQ? (Can be done without being logged in)
 	//
 	if auth.Op == AUTH_OP_PWD_RESET_REQ {
+		if self.resets != nil {
+			self.mailReset(w, &auth)
+			return
+		}
 		resetUdid, err := self.vsm.GenerateResetRequest(auth.Username)
 		if err != nil {
 			WriteError(w, err)
@@ -175,25 +307,64 @@ func (self *SimplePasswordHandler) AuthHandler(w http.ResponseWriter, r *http.Re
 	//
 	if auth.Op == AUTH_OP_PWD_RESET {
 		//UseResetRequest(userId string, requestId string, newpwd string) (bool, error) {
-
-		ok, err := self.vsm.UseResetRequest(auth.UserUdid, auth.ResetRequestUdid, auth.Password)
+		if self.policy != nil {
+			if err := self.policy.Check(auth.Password); err != nil {
+				WriteError(w, err)
+				log.Printf("[AUTH] new password for user %s refused by policy: %v", auth.UserUdid, err)
+				return
+			}
+		}
+		userUdid, resetUdid := auth.UserUdid, auth.ResetRequestUdid
+		if auth.ResetToken != "" {
+			userUdid, resetUdid, err = self.openResetToken(auth.ResetToken)
+			if err != nil {
+				WriteError(w, err)
+				log.Printf("[AUTH] unable to use reset link: %v", err)
+				return
+			}
+		}
+		ok, err := self.vsm.UseResetRequest(userUdid, resetUdid, auth.Password)
 		if err != nil {
+			if auth.ResetToken != "" {
+				self.resets.release(resetUdid)
+			}
 			WriteError(w, err)
 			log.Printf("[AUTH] error returned from UseResetRequest %v", err)
 			return
 		}
 		if !ok {
 			w.WriteHeader(http.StatusUnauthorized)
-			log.Printf("[AUTH] UseResetRequest refused to update password: %s", auth.ResetRequestUdid)
+			log.Printf("[AUTH] UseResetRequest refused to update password: %s", resetUdid)
 			return
 		}
 		log.Printf("[AUTH] reset password for user %s with token %s",
-			auth.UserUdid, auth.ResetRequestUdid)
+			userUdid, resetUdid)
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("{}")) //need to prevent the client-side dying
 		return
 	}
 
+	//
+	//SIGNUP OR SECOND FACTOR?
+	//
+	switch auth.Op {
+	case AUTH_OP_SIGNUP:
+		self.signup(w, &auth)
+		return
+	case AUTH_OP_VERIFY:
+		self.verify(w, &auth)
+		return
+	case AUTH_OP_TOTP_VERIFY:
+		self.verifySecondFactor(w, &auth, val)
+		return
+	case AUTH_OP_TOTP_ENROLL:
+		self.enrollTOTP(w, r, &auth, val)
+		return
+	case AUTH_OP_TOTP_CONFIRM:
+		self.confirmTOTP(w, &auth, val)
+		return
+	}
+
 	//
 	//LOGOUT?
 	//
@@ -212,8 +383,20 @@ func (self *SimplePasswordHandler) AuthHandler(w http.ResponseWriter, r *http.Re
 	//
 	// MUST BE LOGIN
 	//
-	session, err := self.Check(auth.Username, auth.Password)
+	self.login(w, &auth)
+}
+
+//
+// login checks the username and password and, if they are correct and the
+// user does not need a second factor, logs them in.
+//
+func (self *SimplePasswordHandler) login(w http.ResponseWriter, auth *PasswordAuthParameters) {
+	session, secondFactor, err := self.authenticate(auth.Username, auth.Password)
 	if err != nil {
+		if e, ok := err.(*Error); ok {
+			http.Error(w, e.Msg, e.StatusCode)
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -221,8 +404,36 @@ func (self *SimplePasswordHandler) AuthHandler(w http.ResponseWriter, r *http.Re
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-	log.Printf("[AUTH] user %s is authenticated", auth.Username)
+	self.sendLoginResult(w, auth.Username, session, secondFactor)
+}
+
+//
+// sendLoginResult sets the cookie for session and, if we have a codec, sends
+// the client a token for it.
+//
+func (self *SimplePasswordHandler) sendLoginResult(w http.ResponseWriter, username string, session Session, secondFactor bool) {
 	self.cm.AssociateCookie(w, session)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("{}")) //need to prevent the client-side dying
+	if self.codec == nil {
+		if secondFactor {
+			SendJson(w, &PasswordAuthResult{SecondFactorRequired: true})
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("{}")) //need to prevent the client-side dying
+		return
+	}
+	var expires time.Time
+	if es, ok := session.(ExpiringSession); ok {
+		expires = es.Expires()
+	}
+	if expires.IsZero() {
+		expires = time.Now().Add(24 * time.Hour)
+	}
+	tok, err := self.codec.Encode(session.SessionId(), expires)
+	if err != nil {
+		log.Printf("[AUTH] unable to create token for %s: %v", username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	SendJson(w, &PasswordAuthResult{Token: tok, Expires: expires.Unix(), SecondFactorRequired: secondFactor})
 }
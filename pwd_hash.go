@@ -0,0 +1,341 @@
+package seven5
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	UNKNOWN_HASH = errors.New("Password hash is not in a format we understand")
+)
+
+//limits on the parameters of stored hashes, so that a corrupt or hostile
+//hash cannot make Verify panic or use unbounded memory and time
+const (
+	ARGON2_MAX_MEMORY = 4 * 1024 * 1024 //in KiB, 4GiB
+	ARGON2_MAX_TIME   = 64
+	SCRYPT_MAX_LOGN   = 24
+)
+
+//PasswordHasher turns passwords into encoded hashes suitable for storing in
+//a database and checks passwords against them.  The encoded form includes the
+//algorithm and its parameters, so that parameters can be raised over time and
+//old hashes upgraded as users log in (see CheckPassword).  Recognizes returns
+//true if the encoded hash was produced by this algorithm, whatever its
+//parameters.  NeedsRehash returns true if the encoded hash was produced by
+//this algorithm with parameters different from our current ones.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password, encoded string) (bool, error)
+	Recognizes(encoded string) bool
+	NeedsRehash(encoded string) bool
+}
+
+func randomSalt(n int) ([]byte, error) {
+	salt := make([]byte, n)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+//
+// BCRYPT
+//
+
+//BcryptHasher hashes passwords with bcrypt.  The encoded form is the usual
+//$2a$cost$... string.  Note that bcrypt ignores anything after the first 72
+//bytes of a password.
+type BcryptHasher struct {
+	Cost int
+}
+
+//NewBcryptHasher returns a PasswordHasher using bcrypt with the given cost.
+//If cost is 0, bcrypt.DefaultCost is used.
+func NewBcryptHasher(cost int) *BcryptHasher {
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	return &BcryptHasher{Cost: cost}
+}
+
+func (self *BcryptHasher) Hash(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), self.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (self *BcryptHasher) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (self *BcryptHasher) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (self *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != self.Cost
+}
+
+//
+// ARGON2ID
+//
+
+//Argon2idHasher hashes passwords with argon2id.  The encoded form is
+//$argon2id$v=19$m=<KiB>,t=<time>,p=<threads>$<salt>$<hash> with the salt
+//and hash in unpadded base64.
+type Argon2idHasher struct {
+	Memory  uint32 //in KiB
+	Time    uint32
+	Threads uint8
+	KeyLen  uint32
+	SaltLen int
+}
+
+//NewArgon2idHasher returns a PasswordHasher using argon2id with the
+//parameters recommended by the argon2 package (64MiB of memory, one
+//pass, four threads).
+func NewArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{Memory: 64 * 1024, Time: 1, Threads: 4, KeyLen: 32, SaltLen: 16}
+}
+
+func (self *Argon2idHasher) Hash(password string) (string, error) {
+	salt, err := randomSalt(self.SaltLen)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, self.Time, self.Memory, self.Threads, self.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, self.Memory, self.Time, self.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+//decode returns the parameters, salt and key of an encoded argon2id hash.
+func (self *Argon2idHasher) decode(encoded string) (*Argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, UNKNOWN_HASH
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, UNKNOWN_HASH
+	}
+	p := &Argon2idHasher{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return nil, nil, nil, UNKNOWN_HASH
+	}
+	if p.Time < 1 || p.Time > ARGON2_MAX_TIME || p.Threads < 1 || p.Memory < 8*uint32(p.Threads) || p.Memory > ARGON2_MAX_MEMORY {
+		return nil, nil, nil, UNKNOWN_HASH
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, UNKNOWN_HASH
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, UNKNOWN_HASH
+	}
+	p.SaltLen = len(salt)
+	p.KeyLen = uint32(len(key))
+	return p, salt, key, nil
+}
+
+func (self *Argon2idHasher) Verify(password, encoded string) (bool, error) {
+	p, salt, key, err := self.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (self *Argon2idHasher) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (self *Argon2idHasher) NeedsRehash(encoded string) bool {
+	p, _, _, err := self.decode(encoded)
+	if err != nil {
+		return true
+	}
+	return *p != *self
+}
+
+//
+// SCRYPT
+//
+
+//ScryptHasher hashes passwords with scrypt.  The encoded form is
+//$scrypt$ln=<log2 N>,r=<r>,p=<p>$<salt>$<hash> with the salt and hash in
+//unpadded base64.
+type ScryptHasher struct {
+	LogN    uint
+	R       int
+	P       int
+	KeyLen  int
+	SaltLen int
+}
+
+//NewScryptHasher returns a PasswordHasher using scrypt with the parameters
+//recommended by the scrypt package for interactive logins (N=32768, r=8, p=1).
+func NewScryptHasher() *ScryptHasher {
+	return &ScryptHasher{LogN: 15, R: 8, P: 1, KeyLen: 32, SaltLen: 16}
+}
+
+func (self *ScryptHasher) Hash(password string) (string, error) {
+	salt, err := randomSalt(self.SaltLen)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<self.LogN, self.R, self.P, self.KeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", self.LogN, self.R, self.P,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+//decode returns the parameters, salt and key of an encoded scrypt hash.
+func (self *ScryptHasher) decode(encoded string) (*ScryptHasher, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 || parts[1] != "scrypt" {
+		return nil, nil, nil, UNKNOWN_HASH
+	}
+	p := &ScryptHasher{}
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &p.LogN, &p.R, &p.P); err != nil {
+		return nil, nil, nil, UNKNOWN_HASH
+	}
+	if p.LogN < 1 || p.LogN > SCRYPT_MAX_LOGN || p.R < 1 || p.P < 1 || p.R*p.P >= 1<<30 {
+		return nil, nil, nil, UNKNOWN_HASH
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, nil, nil, UNKNOWN_HASH
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, UNKNOWN_HASH
+	}
+	p.SaltLen = len(salt)
+	p.KeyLen = len(key)
+	return p, salt, key, nil
+}
+
+func (self *ScryptHasher) Verify(password, encoded string) (bool, error) {
+	p, salt, key, err := self.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other, err := scrypt.Key([]byte(password), salt, 1<<p.LogN, p.R, p.P, p.KeyLen)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (self *ScryptHasher) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$scrypt$")
+}
+
+func (self *ScryptHasher) NeedsRehash(encoded string) bool {
+	p, _, _, err := self.decode(encoded)
+	if err != nil {
+		return true
+	}
+	return *p != *self
+}
+
+//
+// UPGRADING
+//
+
+//UpgradingHasher is a PasswordHasher that hashes new passwords with a
+//preferred hasher but can still verify hashes made by older ones.  Any hash
+//not made by the preferred hasher with its current parameters needs a rehash.
+type UpgradingHasher struct {
+	preferred PasswordHasher
+	legacy    []PasswordHasher
+}
+
+//NewUpgradingHasher returns a PasswordHasher that uses preferred for new
+//hashes and also understands the hashes of the legacy hashers.
+func NewUpgradingHasher(preferred PasswordHasher, legacy ...PasswordHasher) *UpgradingHasher {
+	return &UpgradingHasher{preferred: preferred, legacy: legacy}
+}
+
+func (self *UpgradingHasher) Hash(password string) (string, error) {
+	return self.preferred.Hash(password)
+}
+
+func (self *UpgradingHasher) find(encoded string) PasswordHasher {
+	if self.preferred.Recognizes(encoded) {
+		return self.preferred
+	}
+	for _, h := range self.legacy {
+		if h.Recognizes(encoded) {
+			return h
+		}
+	}
+	return nil
+}
+
+func (self *UpgradingHasher) Verify(password, encoded string) (bool, error) {
+	h := self.find(encoded)
+	if h == nil {
+		return false, UNKNOWN_HASH
+	}
+	return h.Verify(password, encoded)
+}
+
+func (self *UpgradingHasher) Recognizes(encoded string) bool {
+	return self.find(encoded) != nil
+}
+
+func (self *UpgradingHasher) NeedsRehash(encoded string) bool {
+	return !self.preferred.Recognizes(encoded) || self.preferred.NeedsRehash(encoded)
+}
+
+//DefaultPasswordHasher returns the PasswordHasher most applications should
+//use: argon2id for new hashes, with bcrypt and scrypt hashes still understood.
+func DefaultPasswordHasher() PasswordHasher {
+	return NewUpgradingHasher(NewArgon2idHasher(), NewBcryptHasher(0), NewScryptHasher())
+}
+
+//CheckPassword is intended to be called from the ValidateCredentials method of
+//a ValidatingSessionManager.  It returns true if password matches encoded.  If
+//it matches and the hash should be upgraded, the second return value is a new
+//encoded hash of the same password that should be stored in place of the old
+//one; otherwise it is "".  Nothing stores it for you: SimplePasswordHandler
+//never sees the hash, so the ValidateCredentials that calls CheckPassword
+//must save the new hash itself, or the upgrade never happens.
+func CheckPassword(h PasswordHasher, password, encoded string) (bool, string, error) {
+	ok, err := h.Verify(password, encoded)
+	if err != nil || !ok {
+		return false, "", err
+	}
+	if !h.NeedsRehash(encoded) {
+		return true, "", nil
+	}
+	upgraded, err := h.Hash(password)
+	if err != nil {
+		return true, "", err
+	}
+	return true, upgraded, nil
+}
@@ -0,0 +1,112 @@
+package seven5
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+//these are deliberately weak parameters so the tests run quickly
+func testHashers() []PasswordHasher {
+	return []PasswordHasher{
+		NewBcryptHasher(bcrypt.MinCost),
+		&Argon2idHasher{Memory: 1024, Time: 1, Threads: 1, KeyLen: 32, SaltLen: 16},
+		&ScryptHasher{LogN: 4, R: 8, P: 1, KeyLen: 32, SaltLen: 16},
+	}
+}
+
+func TestPasswordHashers(t *testing.T) {
+	for _, h := range testHashers() {
+		encoded, err := h.Hash("correct horse")
+		if err != nil {
+			t.Fatalf("%T: unable to hash: %v", h, err)
+		}
+		if !h.Recognizes(encoded) {
+			t.Errorf("%T: does not recognize its own hash %s", h, encoded)
+		}
+		if h.NeedsRehash(encoded) {
+			t.Errorf("%T: wants to rehash its own hash %s", h, encoded)
+		}
+		ok, err := h.Verify("correct horse", encoded)
+		if err != nil || !ok {
+			t.Errorf("%T: failed to verify correct password (%v)", h, err)
+		}
+		ok, err = h.Verify("battery staple", encoded)
+		if err != nil || ok {
+			t.Errorf("%T: verified incorrect password (%v)", h, err)
+		}
+	}
+}
+
+func TestPasswordUpgrade(t *testing.T) {
+	hashers := testHashers()
+	old, _ := hashers[0].Hash("correct horse")
+	h := NewUpgradingHasher(hashers[1], hashers[0], hashers[2])
+
+	ok, upgraded, err := CheckPassword(h, "correct horse", old)
+	if err != nil || !ok {
+		t.Fatalf("failed to verify legacy hash (%v)", err)
+	}
+	if !hashers[1].Recognizes(upgraded) {
+		t.Errorf("expected the legacy hash to be upgraded, got %q", upgraded)
+	}
+	ok, again, err := CheckPassword(h, "correct horse", upgraded)
+	if err != nil || !ok || again != "" {
+		t.Errorf("did not expect to upgrade a current hash (%v,%q,%v)", ok, again, err)
+	}
+
+	stronger := NewUpgradingHasher(&Argon2idHasher{Memory: 2048, Time: 1, Threads: 1, KeyLen: 32, SaltLen: 16})
+	if !stronger.NeedsRehash(upgraded) {
+		t.Errorf("expected a hash with old parameters to need a rehash")
+	}
+	if _, err := stronger.Verify("correct horse", "plaintext"); err != UNKNOWN_HASH {
+		t.Errorf("expected unknown hash format to be an error, got %v", err)
+	}
+}
+
+func TestPasswordHashBadParameters(t *testing.T) {
+	h := DefaultPasswordHasher()
+	for _, bad := range []string{
+		"$argon2id$v=19$m=1024,t=0,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=0$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+		"$argon2id$v=19$m=0,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+		"$argon2id$v=19$m=4294967295,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$",
+		"$scrypt$ln=0,r=8,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+		"$scrypt$ln=60,r=8,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+		"$scrypt$ln=4,r=0,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+	} {
+		if ok, err := h.Verify("correct horse", bad); ok || err != UNKNOWN_HASH {
+			t.Errorf("expected %s to be an unknown hash but got %v, %v", bad, ok, err)
+		}
+		if !h.NeedsRehash(bad) {
+			t.Errorf("expected %s to need a rehash", bad)
+		}
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	f, err := ioutil.TempFile("", "breach")
+	if err != nil {
+		t.Fatalf("unable to create breach list: %v", err)
+	}
+	defer os.Remove(f.Name())
+	//second line is sha1("password1") in the haveibeenpwned format
+	f.WriteString("letmein123\nE38AD214943DAAD1D64C102FAEC29DE4AFE9DA3D:2413945\n\n")
+	f.Close()
+
+	p := DefaultPasswordPolicy()
+	if err := p.LoadBreachList(f.Name()); err != nil {
+		t.Fatalf("unable to load breach list: %v", err)
+	}
+	for _, bad := range []string{"short", "letmein123", "password1"} {
+		if err := p.Check(bad); err == nil {
+			t.Errorf("expected %s to be refused", bad)
+		}
+	}
+	if err := p.Check("a perfectly fine passphrase"); err != nil {
+		t.Errorf("expected good password to be accepted: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package seven5
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+//PasswordPolicy decides if a new password is acceptable.  Lengths are counted
+//in characters, not bytes; a MaxLength of 0 means no maximum.  The breach list
+//is a set of passwords known to have been leaked, which users may not choose.
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	breached  map[string]bool
+}
+
+//NewPasswordPolicy returns a policy with the given length limits and an empty
+//breach list.
+func NewPasswordPolicy(minLength, maxLength int) *PasswordPolicy {
+	return &PasswordPolicy{
+		MinLength: minLength,
+		MaxLength: maxLength,
+		breached:  make(map[string]bool),
+	}
+}
+
+//DefaultPasswordPolicy returns a policy requiring between 8 and 128 characters,
+//with an empty breach list.
+func DefaultPasswordPolicy() *PasswordPolicy {
+	return NewPasswordPolicy(8, 128)
+}
+
+func breachKey(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+//LoadBreachList adds the passwords in the file at path to the breach list.
+//Each line of the file is either a password in the clear or, as in the files
+//distributed by haveibeenpwned.com, the SHA-1 of a password in hex optionally
+//followed by a colon and a count.  Blank lines are ignored.  Only the SHA-1
+//of each password is kept in memory.
+func (self *PasswordPolicy) LoadBreachList(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		candidate := line
+		if i := strings.Index(line, ":"); i == 40 {
+			candidate = line[:i]
+		}
+		if _, err := hex.DecodeString(candidate); err == nil && len(candidate) == 40 {
+			self.breached[strings.ToUpper(candidate)] = true
+			continue
+		}
+		self.breached[breachKey(line)] = true
+	}
+	return scanner.Err()
+}
+
+//AddBreached adds passwords to the breach list.
+func (self *PasswordPolicy) AddBreached(passwords ...string) {
+	for _, p := range passwords {
+		self.breached[breachKey(p)] = true
+	}
+}
+
+//Check returns nil if the password is acceptable, otherwise an error (with
+//status code 400) explaining why not that is suitable to show to the user.
+func (self *PasswordPolicy) Check(password string) error {
+	l := utf8.RuneCountInString(password)
+	if l < self.MinLength {
+		return HTTPError(http.StatusBadRequest, fmt.Sprintf("password must be at least %d characters", self.MinLength))
+	}
+	if self.MaxLength > 0 && l > self.MaxLength {
+		return HTTPError(http.StatusBadRequest, fmt.Sprintf("password must be at most %d characters", self.MaxLength))
+	}
+	if self.breached[breachKey(password)] {
+		return HTTPError(http.StatusBadRequest, "password has appeared in a data breach, please choose another")
+	}
+	return nil
+}
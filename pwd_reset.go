@@ -0,0 +1,265 @@
+package seven5
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PASSWORD_RESET_TTL = time.Hour
+
+	s5ResetPrefix = "reset:"
+
+	DEFAULT_RESET_SUBJECT = "Reset your password"
+	DEFAULT_RESET_BODY    = `Someone, hopefully you, asked to reset the password for {{.Username}}.
+
+To choose a new password, follow this link before {{.Expires.Format "Jan 2 15:04 MST"}}:
+
+{{.Link}}
+
+If you did not ask to reset your password, you can ignore this message.
+`
+)
+
+//MailingSessionManager is an optional extension of ValidatingSessionManager
+//that is needed by SimplePasswordHandler to send email to users.  EmailAddress
+//returns the unique id (as passed to UseResetRequest) and the email address of
+//the user with the given username.  It should return "" as the address, and
+//no error, if there is no such user.
+type MailingSessionManager interface {
+	ValidatingSessionManager
+	EmailAddress(username string) (uniq string, address string, err error)
+}
+
+//PasswordResetMail is the data available to the templates of the reset email.
+type PasswordResetMail struct {
+	Username string
+	Link     string
+	Expires  time.Time
+}
+
+//PasswordResetMailer sends the email for AUTH_OP_PWD_RESET_REQ.  The email
+//contains a link to the reset landing page (see NewPasswordResetComponent)
+//with a signed token that holds the user's unique id and the reset request id,
+//so the client only has to send the token and the new password back with
+//AUTH_OP_PWD_RESET.  Tokens expire after PASSWORD_RESET_TTL.  Single use of
+//a token must be enforced by the store: UseResetRequest must consume the
+//reset request id, so that it fails the second time.  The mailer also
+//remembers the ids it has seen used, but only in memory, so that is a best
+//effort extra that a restart or another instance of the application does
+//not share.
+type PasswordResetMailer struct {
+	mailer   Mailer
+	codec    TokenCodec
+	from     string
+	linkBase string
+	tmpl     *mailTemplate
+
+	lock sync.Mutex
+	used map[string]time.Time
+}
+
+//NewPasswordResetMailer returns a PasswordResetMailer that sends mail from the
+//given address with links to linkBase, such as "https://example.com/reset".
+//The codec signs the tokens; it is best to use a different key from the one
+//used for bearer tokens.
+func NewPasswordResetMailer(m Mailer, codec TokenCodec, from string, linkBase string) *PasswordResetMailer {
+	result := &PasswordResetMailer{
+		mailer:   m,
+		codec:    codec,
+		from:     from,
+		linkBase: linkBase,
+		used:     make(map[string]time.Time),
+	}
+	if err := result.SetTemplates(DEFAULT_RESET_SUBJECT, DEFAULT_RESET_BODY); err != nil {
+		panic(fmt.Sprintf("default reset templates are broken: %v", err))
+	}
+	return result
+}
+
+//SetTemplates replaces the subject and body of the reset email.  Both are
+//text/templates executed with a PasswordResetMail.
+func (self *PasswordResetMailer) SetTemplates(subject string, body string) error {
+	t, err := newMailTemplate(subject, body)
+	if err != nil {
+		return err
+	}
+	self.tmpl = t
+	return nil
+}
+
+//Link returns the link sent to the user for the given reset request.
+func (self *PasswordResetMailer) Link(uniq string, resetId string, expires time.Time) (string, error) {
+	return signedLink(self.codec, self.linkBase, s5ResetPrefix+uniq+"\n"+resetId, expires)
+}
+
+//Send mails the reset link for the user to the address provided.
+func (self *PasswordResetMailer) Send(address string, username string, uniq string, resetId string) error {
+	expires := time.Now().Add(PASSWORD_RESET_TTL)
+	link, err := self.Link(uniq, resetId, expires)
+	if err != nil {
+		return err
+	}
+	msg, err := self.tmpl.message(self.from, address, &PasswordResetMail{Username: username, Link: link, Expires: expires})
+	if err != nil {
+		return err
+	}
+	return self.mailer.Send(msg)
+}
+
+//Open checks the token from a reset link and returns the unique id and reset
+//request id inside it.  It does not check if the token was already used.
+func (self *PasswordResetMailer) Open(token string) (string, string, error) {
+	raw, err := self.codec.Decode(token)
+	if err != nil {
+		return "", "", err
+	}
+	nl := strings.LastIndex(raw, "\n")
+	if !strings.HasPrefix(raw, s5ResetPrefix) || nl < 0 {
+		return "", "", BAD_TOKEN
+	}
+	return raw[len(s5ResetPrefix):nl], raw[nl+1:], nil
+}
+
+//Valid returns true if the token can still be used to reset a password, as
+//far as this process knows; only UseResetRequest knows for sure.
+func (self *PasswordResetMailer) Valid(token string) bool {
+	_, resetId, err := self.Open(token)
+	if err != nil {
+		return false
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, used := self.used[resetId]
+	return !used
+}
+
+//claim marks the reset request as used, returning false if it already was.
+func (self *PasswordResetMailer) claim(resetId string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := time.Now()
+	for k, until := range self.used {
+		if until.Before(now) {
+			delete(self.used, k)
+		}
+	}
+	if _, used := self.used[resetId]; used {
+		return false
+	}
+	//no token for this id can outlive this
+	self.used[resetId] = now.Add(PASSWORD_RESET_TTL)
+	return true
+}
+
+//release undoes claim when the reset could not be completed.
+func (self *PasswordResetMailer) release(resetId string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.used, resetId)
+}
+
+//
+// SetResetMailer makes AUTH_OP_PWD_RESET_REQ email the user a reset link,
+// rather than just generating the reset request.  The ValidatingSessionManager
+// must also be a MailingSessionManager, otherwise this panics.
+//
+func (self *SimplePasswordHandler) SetResetMailer(rm *PasswordResetMailer) {
+	if _, ok := self.vsm.(MailingSessionManager); !ok && rm != nil {
+		panic("SetResetMailer requires a MailingSessionManager")
+	}
+	self.resets = rm
+}
+
+//mailReset handles AUTH_OP_PWD_RESET_REQ when there is a reset mailer.  The
+//response is the same whether or not the user exists, so this cannot be used
+//to discover accounts.
+func (self *SimplePasswordHandler) mailReset(w http.ResponseWriter, auth *PasswordAuthParameters) {
+	uniq, address, err := self.vsm.(MailingSessionManager).EmailAddress(auth.Username)
+	if err != nil {
+		log.Printf("[AUTH] error returned from EmailAddress %v", err)
+		WriteError(w, err)
+		return
+	}
+	if address == "" {
+		log.Printf("[AUTH] password reset requested for unknown user %s", auth.Username)
+	} else {
+		resetUdid, err := self.vsm.GenerateResetRequest(auth.Username)
+		if err != nil {
+			log.Printf("[AUTH] error returned from GenerateResetRequest %v", err)
+			WriteError(w, err)
+			return
+		}
+		if err := self.resets.Send(address, auth.Username, uniq, resetUdid); err != nil {
+			log.Printf("[AUTH] unable to mail password reset to user %s: %v", auth.Username, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[AUTH] mailed password reset to user %s", auth.Username)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{}")) //need to prevent the client-side dying
+}
+
+//openResetToken returns the unique id and reset request id in the token of a
+//reset link, and claims the reset request.
+func (self *SimplePasswordHandler) openResetToken(token string) (string, string, error) {
+	if self.resets == nil {
+		return "", "", HTTPError(http.StatusBadRequest, "reset links are not supported")
+	}
+	uniq, resetId, err := self.resets.Open(token)
+	if err != nil {
+		return "", "", HTTPError(http.StatusUnauthorized, "reset link is invalid or has expired")
+	}
+	if !self.resets.claim(resetId) {
+		return "", "", HTTPError(http.StatusUnauthorized, "reset link has already been used")
+	}
+	return uniq, resetId, nil
+}
+
+//
+// RESET LANDING PAGE
+//
+
+//PasswordResetComponent is the StaticComponent for the page that reset links
+//point to.  A request for /prefix?t=<token> serves /prefix/index.html if the
+//token can still be used and /prefix/expired.html if not.  The index page
+//should ask for a new password and send it, along with the token from the
+//url, as the ResetToken of an AUTH_OP_PWD_RESET.
+type PasswordResetComponent struct {
+	prefix string
+	resets *PasswordResetMailer
+}
+
+//NewPasswordResetComponent returns the landing page for reset links, which
+//should match the linkBase given to NewPasswordResetMailer.
+func NewPasswordResetComponent(prefix string, rm *PasswordResetMailer) *PasswordResetComponent {
+	return &PasswordResetComponent{prefix: prefix, resets: rm}
+}
+
+func (self *PasswordResetComponent) Page(pb PBundle, path []string, trailingSlash bool) ComponentResult {
+	if len(path) == 0 || (len(path) == 1 && path[0] == "index.html") {
+		page := "expired.html"
+		if tok, ok := pb.Query("t"); ok && self.resets.Valid(tok) {
+			page = "index.html"
+		}
+		return ComponentResult{
+			Path:   "/" + self.prefix + "/" + page,
+			Status: http.StatusOK,
+		}
+	}
+	//just try to serve up the content
+	return ComponentResult{
+		Status:           CONTINUE,
+		ContinueAt:       self.prefix,
+		ContinueConsumed: 1,
+	}
+}
+
+func (self *PasswordResetComponent) UrlPrefix() string {
+	return self.prefix
+}
@@ -0,0 +1,84 @@
+package seven5
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+type testMailing struct {
+	*testTwoFactor
+	password string
+	resets   map[string]string
+}
+
+func (self *testMailing) EmailAddress(username string) (string, string, error) {
+	if username != "fred" {
+		return "", "", nil
+	}
+	return "uniq-fred", "fred@example.com", nil
+}
+func (self *testMailing) GenerateResetRequest(username string) (string, error) {
+	id := randomHex(8)
+	self.resets[id] = "uniq-fred"
+	return id, nil
+}
+
+//deliberately does not consume the request, the mailer must do that
+func (self *testMailing) UseResetRequest(uniq, resetId, pwd string) (bool, error) {
+	if self.resets[resetId] != uniq {
+		return false, nil
+	}
+	self.password = pwd
+	return true, nil
+}
+
+func TestPasswordResetMail(t *testing.T) {
+	sm := NewDumbSessionManager()
+	vsm := &testMailing{testTwoFactor: &testTwoFactor{SimpleSessionManager: sm}, resets: make(map[string]string)}
+	outbox := NewOutboxMailer("")
+	rm := NewPasswordResetMailer(outbox, NewSimpleTokenCodec([]byte("reset key")), "noreply@example.com", "https://example.com/reset")
+	h := NewSimplePasswordHandler(vsm, NewSimpleCookieMapper("myapp"))
+	h.SetResetMailer(rm)
+
+	w := authRequest(t, h, nil, &PasswordAuthParameters{Op: AUTH_OP_PWD_RESET_REQ, Username: "barney"})
+	if w.Code != http.StatusOK || outbox.Last() != nil {
+		t.Fatalf("expected unknown user to get no mail but the same response, got %d", w.Code)
+	}
+	w = authRequest(t, h, nil, &PasswordAuthParameters{Op: AUTH_OP_PWD_RESET_REQ, Username: "fred"})
+	msg := outbox.Last()
+	if w.Code != http.StatusOK || msg == nil || msg.To[0] != "fred@example.com" {
+		t.Fatalf("expected reset mail to fred (%d): %+v", w.Code, msg)
+	}
+	link := regexp.MustCompile(`https://example.com/reset\?t=\S+`).FindString(msg.Text)
+	u, err := url.Parse(link)
+	if err != nil || link == "" {
+		t.Fatalf("no reset link in mail: %s", msg.Text)
+	}
+	token := u.Query().Get("t")
+
+	landing := NewPasswordResetComponent("reset", rm)
+	r, _ := http.NewRequest("GET", link, nil)
+	pb, _ := NewSimplePBundle(r, nil, sm)
+	if result := landing.Page(pb, nil, false); result.Path != "/reset/index.html" {
+		t.Errorf("expected landing page, got %+v", result)
+	}
+
+	w = authRequest(t, h, nil, &PasswordAuthParameters{Op: AUTH_OP_PWD_RESET, ResetToken: token[:len(token)-2], Password: "new password"})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected tampered token to be refused, got %d", w.Code)
+	}
+	w = authRequest(t, h, nil, &PasswordAuthParameters{Op: AUTH_OP_PWD_RESET, ResetToken: token, Password: "new password"})
+	if w.Code != http.StatusOK || vsm.password != "new password" {
+		t.Fatalf("expected reset to succeed, got %d", w.Code)
+	}
+	w = authRequest(t, h, nil, &PasswordAuthParameters{Op: AUTH_OP_PWD_RESET, ResetToken: token, Password: "another one"})
+	if w.Code != http.StatusUnauthorized || vsm.password != "new password" {
+		t.Errorf("expected reset link to work only once, got %d", w.Code)
+	}
+	if result := landing.Page(pb, nil, false); !strings.HasSuffix(result.Path, "expired.html") {
+		t.Errorf("expected used link to land on the expired page, got %+v", result)
+	}
+}
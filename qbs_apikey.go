@@ -0,0 +1,112 @@
+package seven5
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+//QbsApiKeyStore is an ApiKeyStore that keeps keys in the database, in the
+//table api_key.  The table can be created with CreateTable or by a migration
+//with the same columns as the ApiKey struct.
+type QbsApiKeyStore struct {
+	store *QbsStore
+}
+
+//NewQbsApiKeyStore returns an ApiKeyStore that uses the database of the
+//QbsStore provided.
+func NewQbsApiKeyStore(store *QbsStore) *QbsApiKeyStore {
+	return &QbsApiKeyStore{store: store}
+}
+
+//withQbs runs fn with a qbs object that is released afterwards.  There is no
+//transaction because each operation is a single statement or nearly so.
+func (self *QbsApiKeyStore) withQbs(fn func(*qbs.Qbs) error) error {
+	q, err := self.store.Qbs()
+	if err != nil {
+		return err
+	}
+	defer self.store.Release(q)
+	return fn(q)
+}
+
+//CreateTable creates the api_key table if it does not exist.  Most applications
+//will prefer to do this in a migration.
+func (self *QbsApiKeyStore) CreateTable() error {
+	return self.store.CreateTables(&ApiKey{})
+}
+
+//CreateKey saves a new key and sets its Id.
+func (self *QbsApiKeyStore) CreateKey(k *ApiKey) error {
+	return self.withQbs(func(q *qbs.Qbs) error {
+		_, err := q.Save(k)
+		return err
+	})
+}
+
+//FindKeyByPrefix returns the key with the given prefix, or nil if there is none.
+func (self *QbsApiKeyStore) FindKeyByPrefix(prefix string) (*ApiKey, error) {
+	var result *ApiKey
+	err := self.withQbs(func(q *qbs.Qbs) error {
+		k := &ApiKey{}
+		err := q.WhereEqual("prefix", prefix).Find(k)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		result = k
+		return nil
+	})
+	return result, err
+}
+
+//ListKeys returns all the keys belonging to owner, ordered by id.
+func (self *QbsApiKeyStore) ListKeys(owner string) ([]*ApiKey, error) {
+	var result []*ApiKey
+	err := self.withQbs(func(q *qbs.Qbs) error {
+		return q.WhereEqual("owner", owner).OrderBy("id").FindAll(&result)
+	})
+	if result == nil {
+		result = []*ApiKey{}
+	}
+	return result, err
+}
+
+//RevokeKey marks the key as revoked, if it belongs to owner.
+func (self *QbsApiKeyStore) RevokeKey(owner string, id int64) (bool, error) {
+	found := false
+	err := self.withQbs(func(q *qbs.Qbs) error {
+		k := &ApiKey{Id: id}
+		err := q.Find(k)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if k.Owner != owner {
+			return nil
+		}
+		k.Revoked = true
+		found = true
+		_, err = q.Save(k)
+		return err
+	})
+	return found, err
+}
+
+//TouchKey records the last time a key was used.
+func (self *QbsApiKeyStore) TouchKey(id int64, t time.Time) error {
+	return self.withQbs(func(q *qbs.Qbs) error {
+		k := &ApiKey{Id: id}
+		if err := q.Find(k); err != nil {
+			return err
+		}
+		k.LastUsed = t
+		_, err := q.Save(k)
+		return err
+	})
+}
@@ -0,0 +1,205 @@
+package seven5
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+const (
+	DB_PING_TIMEOUT = 2 * time.Second
+	DB_RETRY_AFTER  = 5 * time.Second
+
+	DB_UNAVAILABLE_MSG = "database unavailable, try again later"
+
+	CONFIG_DB_MAX_OPEN      = "db_max_open"
+	CONFIG_DB_MAX_IDLE      = "db_max_idle"
+	CONFIG_DB_MAX_LIFETIME  = "db_max_lifetime"
+	CONFIG_DB_MAX_IDLE_TIME = "db_max_idle_time"
+)
+
+//PoolConfig is the configuration of the pool of database connections of a
+//QbsStore.  Zero values mean no limit.
+type PoolConfig struct {
+	//MaxOpen is the most connections open at once; requests beyond it wait
+	//for a connection.
+	MaxOpen int
+	//MaxIdle is the most connections kept open while they are not in use.
+	MaxIdle int
+	//MaxLifetime closes connections that are older, which lets a pool
+	//notice a database that has moved (such as after a failover).
+	MaxLifetime time.Duration
+	//MaxIdleTime closes connections that have been idle for longer.
+	MaxIdleTime time.Duration
+}
+
+//DefaultPoolConfig returns the pool configuration used by new stores, which
+//is modest enough to share a small database between a few processes.
+func DefaultPoolConfig() PoolConfig {
+	return PoolConfig{
+		MaxOpen:     20,
+		MaxIdle:     5,
+		MaxLifetime: 30 * time.Minute,
+		MaxIdleTime: 5 * time.Minute,
+	}
+}
+
+//PoolConfigFromEnv returns the DefaultPoolConfig changed by the values of
+//CONFIG_DB_MAX_OPEN, CONFIG_DB_MAX_IDLE (numbers), CONFIG_DB_MAX_LIFETIME
+//and CONFIG_DB_MAX_IDLE_TIME (durations like "10m") that are set in the
+//environment.
+func PoolConfigFromEnv(env DeploymentEnvironment) (PoolConfig, error) {
+	result := DefaultPoolConfig()
+	for key, ptr := range map[string]*int{CONFIG_DB_MAX_OPEN: &result.MaxOpen, CONFIG_DB_MAX_IDLE: &result.MaxIdle} {
+		if v := env.GetAppValue(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return result, fmt.Errorf("%s: %q is not an integer", key, v)
+			}
+			*ptr = n
+		}
+	}
+	for key, ptr := range map[string]*time.Duration{CONFIG_DB_MAX_LIFETIME: &result.MaxLifetime, CONFIG_DB_MAX_IDLE_TIME: &result.MaxIdleTime} {
+		if v := env.GetAppValue(key); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return result, fmt.Errorf("%s: %q is not a duration", key, v)
+			}
+			*ptr = d
+		}
+	}
+	return result, nil
+}
+
+//dialectDriver returns the name of the database/sql driver for a qbs
+//dialect.
+func dialectDriver(d qbs.Dialect) string {
+	t := strings.ToLower(fmt.Sprintf("%T", d))
+	switch {
+	case strings.Contains(t, "postgres"):
+		return "postgres"
+	case strings.Contains(t, "sqlite"):
+		return "sqlite3"
+	case strings.Contains(t, "mysql"):
+		return "mysql"
+	}
+	panic(fmt.Sprintf("unable to deal with db dialect provided %T", d))
+}
+
+//isMemory is true for a store with a private, in memory sqlite database.
+func (self *QbsStore) isMemory() bool {
+	return self.db != nil && self.Dsn.DbName == SQLITE_MEMORY && dialectDriver(self.dialect) == "sqlite3"
+}
+
+//SetPool configures the store's pool of connections, and those of its
+//replicas.  The connection to an in memory database is never closed, since
+//that would lose the database, so such stores ignore the limits.
+func (self *QbsStore) SetPool(cfg PoolConfig) {
+	if self.db == nil {
+		panic("store has no database of its own to configure")
+	}
+	self.pool = cfg
+	applyPool(self.db, self.isMemory(), cfg)
+	for _, r := range self.allReplicas() {
+		applyPool(r.db, dialectDriver(r.dsn.Dialect) == "sqlite3" && r.dsn.DbName == SQLITE_MEMORY, cfg)
+	}
+}
+
+func applyPool(db *sql.DB, memory bool, cfg PoolConfig) {
+	if memory {
+		cfg = PoolConfig{MaxOpen: 1, MaxIdle: 1}
+	}
+	db.SetMaxOpenConns(cfg.MaxOpen)
+	db.SetMaxIdleConns(cfg.MaxIdle)
+	db.SetConnMaxLifetime(cfg.MaxLifetime)
+	db.SetConnMaxIdleTime(cfg.MaxIdleTime)
+}
+
+//Stats returns the statistics of the store's pool of connections, such as
+//how many are in use and how long requests have waited for one.
+func (self *QbsStore) Stats() sql.DBStats {
+	if self.db == nil {
+		return sql.DBStats{}
+	}
+	return self.db.Stats()
+}
+
+//Ping checks that the database can be reached.
+func (self *QbsStore) Ping(ctx context.Context) error {
+	if self.db != nil {
+		return self.db.PingContext(ctx)
+	}
+	q, err := qbs.GetQbs()
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	return q.Db.PingContext(ctx)
+}
+
+//Check pings the database, giving up after DB_PING_TIMEOUT.  It is meant
+//for Server.AddReadyCheck, so that instances that cannot reach the
+//database are taken out of rotation.
+func (self *QbsStore) Check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), DB_PING_TIMEOUT)
+	defer cancel()
+	return self.Ping(ctx)
+}
+
+//IsConnectivityFailure returns true for errors that mean the database could
+//not be reached, or the connection to it was lost, rather than that a
+//statement failed.  These are usually transient, such as during a restart or
+//failover of the database.
+func IsConnectivityFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, e := range []error{driver.ErrBadConn, sql.ErrConnDone, io.EOF, io.ErrUnexpectedEOF, context.DeadlineExceeded} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var state interface {
+		SQLState() string
+	}
+	if errors.As(err, &state) {
+		//connection exceptions, shutdowns and too many connections
+		code := state.SQLState()
+		return strings.HasPrefix(code, "08") || code == "57P01" || code == "57P02" || code == "57P03" || code == "53300"
+	}
+	msg := err.Error()
+	if msg == "EOF" {
+		return true
+	}
+	for _, s := range []string{"connection refused", "connection reset", "broken pipe", "no such host", "bad connection"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+//DatabaseUnavailable returns a 503 for a request that failed because of a
+//connectivity failure, which asks the client to try again after
+//DB_RETRY_AFTER.
+func DatabaseUnavailable(err error) *Error {
+	log.Printf("[DB] database unavailable: %v", err)
+	result := HTTPError(http.StatusServiceUnavailable, DB_UNAVAILABLE_MSG)
+	result.RetryAfter = DB_RETRY_AFTER
+	return result
+}
@@ -0,0 +1,111 @@
+package seven5
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coocood/qbs"
+)
+
+//eofPolicy is a policy whose transactions fail to start as they do when the
+//database goes away.
+type eofPolicy struct {
+	*QbsDefaultOrmTransactionPolicy
+}
+
+func (self *eofPolicy) StartTransaction(q *qbs.Qbs) *qbs.Qbs {
+	panic(io.EOF)
+}
+
+type sqlStateError string
+
+func (self sqlStateError) Error() string    { return "pq: " + string(self) }
+func (self sqlStateError) SQLState() string { return string(self) }
+
+func TestConnectivityFailure(t *testing.T) {
+	yes := []error{
+		io.EOF,
+		driver.ErrBadConn,
+		fmt.Errorf("begin: %w", io.ErrUnexpectedEOF),
+		&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+		sqlStateError("08006"),
+		sqlStateError("57P03"),
+		errors.New("dial tcp 127.0.0.1:5432: connect: connection refused"),
+	}
+	no := []error{
+		nil,
+		errors.New("pq: duplicate key value violates unique constraint"),
+		sqlStateError("23505"),
+		sqlStateError("40001"),
+	}
+	for _, err := range yes {
+		if !IsConnectivityFailure(err) {
+			t.Errorf("expected %v to be a connectivity failure", err)
+		}
+	}
+	for _, err := range no {
+		if IsConnectivityFailure(err) {
+			t.Errorf("did not expect %v to be a connectivity failure", err)
+		}
+	}
+}
+
+func TestDatabaseUnavailable(t *testing.T) {
+	store := NewMemoryQbsStore()
+	defer store.Close()
+	wrapped := QbsWrapAll(&testObj{}, store.WithPolicy(&eofPolicy{NewQbsDefaultOrmTransactionPolicy()}))
+
+	_, err := wrapped.Find(1, nil)
+	e, ok := err.(*Error)
+	if !ok || e.StatusCode != http.StatusServiceUnavailable || e.RetryAfter != DB_RETRY_AFTER {
+		t.Fatalf("expected a 503 with a retry after but got %v", err)
+	}
+	w := httptest.NewRecorder()
+	WriteError(w, err)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "5" {
+		t.Errorf("expected 503 and Retry-After 5 but got %d and %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	//errors returned by the call are converted as well
+	_, err = NewQbsDefaultOrmTransactionPolicy().HandleResult(&qbs.Qbs{}, nil, driver.ErrBadConn)
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected a 503 but got %v", err)
+	}
+}
+
+func TestPoolConfig(t *testing.T) {
+	store := NewMemoryQbsStore()
+	store.SetPool(PoolConfig{MaxOpen: 10, MaxIdle: 2})
+	if n := store.Stats().MaxOpenConnections; n != 1 {
+		t.Errorf("expected a memory store to keep one connection but got %d", n)
+	}
+	if err := store.Check(); err != nil {
+		t.Errorf("unexpected error from check: %v", err)
+	}
+	store.Close()
+	if err := store.Check(); err == nil {
+		t.Errorf("expected the check of a closed store to fail")
+	}
+
+	env := NewConfigDeploy("pooltest")
+	env.SetDefault(CONFIG_DB_MAX_OPEN, "7")
+	env.SetDefault(CONFIG_DB_MAX_IDLE_TIME, "90s")
+	cfg, err := PoolConfigFromEnv(env)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	def := DefaultPoolConfig()
+	if cfg.MaxOpen != 7 || cfg.MaxIdle != def.MaxIdle || cfg.MaxIdleTime.Seconds() != 90 || cfg.MaxLifetime != def.MaxLifetime {
+		t.Errorf("unexpected pool config %+v", cfg)
+	}
+	env.SetDefault(CONFIG_DB_MAX_IDLE, "lots")
+	if _, err := PoolConfigFromEnv(env); err == nil {
+		t.Errorf("expected an error for a bad number")
+	}
+}
@@ -0,0 +1,216 @@
+package seven5
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+const (
+	REPLICA_RECHECK = 10 * time.Second
+
+	//READ_YOUR_WRITES_HEADER, with any value, sends a request's reads to the
+	//primary so that it sees the effects of the requests before it.  Clients
+	//typically set it for a while after they write.
+	READ_YOUR_WRITES_HEADER = "X-Read-Your-Writes"
+
+	CONFIG_DATABASE_REPLICA_URLS = "database_replica_urls"
+)
+
+//qbsReplica is a read replica of the store's database.
+type qbsReplica struct {
+	dsn  *qbs.DataSourceName
+	db   *sql.DB
+	lock sync.Mutex
+	down time.Time //zero when the replica is healthy
+}
+
+//replicaSet is the replicas of a store, which the copies made by
+//WithPolicy share.
+type replicaSet struct {
+	lock     sync.Mutex
+	replicas []*qbsReplica
+	next     int
+}
+
+//dataSource is the string to give sql.Open for the dsn.
+func dataSource(dsn *qbs.DataSourceName) string {
+	if dialectDriver(dsn.Dialect) == "sqlite3" {
+		return dsn.DbName
+	}
+	return dsn.String()
+}
+
+//AddReplica adds a read replica of the store's database, which must have
+//the same dialect.  The transactions of Index and Find calls of the
+//QbsWrap* functions go to the replicas in turn, unless the request has the
+//READ_YOUR_WRITES_HEADER; other calls go to the primary.  A replica that
+//cannot be reached is skipped (its calls go to another replica or the
+//primary) until it answers a ping, at most every REPLICA_RECHECK.
+//Replicas are usually a little behind the primary, so resources that
+//must see the latest writes should be given the primary store, via
+//WithoutReplicas.
+func (self *QbsStore) AddReplica(dsn *qbs.DataSourceName) error {
+	if self.db == nil {
+		panic("store has no database of its own to replicate")
+	}
+	if dialectDriver(dsn.Dialect) != dialectDriver(self.dialect) {
+		panic(fmt.Sprintf("replica is %s but the primary is %s", dialectDriver(dsn.Dialect), dialectDriver(self.dialect)))
+	}
+	db, err := sql.Open(dialectDriver(dsn.Dialect), dataSource(dsn))
+	if err != nil {
+		return err
+	}
+	applyPool(db, dialectDriver(dsn.Dialect) == "sqlite3" && dsn.DbName == SQLITE_MEMORY, self.pool)
+	if self.replicas == nil {
+		self.replicas = &replicaSet{}
+	}
+	self.replicas.lock.Lock()
+	defer self.replicas.lock.Unlock()
+	self.replicas.replicas = append(self.replicas.replicas, &qbsReplica{dsn: dsn, db: db})
+	return nil
+}
+
+//AddReplicaURL is AddReplica for a database url, as for NewQbsStoreFromURL.
+func (self *QbsStore) AddReplicaURL(db string) error {
+	if strings.HasPrefix(db, "sqlite3:") {
+		path := strings.TrimPrefix(strings.TrimPrefix(db, "sqlite3:"), "//")
+		return self.AddReplica(&qbs.DataSourceName{DbName: path, Dialect: qbs.NewSqlite3()})
+	}
+	dsn, err := DSNFromURL(db)
+	if err != nil {
+		return err
+	}
+	return self.AddReplica(dsn)
+}
+
+//WithoutReplicas returns a copy of the store that only uses the primary.
+func (self *QbsStore) WithoutReplicas() *QbsStore {
+	result := *self
+	result.replicas = nil
+	return &result
+}
+
+//ReplicaStats returns the statistics of the pools of the replicas, in the
+//order they were added.
+func (self *QbsStore) ReplicaStats() []sql.DBStats {
+	var result []sql.DBStats
+	for _, r := range self.allReplicas() {
+		result = append(result, r.db.Stats())
+	}
+	return result
+}
+
+//CheckReplicas pings every replica, marking the ones that fail as down,
+//and returns the number that are up.
+func (self *QbsStore) CheckReplicas() int {
+	up := 0
+	for _, r := range self.allReplicas() {
+		if r.ping() {
+			up++
+		}
+	}
+	return up
+}
+
+//ReadYourWrites is true if the request must read from the primary.
+func ReadYourWrites(pb PBundle) bool {
+	if pb == nil {
+		return false
+	}
+	v, ok := pb.Header(READ_YOUR_WRITES_HEADER)
+	return ok && v != ""
+}
+
+func (self *QbsStore) allReplicas() []*qbsReplica {
+	if self.replicas == nil {
+		return nil
+	}
+	self.replicas.lock.Lock()
+	defer self.replicas.lock.Unlock()
+	return append([]*qbsReplica(nil), self.replicas.replicas...)
+}
+
+//replica returns the next healthy replica, or nil if there is none.
+func (self *QbsStore) replica() *qbsReplica {
+	if self.replicas == nil {
+		return nil
+	}
+	self.replicas.lock.Lock()
+	all := self.replicas.replicas
+	start := self.replicas.next
+	self.replicas.next++
+	self.replicas.lock.Unlock()
+	for i := range all {
+		r := all[(start+i)%len(all)]
+		if r.usable() {
+			return r
+		}
+	}
+	return nil
+}
+
+//route returns a qbs for a call, on a replica if it only reads and one is
+//available, along with the replica.
+func (self *QbsStore) route(useReplica bool) (*qbs.Qbs, *qbsReplica, error) {
+	if useReplica {
+		if r := self.replica(); r != nil {
+			return qbs.New(r.db, self.dialect), r, nil
+		}
+	}
+	q, err := self.Qbs()
+	return q, nil, err
+}
+
+//usable is true if the replica is up, or has been down long enough to try
+//it again and answers a ping.
+func (self *qbsReplica) usable() bool {
+	self.lock.Lock()
+	down := self.down
+	self.lock.Unlock()
+	if down.IsZero() {
+		return true
+	}
+	if time.Since(down) < REPLICA_RECHECK {
+		return false
+	}
+	return self.ping()
+}
+
+func (self *qbsReplica) ping() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), DB_PING_TIMEOUT)
+	defer cancel()
+	if err := self.db.PingContext(ctx); err != nil {
+		self.markDown(err)
+		return false
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.down.IsZero() {
+		log.Printf("[DB] replica %s is back", self.dsn.DbName)
+	}
+	self.down = time.Time{}
+	return true
+}
+
+func (self *qbsReplica) markDown(err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.down.IsZero() {
+		log.Printf("[DB] replica %s is down: %v", self.dsn.DbName, err)
+	}
+	self.down = time.Now()
+}
+
+//isUnavailable is true for the errors made by DatabaseUnavailable.
+func isUnavailable(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusServiceUnavailable && e.Msg == DB_UNAVAILABLE_MSG
+}
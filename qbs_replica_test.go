@@ -0,0 +1,97 @@
+package seven5
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/coocood/qbs"
+)
+
+//replicaObj records which database each call was given.
+type replicaObj struct {
+	testObj
+	dbs []*sql.DB
+}
+
+func (self *replicaObj) IndexQbs(pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	self.dbs = append(self.dbs, q.Db)
+	return []*HouseWire{}, nil
+}
+
+func (self *replicaObj) FindQbs(id int64, pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	self.dbs = append(self.dbs, q.Db)
+	return &HouseWire{Id: id}, nil
+}
+
+func (self *replicaObj) PutQbs(id int64, value interface{}, pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	self.dbs = append(self.dbs, q.Db)
+	return &HouseWire{Id: id}, nil
+}
+
+func (self *replicaObj) last() *sql.DB {
+	return self.dbs[len(self.dbs)-1]
+}
+
+func TestReplicaRouting(t *testing.T) {
+	store := NewMemoryQbsStore()
+	defer store.Close()
+	if err := store.AddReplicaURL("sqlite3:" + SQLITE_MEMORY); err != nil {
+		t.Fatalf("unable to add replica: %v", err)
+	}
+	replica := store.allReplicas()[0].db
+	obj := &replicaObj{}
+	wrapped := QbsWrapAll(obj, store)
+
+	if _, err := wrapped.Index(nil); err != nil || obj.last() != replica {
+		t.Errorf("expected index to use the replica (%v)", err)
+	}
+	if _, err := wrapped.Find(1, nil); err != nil || obj.last() != replica {
+		t.Errorf("expected find to use the replica (%v)", err)
+	}
+	if _, err := wrapped.Put(1, &HouseWire{}, nil); err != nil || obj.last() != store.db {
+		t.Errorf("expected put to use the primary (%v)", err)
+	}
+	pb := NewTestPBundle(map[string]string{"x-read-your-writes": "1"}, nil, nil, nil, map[string]string{}, nil)
+	if _, err := wrapped.Find(1, pb); err != nil || obj.last() != store.db {
+		t.Errorf("expected read your writes to use the primary (%v)", err)
+	}
+	if _, err := QbsWrapAll(obj, store.WithoutReplicas()).Find(1, nil); err != nil || obj.last() != store.db {
+		t.Errorf("expected the store without replicas to use the primary (%v)", err)
+	}
+	if len(store.ReplicaStats()) != 1 {
+		t.Errorf("expected the stats of one replica")
+	}
+}
+
+func TestReplicaDown(t *testing.T) {
+	store := NewMemoryQbsStore()
+	defer store.Close()
+	//nothing listens on port 1, so this replica is never reachable
+	bad, err := sql.Open("postgres", "host=127.0.0.1 port=1 user=nobody dbname=nothing sslmode=disable connect_timeout=1")
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+	store.replicas = &replicaSet{}
+	store.replicas.replicas = append(store.replicas.replicas, &qbsReplica{dsn: &qbs.DataSourceName{DbName: "bad", Dialect: qbs.NewPostgres()}, db: bad})
+	if err := store.AddReplicaURL("sqlite3:" + SQLITE_MEMORY); err != nil {
+		t.Fatalf("unable to add replica: %v", err)
+	}
+	good := store.allReplicas()[1].db
+	obj := &replicaObj{}
+	wrapped := QbsWrapAll(obj, store)
+
+	for i := 0; i < 3; i++ {
+		if _, err := wrapped.Find(1, nil); err != nil {
+			t.Fatalf("expected the call to avoid the bad replica but got %v", err)
+		}
+		if obj.last() != good {
+			t.Errorf("expected call %d to use the good replica", i)
+		}
+	}
+	if store.allReplicas()[0].down.IsZero() {
+		t.Errorf("expected the bad replica to be marked down")
+	}
+	if n := store.CheckReplicas(); n != 1 {
+		t.Errorf("expected one replica up but got %d", n)
+	}
+}
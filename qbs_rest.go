@@ -89,54 +89,41 @@ type qbsWrappedUdid struct {
 // WRAPPED
 //
 
-func (self *qbsWrapped) applyPolicy(pb PBundle, fn func(tx *qbs.Qbs) (interface{}, error)) (result_obj interface{}, result_error error) {
-	q, err := qbs.GetQbs()
-	if err != nil {
-		return nil, err
-	}
-	defer q.Close()
-
-	tx := self.store.Policy.StartTransaction(q)
-	defer func() {
-		if x := recover(); x != nil {
-			result_obj, result_error = self.store.Policy.HandlePanic(tx, x)
-		}
-	}()
-	value, err := fn(tx)
-	return self.store.Policy.HandleResult(tx, value, err)
+func (self *qbsWrapped) applyPolicy(pb PBundle, read bool, fn func(tx *qbs.Qbs) (interface{}, error)) (interface{}, error) {
+	return runTransaction(self.store, pb, read, fn)
 }
 
 //Index meets the interface RestIndex but calls the wrapped QBSRestIndex
 func (self *qbsWrapped) Index(pb PBundle) (interface{}, error) {
-	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+	return self.applyPolicy(pb, true, func(tx *qbs.Qbs) (interface{}, error) {
 		return self.index.IndexQbs(pb, tx)
 	})
 }
 
 //Find meets the interface RestFind but calls the wrapped QBSRestFind
 func (self *qbsWrapped) Find(id int64, pb PBundle) (interface{}, error) {
-	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+	return self.applyPolicy(pb, true, func(tx *qbs.Qbs) (interface{}, error) {
 		return self.find.FindQbs(id, pb, tx)
 	})
 }
 
 //Delete meets the interface RestDelete but calls the wrapped QBSRestDelete
 func (self *qbsWrapped) Delete(id int64, pb PBundle) (interface{}, error) {
-	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+	return self.applyPolicy(pb, false, func(tx *qbs.Qbs) (interface{}, error) {
 		return self.del.DeleteQbs(id, pb, tx)
 	})
 }
 
 //Put meets the interface RestPut but calls the wrapped QBSRestPut
 func (self *qbsWrapped) Put(id int64, value interface{}, pb PBundle) (interface{}, error) {
-	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+	return self.applyPolicy(pb, false, func(tx *qbs.Qbs) (interface{}, error) {
 		return self.put.PutQbs(id, value, pb, tx)
 	})
 }
 
 //Post meets the interface RestPost but calls the wrapped QBSRestPost
 func (self *qbsWrapped) Post(value interface{}, pb PBundle) (interface{}, error) {
-	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+	return self.applyPolicy(pb, false, func(tx *qbs.Qbs) (interface{}, error) {
 		return self.post.PostQbs(value, pb, tx)
 	})
 }
@@ -182,53 +169,41 @@ func (self *qbsWrapped) Allow(id int64, method string, pb PBundle) bool {
 // WRAPPED UDID
 //
 
-func (self *qbsWrappedUdid) applyPolicy(pb PBundle, fn func(*qbs.Qbs) (interface{}, error)) (result_obj interface{}, result_error error) {
-	q, err := qbs.GetQbs()
-	if err != nil {
-		return nil, err
-	}
-	defer q.Close()
-	tx := self.store.Policy.StartTransaction(q)
-	defer func() {
-		if x := recover(); x != nil {
-			result_obj, result_error = self.store.Policy.HandlePanic(tx, x)
-		}
-	}()
-	value, err := fn(tx)
-	return self.store.Policy.HandleResult(tx, value, err)
+func (self *qbsWrappedUdid) applyPolicy(pb PBundle, read bool, fn func(*qbs.Qbs) (interface{}, error)) (interface{}, error) {
+	return runTransaction(self.store, pb, read, fn)
 }
 
 //Index meets the interface RestIndex but calls the wrapped QBSRestIndex
 func (self *qbsWrappedUdid) Index(pb PBundle) (interface{}, error) {
-	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+	return self.applyPolicy(pb, true, func(tx *qbs.Qbs) (interface{}, error) {
 		return self.index.IndexQbs(pb, tx)
 	})
 }
 
 //FindUdid meets the interface RestFindUdid but calls the wrapped QBSRestFindUdid
 func (self *qbsWrappedUdid) Find(id string, pb PBundle) (interface{}, error) {
-	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+	return self.applyPolicy(pb, true, func(tx *qbs.Qbs) (interface{}, error) {
 		return self.find.FindQbs(id, pb, tx)
 	})
 }
 
 //DeleteUdid meets the interface RestDeleteUdid but calls the wrapped QBSRestDeleteUdid
 func (self *qbsWrappedUdid) Delete(id string, pb PBundle) (interface{}, error) {
-	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+	return self.applyPolicy(pb, false, func(tx *qbs.Qbs) (interface{}, error) {
 		return self.del.DeleteQbs(id, pb, tx)
 	})
 }
 
 //Post meets the interface RestPost but calls the wrapped QBSRestPost
 func (self *qbsWrappedUdid) Post(value interface{}, pb PBundle) (interface{}, error) {
-	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+	return self.applyPolicy(pb, false, func(tx *qbs.Qbs) (interface{}, error) {
 		return self.post.PostQbs(value, pb, tx)
 	})
 }
 
 //PutUdid meets the interface RestPutUdid but calls the wrapped QBSRestPutUdid
 func (self *qbsWrappedUdid) Put(id string, value interface{}, pb PBundle) (interface{}, error) {
-	return self.applyPolicy(pb, func(tx *qbs.Qbs) (interface{}, error) {
+	return self.applyPolicy(pb, false, func(tx *qbs.Qbs) (interface{}, error) {
 		return self.put.PutQbs(id, value, pb, tx)
 	})
 }
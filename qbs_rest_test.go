@@ -4,10 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
 	"testing"
 
 	"github.com/coocood/qbs"
 	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 const (
@@ -135,11 +137,11 @@ const (
 
 func checkNumberHouses(T *testing.T, store *QbsStore, expected int) {
 	houses := []*House{}
-	q, err := qbs.GetQbs()
+	q, err := store.Qbs()
 	if err != nil {
 		T.Fatalf("couldn't get QBS: %v", err)
 	}
-	defer q.Close()
+	defer store.Release(q)
 	if err := q.FindAll(&houses); err != nil {
 		T.Fatalf("Error during find: %s", err)
 	}
@@ -157,11 +159,11 @@ func TestTxn(T *testing.T) {
 	wrapped := QbsWrapAll(obj, store)
 
 	//insure that there are no houses at start
-	q, err := qbs.GetQbs()
+	q, err := store.Qbs()
 	if err != nil {
 		T.Fatalf("couldn't get QBS: %v", err)
 	}
-	defer q.Close()
+	defer store.Release(q)
 	var houses []*House
 	if err := q.FindAll(&houses); err != nil {
 		T.Fatalf("Error during find: %s", err)
@@ -201,9 +203,13 @@ func setupDispatcher() (*RawDispatcher, *ServeMux) {
 	return raw, serveMux
 }
 
+//setupTestStore uses the postgres database in DATABASE_URL if there is one,
+//otherwise a new sqlite database in memory.
 func setupTestStore() *QbsStore {
-	dsn := GetDSNOrDie()
-	return NewQbsStoreFromDSN(dsn)
+	if os.Getenv("DATABASE_URL") != "" {
+		return NewQbsStoreFromDSN(GetDSNOrDie())
+	}
+	return NewMemoryQbsStore(&House{}, &HouseUdid{})
 }
 
 func checkNetworkCalls(T *testing.T, portSpec string, serveMux *ServeMux, obj *testObj, udid *testObjUdid) {
@@ -269,12 +275,12 @@ func TestWrappingAll(T *testing.T) {
 	checkNetworkCalls(T, ":8991", mux, obj, nil)
 
 	//clean up
-	q, err := qbs.GetQbs()
+	q, err := store.Qbs()
 	if err != nil {
 		T.Fatalf("couldn't get a qbs: %v", err)
 	}
 	q.WhereEqual("Zip", 0).Delete(&House{})
-	q.Close()
+	store.Release(q)
 }
 
 func TestWrappingUdid(T *testing.T) {
@@ -286,12 +292,12 @@ func TestWrappingUdid(T *testing.T) {
 	checkNetworkCalls(T, ":8993", mux, nil, obj)
 
 	//clean up
-	q, err := qbs.GetQbs()
+	q, err := store.Qbs()
 	if err != nil {
 		T.Fatalf("couldn't get a qbs: %v", err)
 	}
 	q.WhereEqual("Zip", 0).Delete(&HouseUdid{})
-	q.Close()
+	store.Release(q)
 }
 
 func TestWrappingSeparate(T *testing.T) {
@@ -310,12 +316,12 @@ func TestWrappingSeparate(T *testing.T) {
 	checkNetworkCalls(T, ":8992", mux, obj, nil)
 
 	//clean up
-	q, err := qbs.GetQbs()
+	q, err := store.Qbs()
 	if err != nil {
 		T.Fatalf("couldn't get a qbs: %v", err)
 	}
 	q.WhereEqual("Zip", 0).Delete(&House{})
-	q.Close()
+	store.Release(q)
 
 }
 
@@ -0,0 +1,40 @@
+package seven5
+
+import (
+	"testing"
+)
+
+func TestSqliteQbsStore(t *testing.T) {
+	dsn := ParamsToDSN("test.db", "sqlite3", "")
+	if dsn.DbName != "test.db" || dsn.Host != "" || dsn.Port != "" || dsn.Username != "" {
+		t.Errorf("expected sqlite dsn to have only a file, got %+v", dsn)
+	}
+
+	one, err := NewQbsStoreFromURL("sqlite3::memory:")
+	if err != nil {
+		t.Fatalf("unable to open sqlite store: %v", err)
+	}
+	two := NewMemoryQbsStore()
+	defer two.Close()
+
+	if _, err := one.db.Exec("CREATE TABLE house (id INTEGER PRIMARY KEY, address TEXT)"); err != nil {
+		t.Fatalf("unable to create table: %v", err)
+	}
+	if _, err := one.db.Exec("INSERT INTO house (address) VALUES ('742 evergreen terrace')"); err != nil {
+		t.Fatalf("unable to insert: %v", err)
+	}
+	var n int
+	if err := one.db.QueryRow("SELECT count(*) FROM house").Scan(&n); err != nil || n != 1 {
+		t.Errorf("expected one house, got %d (%v)", n, err)
+	}
+	if err := two.db.QueryRow("SELECT count(*) FROM house").Scan(&n); err == nil {
+		t.Errorf("expected in memory stores to be separate databases")
+	}
+
+	if err := one.Close(); err != nil {
+		t.Errorf("unable to close store: %v", err)
+	}
+	if err := one.db.Ping(); err == nil {
+		t.Errorf("expected closed store's database to be closed")
+	}
+}
@@ -278,7 +278,7 @@ func (self *RawDispatcher) Dispatch(mux *ServeMux, w http.ResponseWriter, r *htt
 	parts := strings.Split(path, "/")
 	bundle, err := self.IO.BundleHook(w, r, self.SessionMgr)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to create parameter bundle:%s", err), http.StatusInternalServerError)
+		self.SendError(err, w, "failed to create parameter bundle")
 		return nil
 	}
 	self.DispatchSegment(mux, w, r, parts, self.Root, bundle)
@@ -623,6 +623,7 @@ func (self *RawDispatcher) SendError(err error, w http.ResponseWriter, msg strin
 	if !ok {
 		http.Error(w, fmt.Sprintf("%s: %s", msg, err), http.StatusInternalServerError)
 	} else {
+		ours.setHeaders(w)
 		http.Error(w, ours.Msg, ours.StatusCode)
 	}
 }
@@ -0,0 +1,197 @@
+package seven5
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+const (
+	//CSP_NONCE_PLACEHOLDER is written into pages by the cspNonce function of
+	//pagegen and replaced by the nonce of each request when the page is served
+	//from disk by SimpleStaticFilesServer or SimpleComponentMatcher; it is never
+	//replaced in responses from other handlers, which may contain user content.
+	//It is the same length as a nonce so Content-Length is unchanged.
+	CSP_NONCE_PLACEHOLDER = "s5-csp-nonce-placeholder"
+	//CSP_NONCE is replaced by the nonce of the request in a
+	//ContentSecurityPolicy.
+	CSP_NONCE = "{nonce}"
+
+	DEFAULT_CSP = "default-src 'self'; script-src 'self' 'nonce-" + CSP_NONCE + "'; " +
+		"style-src 'self' 'unsafe-inline'; img-src 'self' data:; object-src 'none'; " +
+		"base-uri 'self'; form-action 'self'; frame-ancestors 'none'"
+)
+
+type cspNonceKey struct{}
+
+//SecurityHeaders is the policy for the security related headers of every
+//response.  Empty fields are not sent.
+type SecurityHeaders struct {
+	//ContentSecurityPolicy may include CSP_NONCE, which becomes a fresh nonce
+	//for each request.
+	ContentSecurityPolicy string
+	//ReportOnly sends the policy as Content-Security-Policy-Report-Only, to
+	//try out a policy without breaking the application.
+	ReportOnly        bool
+	FrameOptions      string
+	ReferrerPolicy    string
+	NoSniff           bool
+	PermissionsPolicy string
+	CrossOriginOpener string
+}
+
+//DefaultSecurityHeaders returns a strict policy: scripts only from our own
+//origin or inline with the nonce, no framing, no sniffing and no referrer
+//outside our origin.
+func DefaultSecurityHeaders() *SecurityHeaders {
+	return &SecurityHeaders{
+		ContentSecurityPolicy: DEFAULT_CSP,
+		FrameOptions:          "DENY",
+		ReferrerPolicy:        "strict-origin-when-cross-origin",
+		NoSniff:               true,
+		PermissionsPolicy:     "camera=(), microphone=(), geolocation=()",
+		CrossOriginOpener:     "same-origin",
+	}
+}
+
+//NewCSPNonce returns a new random nonce, the same length as
+//CSP_NONCE_PLACEHOLDER.
+func NewCSPNonce() string {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		panic("unable to read random bytes for nonce: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+//CSPNonce returns the nonce of the request, or "" if it did not go through a
+//SecurityHandler.  Handlers that generate html must use it for the nonce
+//attribute of inline scripts, such as by passing it to their templates.
+func CSPNonce(r *http.Request) string {
+	n, _ := r.Context().Value(cspNonceKey{}).(string)
+	return n
+}
+
+//Apply sets the headers on w using the nonce.
+func (self *SecurityHeaders) Apply(w http.ResponseWriter, nonce string) {
+	h := w.Header()
+	if self.ContentSecurityPolicy != "" {
+		name := "Content-Security-Policy"
+		if self.ReportOnly {
+			name += "-Report-Only"
+		}
+		h.Set(name, strings.Replace(self.ContentSecurityPolicy, CSP_NONCE, nonce, -1))
+	}
+	if self.FrameOptions != "" {
+		h.Set("X-Frame-Options", self.FrameOptions)
+	}
+	if self.ReferrerPolicy != "" {
+		h.Set("Referrer-Policy", self.ReferrerPolicy)
+	}
+	if self.NoSniff {
+		h.Set("X-Content-Type-Options", "nosniff")
+	}
+	if self.PermissionsPolicy != "" {
+		h.Set("Permissions-Policy", self.PermissionsPolicy)
+	}
+	if self.CrossOriginOpener != "" {
+		h.Set("Cross-Origin-Opener-Policy", self.CrossOriginOpener)
+	}
+}
+
+//SecurityHandler wraps a handler to send the security headers with every
+//response.  Each request gets a new nonce (see CSPNonce).  The response
+//writer is passed to the handler unchanged, so streaming and websocket
+//handlers work as usual.
+type SecurityHandler struct {
+	handler http.Handler
+	policy  *SecurityHeaders
+}
+
+//NewSecurityHandler returns a handler that wraps h.  If policy is nil, the
+//DefaultSecurityHeaders are used.  See also ServeMux.SetSecurityHeaders.
+func NewSecurityHandler(h http.Handler, policy *SecurityHeaders) *SecurityHandler {
+	if policy == nil {
+		policy = DefaultSecurityHeaders()
+	}
+	return &SecurityHandler{handler: h, policy: policy}
+}
+
+func (self *SecurityHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveSecurely(self.policy, self.handler, w, r)
+}
+
+func serveSecurely(policy *SecurityHeaders, h http.Handler, w http.ResponseWriter, r *http.Request) {
+	nonce := NewCSPNonce()
+	policy.Apply(w, nonce)
+	h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), cspNonceKey{}, nonce)))
+}
+
+//servePage serves a page from disk with h, replacing CSP_NONCE_PLACEHOLDER
+//in it by the nonce of the request if it is html.  Only use this for files
+//written by the application's developers, such as the output of pagegen.
+func servePage(h http.Handler, w http.ResponseWriter, r *http.Request) {
+	nonce := CSPNonce(r)
+	if nonce == "" {
+		h.ServeHTTP(w, r)
+		return
+	}
+	nw := &nonceWriter{ResponseWriter: w, nonce: nonce}
+	h.ServeHTTP(nw, r)
+	nw.finish()
+}
+
+//nonceWriter holds back html responses until they are complete to replace
+//the placeholder with the nonce; other responses pass straight through.
+type nonceWriter struct {
+	http.ResponseWriter
+	nonce   string
+	decided bool
+	html    bool
+	status  int
+	buf     bytes.Buffer
+}
+
+func (self *nonceWriter) decide() {
+	if !self.decided {
+		self.decided = true
+		self.html = strings.HasPrefix(self.Header().Get("Content-Type"), "text/html")
+	}
+}
+
+func (self *nonceWriter) WriteHeader(status int) {
+	self.decide()
+	if self.html {
+		if self.status == 0 {
+			self.status = status
+		}
+		return
+	}
+	self.ResponseWriter.WriteHeader(status)
+}
+
+func (self *nonceWriter) Write(b []byte) (int, error) {
+	if !self.decided && self.Header().Get("Content-Type") == "" {
+		//as net/http would
+		self.Header().Set("Content-Type", http.DetectContentType(b))
+	}
+	self.decide()
+	if self.html {
+		return self.buf.Write(b)
+	}
+	return self.ResponseWriter.Write(b)
+}
+
+func (self *nonceWriter) finish() {
+	if !self.html {
+		return
+	}
+	if self.status == 0 {
+		self.status = http.StatusOK
+	}
+	self.ResponseWriter.WriteHeader(self.status)
+	self.ResponseWriter.Write(bytes.Replace(self.buf.Bytes(), []byte(CSP_NONCE_PLACEHOLDER), []byte(self.nonce), -1))
+}
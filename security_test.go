@@ -0,0 +1,95 @@
+package seven5
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s5security")
+	if err != nil {
+		t.Fatalf("unable to make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var page bytes.Buffer
+	po := PagegenOpts{}
+	tmpl := po.newTemplate("index.html")
+	tmpl.Parse(`<html><script nonce="{{cspNonce}}">main()</script></html>`)
+	tmpl.Execute(&page, nil)
+	ioutil.WriteFile(filepath.Join(dir, "index.html"), page.Bytes(), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "app.js"), []byte("var x = '"+CSP_NONCE_PLACEHOLDER+"';"), 0644)
+
+	os.Setenv("STATIC_DIR", dir)
+	defer os.Unsetenv("STATIC_DIR")
+	mux := NewServeMux()
+	mux.Handle("/", NewStaticFilesServer("/", false))
+	var seen string
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		seen = CSPNonce(r)
+		w.Write([]byte("{}"))
+	})
+	mux.HandleFunc("/comment", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<p><script nonce="` + CSP_NONCE_PLACEHOLDER + `">evil()</script></p>`))
+		w.(http.Flusher).Flush()
+	})
+	mux.SetSecurityHeaders(DefaultSecurityHeaders())
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	csp := w.Header().Get("Content-Security-Policy")
+	body := w.Body.String()
+	start := strings.Index(body, `nonce="`) + len(`nonce="`)
+	nonce := body[start : start+len(CSP_NONCE_PLACEHOLDER)]
+	if strings.Contains(body, CSP_NONCE_PLACEHOLDER) || !strings.Contains(csp, "'nonce-"+nonce+"'") {
+		t.Errorf("expected page nonce to match policy:\n%s\n%s", body, csp)
+	}
+	if cl := w.Header().Get("Content-Length"); cl != strconv.Itoa(len(body)) {
+		t.Errorf("expected content length %d but got %s", len(body), cl)
+	}
+	for h, v := range map[string]string{
+		"X-Frame-Options":        "DENY",
+		"X-Content-Type-Options": "nosniff",
+		"Referrer-Policy":        "strict-origin-when-cross-origin",
+	} {
+		if w.Header().Get(h) != v {
+			t.Errorf("expected %s to be %s but got %q", h, v, w.Header().Get(h))
+		}
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/app.js", nil))
+	if !strings.Contains(w.Body.String(), CSP_NONCE_PLACEHOLDER) {
+		t.Errorf("expected placeholder to be left alone outside html: %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/comment", nil))
+	if !strings.Contains(w.Body.String(), CSP_NONCE_PLACEHOLDER) || !w.Flushed {
+		t.Errorf("expected html from a handler to be passed through untouched: %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api", nil))
+	if seen == "" || seen == nonce || !strings.Contains(w.Header().Get("Content-Security-Policy"), seen) {
+		t.Errorf("expected a new nonce for each request, got %q", seen)
+	}
+
+	report := &SecurityHeaders{ContentSecurityPolicy: "default-src 'self'", ReportOnly: true}
+	w = httptest.NewRecorder()
+	NewSecurityHandler(http.NotFoundHandler(), report).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Header().Get("Content-Security-Policy-Report-Only") != "default-src 'self'" || w.Header().Get("X-Frame-Options") != "" {
+		t.Errorf("expected only a report only policy, got %v", w.Header())
+	}
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status to be kept, got %d", w.Code)
+	}
+}
@@ -0,0 +1,244 @@
+package seven5
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	HEALTH_LIVE_PATH  = "/healthz"
+	HEALTH_READY_PATH = "/readyz"
+
+	SHUTDOWN_TIMEOUT = 30 * time.Second
+	DRAIN_DELAY      = 5 * time.Second
+
+	CONFIG_TLS_CERT = "tls_cert"
+	CONFIG_TLS_KEY  = "tls_key"
+)
+
+type shutdownHook struct {
+	name string
+	fn   func(context.Context) error
+}
+
+type readyCheck struct {
+	name string
+	fn   func() error
+}
+
+//Server runs the application's ServeMux (or any other handler) on the port given by the
+//DeploymentEnvironment and shuts it down gracefully on SIGTERM (or SIGINT):
+//it first reports that it is not ready, waits for the drain delay so load
+//balancers stop sending it requests, lets the requests in progress finish and
+//then runs the shutdown hooks in the order they were added.  It adds a
+//liveness endpoint (HEALTH_LIVE_PATH) and a readiness endpoint
+//(HEALTH_READY_PATH) in front of the handler; these are answered directly, so
+//the ErrorDispatcher never sees a failed readiness check.  If the app values
+//tls_cert and tls_key are set, these are the files of the certificate and key
+//and the server uses TLS.
+type Server struct {
+	handler http.Handler
+	env     DeploymentEnvironment
+	server  *http.Server
+
+	drain   time.Duration
+	timeout time.Duration
+
+	lock     sync.Mutex
+	stopping bool
+	hooks    []shutdownHook
+	checks   []readyCheck
+	stopped  chan struct{}
+}
+
+//NewServer returns a server for the handler in the environment given,
+//usually a *ServeMux so that its ErrorDispatcher and security headers apply.
+func NewServer(handler http.Handler, env DeploymentEnvironment) *Server {
+	result := &Server{
+		handler: handler,
+		env:     env,
+		drain:   DRAIN_DELAY,
+		timeout: SHUTDOWN_TIMEOUT,
+		stopped: make(chan struct{}),
+	}
+	result.server = &http.Server{
+		Handler:           http.HandlerFunc(result.serve),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+	return result
+}
+
+func (self *Server) serve(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case HEALTH_LIVE_PATH:
+		self.live(w, r)
+	case HEALTH_READY_PATH:
+		self.ready(w, r)
+	default:
+		self.handler.ServeHTTP(w, r)
+	}
+}
+
+//HTTPServer returns the http.Server, for setting timeouts or the TLS config
+//before calling Run.
+func (self *Server) HTTPServer() *http.Server {
+	return self.server
+}
+
+//SetDrainDelay sets how long the server keeps serving, while reporting not
+//ready, before it stops accepting connections.  The default is DRAIN_DELAY.
+func (self *Server) SetDrainDelay(d time.Duration) {
+	self.drain = d
+}
+
+//SetShutdownTimeout sets how long requests in progress, and then the shutdown
+//hooks, have to finish.  The default is SHUTDOWN_TIMEOUT.
+func (self *Server) SetShutdownTimeout(d time.Duration) {
+	self.timeout = d
+}
+
+//OnShutdown adds a hook that is run after the server has stopped serving.
+//Hooks run in the order they were added, so add hooks that use the database
+//(like a SessionManager kept there) before the hook that closes the QbsStore.
+func (self *Server) OnShutdown(name string, fn func(context.Context) error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.hooks = append(self.hooks, shutdownHook{name, fn})
+}
+
+//CloseOnShutdown adds a shutdown hook that closes c, such as a
+//SimpleSessionManager or a QbsStore.
+func (self *Server) CloseOnShutdown(name string, c io.Closer) {
+	self.OnShutdown(name, func(context.Context) error {
+		return c.Close()
+	})
+}
+
+//AddReadyCheck adds a check to the readiness endpoint, which fails if any
+//check returns an error.
+func (self *Server) AddReadyCheck(name string, fn func() error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.checks = append(self.checks, readyCheck{name, fn})
+}
+
+func (self *Server) live(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+func (self *Server) ready(w http.ResponseWriter, r *http.Request) {
+	self.lock.Lock()
+	stopping := self.stopping
+	checks := append([]readyCheck(nil), self.checks...)
+	self.lock.Unlock()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if stopping {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	for _, c := range checks {
+		if err := c.fn(); err != nil {
+			http.Error(w, fmt.Sprintf("%s: %v", c.name, err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+//Run listens on the port of the DeploymentEnvironment and serves until it
+//receives SIGTERM or SIGINT, then shuts down.  It returns an error if the
+//server could not start or did not shut down cleanly.
+func (self *Server) Run() error {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", self.env.Port()))
+	if err != nil {
+		return err
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sig)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- self.Serve(l)
+	}()
+	select {
+	case err := <-served:
+		return err
+	case s := <-sig:
+		log.Printf("[SERVER] received %v, shutting down", s)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), self.drain+self.timeout)
+	defer cancel()
+	if err := self.Shutdown(ctx); err != nil {
+		return err
+	}
+	return <-served
+}
+
+//Serve serves on the listener until Shutdown is called, when it returns nil.
+func (self *Server) Serve(l net.Listener) error {
+	var err error
+	cert, key := self.env.GetAppValue(CONFIG_TLS_CERT), self.env.GetAppValue(CONFIG_TLS_KEY)
+	switch {
+	case cert != "" && key != "":
+		err = self.server.ServeTLS(l, cert, key)
+	case cert != "" || key != "":
+		l.Close()
+		return fmt.Errorf("both %s and %s are needed for TLS", CONFIG_TLS_CERT, CONFIG_TLS_KEY)
+	default:
+		err = self.server.Serve(l)
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	<-self.stopped
+	return nil
+}
+
+//Shutdown stops the server gracefully, as if it had received SIGTERM, and
+//runs the shutdown hooks.  The drain delay is cut short if ctx is done.  All
+//the hooks are run even if some fail; the error reports every failure.
+func (self *Server) Shutdown(ctx context.Context) error {
+	self.lock.Lock()
+	if self.stopping {
+		self.lock.Unlock()
+		return fmt.Errorf("server is already shutting down")
+	}
+	self.stopping = true
+	hooks := append([]shutdownHook(nil), self.hooks...)
+	self.lock.Unlock()
+	defer close(self.stopped)
+
+	select {
+	case <-time.After(self.drain):
+	case <-ctx.Done():
+	}
+	var problems []string
+	sctx, cancel := context.WithTimeout(ctx, self.timeout)
+	defer cancel()
+	if err := self.server.Shutdown(sctx); err != nil {
+		problems = append(problems, fmt.Sprintf("http: %v", err))
+	}
+	for _, h := range hooks {
+		if err := h.fn(sctx); err != nil {
+			log.Printf("[SERVER] shutdown of %s failed: %v", h.name, err)
+			problems = append(problems, fmt.Sprintf("%s: %v", h.name, err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("unclean shutdown: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
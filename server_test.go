@@ -0,0 +1,101 @@
+package seven5
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerShutdown(t *testing.T) {
+	mux := NewServeMux()
+	release := make(chan struct{})
+	started := make(chan struct{})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+	srv := NewServer(mux, &testDeploy{true})
+	srv.SetDrainDelay(100 * time.Millisecond)
+	srv.SetShutdownTimeout(5 * time.Second)
+
+	sm := NewDumbSessionManager()
+	var order []string
+	srv.OnShutdown("first", func(context.Context) error {
+		order = append(order, "first")
+		return nil
+	})
+	srv.CloseOnShutdown("sessions", sm)
+	srv.OnShutdown("broken", func(context.Context) error {
+		order = append(order, "broken")
+		return errors.New("oops")
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	base := "http://" + l.Addr().String()
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(base + path)
+		if err != nil {
+			t.Fatalf("unable to get %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	if code, _ := get(HEALTH_READY_PATH); code != http.StatusOK {
+		t.Errorf("expected ready, got %d", code)
+	}
+	srv.AddReadyCheck("db", func() error { return errors.New("down") })
+	if code, body := get(HEALTH_READY_PATH); code != http.StatusServiceUnavailable || !strings.Contains(body, "db") {
+		t.Errorf("expected failed check to make server not ready, got %d %s", code, body)
+	}
+
+	slow := make(chan string, 1)
+	go func() {
+		_, body := get("/slow")
+		slow <- body
+	}()
+	<-started
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(context.Background()) }()
+
+	time.Sleep(20 * time.Millisecond)
+	if code, body := get(HEALTH_READY_PATH); code != http.StatusServiceUnavailable || !strings.Contains(body, "shutting down") {
+		t.Errorf("expected not ready while draining, got %d %s", code, body)
+	}
+	if code, _ := get(HEALTH_LIVE_PATH); code != http.StatusOK {
+		t.Errorf("expected live while draining, got %d", code)
+	}
+	close(release)
+	if body := <-slow; body != "done" {
+		t.Errorf("expected request in progress to finish, got %q", body)
+	}
+
+	err = <-shutdown
+	if err == nil || !strings.Contains(err.Error(), "broken: oops") {
+		t.Errorf("expected failed hook to be reported, got %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("expected Serve to return nil after shutdown, got %v", err)
+	}
+	if strings.Join(order, ",") != "first,broken" {
+		t.Errorf("expected hooks in order, got %v", order)
+	}
+	if _, err := sm.Find("fred"); err != SESSIONS_CLOSED {
+		t.Errorf("expected session manager to be closed, got %v", err)
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Errorf("expected server to stop listening")
+	}
+}
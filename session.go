@@ -5,12 +5,14 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,6 +20,10 @@ const (
 	s5CookiePrefix = "s5" //helps for detecting keys have changed and shuffling attacks
 )
 
+var (
+	SESSIONS_CLOSED = errors.New("session manager has been closed")
+)
+
 //Generator is a type that converts from a small amount of unique info to the
 //data that should be stored in a session.  It is called when an http request
 //is received (see IOHook) and the user has previously visited this website.
@@ -53,10 +59,19 @@ type Session interface {
 	UserData() interface{}
 }
 
+//ExpiringSession is implemented by sessions that know when they will expire.
+//The CookieMapper uses this, if present, to make the lifetime of the browser's
+//cookie match the lifetime of the session it refers to.
+type ExpiringSession interface {
+	Session
+	Expires() time.Time
+}
+
 //SimpleSession is a default implementation of Session suitable for most applications.
 type SimpleSession struct {
-	id string
-	ud interface{}
+	id      string
+	ud      interface{}
+	expires time.Time
 }
 
 //SessionId returns the sessionId. To make sessions stable across runs, the
@@ -74,6 +89,12 @@ func (self *SimpleSession) UserData() interface{} {
 	return self.ud
 }
 
+//Expires returns the time this session expires or the zero time if the
+//session was not created with an expiration time.
+func (self *SimpleSession) Expires() time.Time {
+	return self.expires
+}
+
 //NewSimpleSession returns a new simple session with its SessionId initialized.
 //If the sid is "", a new UDID is generated as the session ID, but most applications
 //will want to control this so that sessions are stable across runs.
@@ -82,7 +103,7 @@ func NewSimpleSession(userData interface{}, sid string) *SimpleSession {
 	if sid == "" {
 		s = UDID()
 	}
-	return &SimpleSession{s, userData}
+	return &SimpleSession{id: s, ud: userData}
 }
 
 //SimpleSessionManager is an implementation of the SessionManager that knows about the semantics
@@ -90,6 +111,8 @@ func NewSimpleSession(userData interface{}, sid string) *SimpleSession {
 type SimpleSessionManager struct {
 	generator Generator
 	out       chan *sessionPacket
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 //NewSimpleSessionManager returns an instance of seven5.SessionManager.
@@ -101,6 +124,19 @@ type SimpleSessionManager struct {
 //as your generator, we are assuming that you will explicitly connect each
 //user session via a call to Assign.
 func NewSimpleSessionManager(g Generator) *SimpleSessionManager {
+	key := serverSessionKey()
+	result := &SimpleSessionManager{
+		out:       make(chan *sessionPacket),
+		done:      make(chan struct{}),
+		generator: g,
+	}
+	go handleSessionChecks(result.out, result.done, key)
+	return result
+}
+
+//serverSessionKey reads and decodes the environment variable SERVER_SESSION_KEY
+//or exits the program if it cannot.
+func serverSessionKey() []byte {
 	if os.Getenv("SERVER_SESSION_KEY") == "" {
 		log.Fatalf("unable to find environment variable SERVER_SESSION_KEY")
 	}
@@ -116,14 +152,7 @@ func NewSimpleSessionManager(g Generator) *SimpleSessionManager {
 	if l != aes.BlockSize {
 		log.Fatalf("expected SERVER_SESSION_KEY decoded length to be %d, but was %d", aes.BlockSize, l)
 	}
-	key := buf[0:l]
-
-	result := &SimpleSessionManager{
-		out:       make(chan *sessionPacket),
-		generator: g,
-	}
-	go handleSessionChecks(result.out, key)
-	return result
+	return buf[0:l]
 }
 
 //NewDumbSessionManager returns a session manager that makes no attempt
@@ -132,9 +161,10 @@ func NewSimpleSessionManager(g Generator) *SimpleSessionManager {
 func NewDumbSessionManager() *SimpleSessionManager {
 	result := &SimpleSessionManager{
 		out:       make(chan *sessionPacket),
+		done:      make(chan struct{}),
 		generator: nil,
 	}
-	go handleSessionChecks(result.out, []byte{})
+	go handleSessionChecks(result.out, result.done, []byte{})
 	return result
 }
 
@@ -174,8 +204,8 @@ type SessionReturn struct {
 
 //handleSessionChecks is the goroutine that reads session manager requests and responds based on its
 //map.  Each operation has a sessionPacket and that has on op to tell us how to
-//process each one.
-func handleSessionChecks(ch chan *sessionPacket, key []byte) {
+//process each one.  It exits when done is closed.
+func handleSessionChecks(ch chan *sessionPacket, done chan struct{}, key []byte) {
 	hash := make(map[string]Session)
 
 	var err error
@@ -190,7 +220,12 @@ func handleSessionChecks(ch chan *sessionPacket, key []byte) {
 
 	var result *SessionReturn
 	for {
-		pkt := <-ch
+		var pkt *sessionPacket
+		select {
+		case pkt = <-ch:
+		case <-done:
+			return
+		}
 		packetsProcessed++
 
 		result = nil //safety
@@ -211,14 +246,18 @@ func handleSessionChecks(ch chan *sessionPacket, key []byte) {
 				sid = encryptSessionId(sessionId, block)
 			}
 			s := NewSimpleSession(pkt.userData, sid)
+			s.expires = pkt.expires
 			hash[sid] = s
 			result = &SessionReturn{Session: s}
 		case _SESSION_OP_UPDATE:
-			_, ok := hash[pkt.sessionId]
+			old, ok := hash[pkt.sessionId]
 			if !ok {
 				result = nil
 			} else {
 				s := NewSimpleSession(pkt.userData, pkt.sessionId)
+				if es, ok := old.(ExpiringSession); ok {
+					s.expires = es.Expires()
+				}
 				result = &SessionReturn{Session: s}
 			}
 		case _SESSION_OP_FIND:
@@ -277,9 +316,10 @@ func (self *SimpleSessionManager) Assign(uniqueInfo string, userData interface{}
 		expires:    expires,
 		ret:        ch,
 	}
-	self.out <- pkt
-	sr := <-ch
-	close(ch)
+	sr, err := self.send(pkt)
+	if err != nil {
+		return nil, err
+	}
 
 	//this the now initialized session
 	return sr.Session, nil
@@ -300,9 +340,10 @@ func (self *SimpleSessionManager) Update(session Session, i interface{}) (Sessio
 		sessionId: session.SessionId(),
 		ret:       ch,
 	}
-	self.out <- pkt
-	sr := <-ch
-	close(ch)
+	sr, err := self.send(pkt)
+	if err != nil || sr == nil {
+		return nil, err
+	}
 
 	//this the now initialized session
 	return sr.Session, nil
@@ -318,11 +359,8 @@ func (self *SimpleSessionManager) Destroy(id string) error {
 		sessionId: id,
 		ret:       ch,
 	}
-	self.out <- pkt
-	_ = <-ch
-	close(ch)
-
-	return nil
+	_, err := self.send(pkt)
+	return err
 }
 
 //Find is called by the cookie management layer to see if a particular session
@@ -344,11 +382,29 @@ func (self *SimpleSessionManager) Find(id string) (*SessionReturn, error) {
 		sessionId: id,
 		ret:       ch,
 	}
-	self.out <- pkt
-	s := <-ch
-	close(ch)
+	return self.send(pkt)
+}
+
+//send gives the packet to the goroutine that owns the sessions and waits for
+//the answer.
+func (self *SimpleSessionManager) send(pkt *sessionPacket) (*SessionReturn, error) {
+	select {
+	case self.out <- pkt:
+	case <-self.done:
+		return nil, SESSIONS_CLOSED
+	}
+	sr := <-pkt.ret
+	close(pkt.ret)
+	return sr, nil
+}
 
-	return s, nil
+//Close stops the session manager; all the sessions are forgotten and later
+//calls return SESSIONS_CLOSED.  It is safe to call Close more than once.
+func (self *SimpleSessionManager) Close() error {
+	self.closeOnce.Do(func() {
+		close(self.done)
+	})
+	return nil
 }
 
 //given a uniqueId, compute a related blob of stuff that can be used to
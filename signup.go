@@ -0,0 +1,223 @@
+package seven5
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	VERIFICATION_TTL = 48 * time.Hour
+
+	s5VerifyPrefix = "verify:"
+
+	DEFAULT_VERIFY_SUBJECT = "Please confirm your email address"
+	DEFAULT_VERIFY_BODY    = `Welcome {{.Username}}!
+
+Please confirm your email address by following this link before {{.Expires.Format "Jan 2 15:04 MST"}}:
+
+{{.Link}}
+
+If you did not create an account, you can ignore this message.
+`
+)
+
+//SignupSessionManager is an optional extension of ValidatingSessionManager
+//that allows users to create their own accounts with AUTH_OP_SIGNUP.
+//CreateAccount should store the new user, with the password hashed (see
+//PasswordHasher), and return their unique id.  If the username is taken it
+//should return an HTTPError with status 409 (Conflict).  MarkVerified is
+//called when the user follows the link in the verification email and
+//IsVerified is consulted at login if SetMustVerify(true) has been called.
+//DeleteAccount removes an account that was just created when users must
+//verify but the verification email could not be sent, so that the user can
+//sign up again rather than being left with an account they can never use.
+type SignupSessionManager interface {
+	ValidatingSessionManager
+	CreateAccount(username, email, password string) (string, error)
+	MarkVerified(uniq string) error
+	IsVerified(uniq string) (bool, error)
+	DeleteAccount(uniq string) error
+}
+
+//VerificationMail is the data available to the templates of the
+//verification email.
+type VerificationMail struct {
+	Username string
+	Link     string
+	Expires  time.Time
+}
+
+//VerificationMailer sends the email that confirms a new user owns their email
+//address.  The email contains a link to linkBase with a signed token holding
+//the user's unique id; the page at linkBase should send that token back as the
+//VerifyToken of an AUTH_OP_VERIFY.  Tokens expire after VERIFICATION_TTL.
+type VerificationMailer struct {
+	mailer   Mailer
+	codec    TokenCodec
+	from     string
+	linkBase string
+	tmpl     *mailTemplate
+}
+
+//NewVerificationMailer returns a VerificationMailer that sends mail from the
+//given address with links to linkBase, such as "https://example.com/verify".
+//Like NewPasswordResetMailer, it is best to give this a codec with its own key.
+func NewVerificationMailer(m Mailer, codec TokenCodec, from string, linkBase string) *VerificationMailer {
+	result := &VerificationMailer{
+		mailer:   m,
+		codec:    codec,
+		from:     from,
+		linkBase: linkBase,
+	}
+	if err := result.SetTemplates(DEFAULT_VERIFY_SUBJECT, DEFAULT_VERIFY_BODY); err != nil {
+		panic(fmt.Sprintf("default verification templates are broken: %v", err))
+	}
+	return result
+}
+
+//SetTemplates replaces the subject and body of the verification email.  Both
+//are text/templates executed with a VerificationMail.
+func (self *VerificationMailer) SetTemplates(subject string, body string) error {
+	t, err := newMailTemplate(subject, body)
+	if err != nil {
+		return err
+	}
+	self.tmpl = t
+	return nil
+}
+
+//Send mails the verification link for the user to the address provided.
+func (self *VerificationMailer) Send(address string, username string, uniq string) error {
+	expires := time.Now().Add(VERIFICATION_TTL)
+	link, err := signedLink(self.codec, self.linkBase, s5VerifyPrefix+uniq, expires)
+	if err != nil {
+		return err
+	}
+	msg, err := self.tmpl.message(self.from, address, &VerificationMail{Username: username, Link: link, Expires: expires})
+	if err != nil {
+		return err
+	}
+	return self.mailer.Send(msg)
+}
+
+//Open checks the token from a verification link and returns the unique id
+//inside it.
+func (self *VerificationMailer) Open(token string) (string, error) {
+	raw, err := self.codec.Decode(token)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(raw, s5VerifyPrefix) {
+		return "", BAD_TOKEN
+	}
+	return raw[len(s5VerifyPrefix):], nil
+}
+
+//
+// SetVerificationMailer makes AUTH_OP_SIGNUP send a verification email to the
+// new user.  The ValidatingSessionManager must also be a SignupSessionManager,
+// otherwise this panics.  It also panics if vm is nil while users must verify
+// (see SetMustVerify).
+//
+func (self *SimplePasswordHandler) SetVerificationMailer(vm *VerificationMailer) {
+	if _, ok := self.vsm.(SignupSessionManager); !ok && vm != nil {
+		panic("SetVerificationMailer requires a SignupSessionManager")
+	}
+	if vm == nil && self.mustVerify {
+		panic("users must verify, so a VerificationMailer is required")
+	}
+	self.verifier = vm
+}
+
+//
+// SetMustVerify controls whether users must verify their email address before
+// they can log in.  The default is false, and new users are logged in as soon
+// as they sign up.  The ValidatingSessionManager must also be a
+// SignupSessionManager and a VerificationMailer must have been set with
+// SetVerificationMailer, since otherwise no one could ever log in; if not,
+// this panics.
+//
+func (self *SimplePasswordHandler) SetMustVerify(must bool) {
+	if _, ok := self.vsm.(SignupSessionManager); !ok && must {
+		panic("SetMustVerify requires a SignupSessionManager")
+	}
+	if must && self.verifier == nil {
+		panic("SetMustVerify requires a VerificationMailer (see SetVerificationMailer) to send the links")
+	}
+	self.mustVerify = must
+}
+
+//signup handles AUTH_OP_SIGNUP.  If we must verify, the result tells the
+//client that the user needs to check their email, otherwise the new user is
+//logged in.  If we must verify and the email cannot be sent, the account is
+//deleted and the signup fails with a 503.
+func (self *SimplePasswordHandler) signup(w http.ResponseWriter, auth *PasswordAuthParameters) {
+	ssm, ok := self.vsm.(SignupSessionManager)
+	if !ok {
+		http.Error(w, "signup not supported", http.StatusNotImplemented)
+		return
+	}
+	if strings.TrimSpace(auth.Username) == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+	if self.policy != nil {
+		if err := self.policy.Check(auth.Password); err != nil {
+			WriteError(w, err)
+			return
+		}
+	}
+	address := auth.Email
+	if address == "" {
+		address = auth.Username
+	}
+	uniq, err := ssm.CreateAccount(auth.Username, auth.Email, auth.Password)
+	if err != nil {
+		log.Printf("[AUTH] unable to create account for %s: %v", auth.Username, err)
+		WriteError(w, err)
+		return
+	}
+	log.Printf("[AUTH] created account for %s", auth.Username)
+	if self.verifier != nil {
+		if err := self.verifier.Send(address, auth.Username, uniq); err != nil {
+			log.Printf("[AUTH] unable to mail verification to %s: %v", auth.Username, err)
+			if self.mustVerify {
+				//the user could never log in, so the signup did not happen
+				if err := ssm.DeleteAccount(uniq); err != nil {
+					log.Printf("[AUTH] unable to delete unverifiable account %s: %v", auth.Username, err)
+				}
+				http.Error(w, "unable to send the verification email, try again later", http.StatusServiceUnavailable)
+				return
+			}
+		}
+	}
+	if self.mustVerify {
+		SendJson(w, &PasswordAuthResult{VerificationRequired: true})
+		return
+	}
+	self.login(w, auth)
+}
+
+//verify handles AUTH_OP_VERIFY.
+func (self *SimplePasswordHandler) verify(w http.ResponseWriter, auth *PasswordAuthParameters) {
+	if self.verifier == nil {
+		http.Error(w, "verification not supported", http.StatusNotImplemented)
+		return
+	}
+	uniq, err := self.verifier.Open(auth.VerifyToken)
+	if err != nil {
+		http.Error(w, "verification link is invalid or has expired", http.StatusUnauthorized)
+		return
+	}
+	if err := self.vsm.(SignupSessionManager).MarkVerified(uniq); err != nil {
+		log.Printf("[AUTH] unable to mark %s verified: %v", uniq, err)
+		WriteError(w, err)
+		return
+	}
+	log.Printf("[AUTH] user %s verified their email address", uniq)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{}")) //need to prevent the client-side dying
+}
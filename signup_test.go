@@ -0,0 +1,146 @@
+package seven5
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+type testSignup struct {
+	*testTwoFactor
+	accounts map[string]string
+	verified map[string]bool
+}
+
+func (self *testSignup) ValidateCredentials(username, pwd string) (string, interface{}, error) {
+	if p, ok := self.accounts[username]; !ok || p != pwd {
+		return "", nil, nil
+	}
+	return username, username, nil
+}
+func (self *testSignup) CreateAccount(username, email, pwd string) (string, error) {
+	if _, ok := self.accounts[username]; ok {
+		return "", HTTPError(http.StatusConflict, "username is taken")
+	}
+	self.accounts[username] = pwd
+	return username, nil
+}
+func (self *testSignup) MarkVerified(uniq string) error {
+	self.verified[uniq] = true
+	return nil
+}
+func (self *testSignup) IsVerified(uniq string) (bool, error) {
+	return self.verified[uniq], nil
+}
+func (self *testSignup) DeleteAccount(uniq string) error {
+	delete(self.accounts, uniq)
+	delete(self.verified, uniq)
+	return nil
+}
+
+type brokenMailer struct{}
+
+func (self brokenMailer) Send(msg *MailMessage) error {
+	return errors.New("mail server is down")
+}
+
+func TestSignupVerification(t *testing.T) {
+	sm := NewDumbSessionManager()
+	vsm := &testSignup{
+		testTwoFactor: &testTwoFactor{SimpleSessionManager: sm},
+		accounts:      make(map[string]string),
+		verified:      make(map[string]bool),
+	}
+	outbox := NewOutboxMailer("")
+	h := NewSimplePasswordHandler(vsm, NewSimpleCookieMapper("myapp"))
+	h.SetPasswordPolicy(DefaultPasswordPolicy())
+	h.SetVerificationMailer(NewVerificationMailer(outbox, NewSimpleTokenCodec([]byte("verify key")), "noreply@example.com", "https://example.com/verify"))
+	h.SetMustVerify(true)
+	signup := &PasswordAuthParameters{Op: AUTH_OP_SIGNUP, Username: "fred", Email: "fred@example.com", Password: "yabba dabba doo"}
+
+	w := authRequest(t, h, nil, &PasswordAuthParameters{Op: AUTH_OP_SIGNUP, Username: "fred", Password: "short"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected weak password to be refused, got %d", w.Code)
+	}
+	w = authRequest(t, h, nil, signup)
+	var result PasswordAuthResult
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil || !result.VerificationRequired {
+		t.Fatalf("expected verification to be required (%d): %v", w.Code, err)
+	}
+	if len(w.HeaderMap["Set-Cookie"]) != 0 {
+		t.Errorf("did not expect to be logged in before verifying")
+	}
+	if w = authRequest(t, h, nil, signup); w.Code != http.StatusConflict {
+		t.Errorf("expected duplicate signup to be refused, got %d", w.Code)
+	}
+	login := &PasswordAuthParameters{Op: AUTH_OP_LOGIN, Username: "fred", Password: "yabba dabba doo"}
+	if w = authRequest(t, h, nil, login); w.Code != http.StatusForbidden {
+		t.Errorf("expected unverified login to be refused, got %d", w.Code)
+	}
+
+	msg := outbox.Last()
+	if msg == nil || msg.To[0] != "fred@example.com" {
+		t.Fatalf("expected verification mail to fred, got %+v", msg)
+	}
+	u, _ := url.Parse(regexp.MustCompile(`https://example.com/verify\?t=\S+`).FindString(msg.Text))
+	w = authRequest(t, h, nil, &PasswordAuthParameters{Op: AUTH_OP_VERIFY, VerifyToken: "s5t.bogus.token"})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected bad token to be refused, got %d", w.Code)
+	}
+	w = authRequest(t, h, nil, &PasswordAuthParameters{Op: AUTH_OP_VERIFY, VerifyToken: u.Query().Get("t")})
+	if w.Code != http.StatusOK || !vsm.verified["fred"] {
+		t.Fatalf("expected verification to succeed, got %d", w.Code)
+	}
+	if w = authRequest(t, h, nil, login); w.Code != http.StatusOK {
+		t.Errorf("expected verified login to succeed, got %d", w.Code)
+	}
+
+	//without must verify, signup logs you in
+	h.SetMustVerify(false)
+	signup.Username = "barney"
+	w = authRequest(t, h, nil, signup)
+	if w.Code != http.StatusOK || setCookieFromRecorder(t, w) == nil {
+		t.Errorf("expected signup to log in, got %d", w.Code)
+	}
+}
+
+func TestMustVerifyNeedsMailer(t *testing.T) {
+	vsm := &testSignup{testTwoFactor: &testTwoFactor{SimpleSessionManager: NewDumbSessionManager()}}
+	h := NewSimplePasswordHandler(vsm, NewSimpleCookieMapper("myapp"))
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected SetMustVerify to panic without a VerificationMailer")
+		}
+	}()
+	h.SetMustVerify(true)
+}
+
+func TestSignupMailFailure(t *testing.T) {
+	vsm := &testSignup{
+		testTwoFactor: &testTwoFactor{SimpleSessionManager: NewDumbSessionManager()},
+		accounts:      make(map[string]string),
+		verified:      make(map[string]bool),
+	}
+	h := NewSimplePasswordHandler(vsm, NewSimpleCookieMapper("myapp"))
+	codec := NewSimpleTokenCodec([]byte("verify key"))
+	h.SetVerificationMailer(NewVerificationMailer(brokenMailer{}, codec, "noreply@example.com", "https://example.com/verify"))
+	h.SetMustVerify(true)
+	signup := &PasswordAuthParameters{Op: AUTH_OP_SIGNUP, Username: "fred", Email: "fred@example.com", Password: "yabba dabba doo"}
+
+	if w := authRequest(t, h, nil, signup); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected signup to fail when the mail cannot be sent, got %d", w.Code)
+	}
+	if _, ok := vsm.accounts["fred"]; ok {
+		t.Errorf("expected the unverifiable account to be deleted")
+	}
+	outbox := NewOutboxMailer("")
+	h.SetVerificationMailer(NewVerificationMailer(outbox, codec, "noreply@example.com", "https://example.com/verify"))
+	w := authRequest(t, h, nil, signup)
+	var result PasswordAuthResult
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil || !result.VerificationRequired || outbox.Last() == nil {
+		t.Errorf("expected the user to be able to sign up again (%d): %v", w.Code, err)
+	}
+}
@@ -86,12 +86,13 @@ func GopathSearch(desired string) string {
 }
 
 //ServeHTTP retuns a static file or a not found error. This function meets
-//the requirement of net/http#Handler.
+//the requirement of net/http#Handler.  In html files, CSP_NONCE_PLACEHOLDER
+//is replaced by the nonce of the request; see SecurityHandler.
 func (s *SimpleStaticFilesServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if s.testMode && strings.HasPrefix(r.URL.String(), GOPATH_PREFIX) {
 		GopathLookup(w, r, strings.TrimPrefix(r.URL.String(), GOPATH_PREFIX))
 		return
 	}
 	log.Printf("[STATIC CONTENT (%s)]: %v", s.staticDir, r.URL.String())
-	s.fs.ServeHTTP(w, r)
+	servePage(s.fs, w, r)
 }
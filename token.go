@@ -0,0 +1,107 @@
+package seven5
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s5TokenPrefix = "s5t" //lets us tell a token from a raw session id at a glance
+)
+
+var (
+	BAD_TOKEN     = errors.New("Token is badly formed or has a bad signature")
+	EXPIRED_TOKEN = errors.New("Token has expired")
+)
+
+//TokenCodec converts between session ids and the bearer tokens that are given
+//to clients that cannot keep cookies, such as command line tools or mobile
+//applications.  Encode is called by SimplePasswordHandler on a successful login
+//and Decode is called by BearerExtractor on each request.  Decode must refuse
+//tokens that have been tampered with or have expired.
+type TokenCodec interface {
+	Encode(sessionId string, expires time.Time) (string, error)
+	Decode(token string) (string, error)
+}
+
+//SimpleTokenCodec is the default TokenCodec. Tokens are the session id and
+//the expiration time, signed with HMAC-SHA256.  The session id is not
+//encrypted by the codec because the SimpleSessionManager already encrypts
+//the unique id it contains.
+type SimpleTokenCodec struct {
+	key []byte
+}
+
+//NewSimpleTokenCodec returns a SimpleTokenCodec that signs with a key derived
+//from the key provided.  The same key must be used on all servers that should
+//accept the token.
+func NewSimpleTokenCodec(key []byte) *SimpleTokenCodec {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("seven5 token signing key"))
+	return &SimpleTokenCodec{key: mac.Sum(nil)}
+}
+
+//NewSimpleTokenCodecFromEnv returns a SimpleTokenCodec whose key is derived
+//from the environment variable SERVER_SESSION_KEY, the same key used by the
+//SimpleSessionManager.  Like NewSimpleSessionManager, this exits if that
+//variable is missing or malformed.
+func NewSimpleTokenCodecFromEnv() *SimpleTokenCodec {
+	return NewSimpleTokenCodec(serverSessionKey())
+}
+
+func (self *SimpleTokenCodec) sign(payload string) string {
+	mac := hmac.New(sha256.New, self.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+//Encode returns a token of the form s5t.payload.signature, where the payload
+//holds the session id and expiration time.  If expires is the zero time, the
+//token expires in one day, like sessions from SimpleSessionManager.
+func (self *SimpleTokenCodec) Encode(sessionId string, expires time.Time) (string, error) {
+	if sessionId == "" {
+		return "", errors.New("cannot create a token for an empty session id")
+	}
+	if expires.IsZero() {
+		expires = time.Now().Add(24 * time.Hour)
+	}
+	raw := fmt.Sprintf("%s,%d", sessionId, expires.Unix())
+	payload := base64.RawURLEncoding.EncodeToString([]byte(raw))
+	return s5TokenPrefix + "." + payload + "." + self.sign(payload), nil
+}
+
+//Decode checks the signature and expiration time of the token and returns
+//the session id inside it.  It returns BAD_TOKEN or EXPIRED_TOKEN if the token
+//cannot be used.
+func (self *SimpleTokenCodec) Decode(token string) (string, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 || parts[0] != s5TokenPrefix {
+		return "", BAD_TOKEN
+	}
+	if !hmac.Equal([]byte(self.sign(parts[1])), []byte(parts[2])) {
+		return "", BAD_TOKEN
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", BAD_TOKEN
+	}
+	s := string(raw)
+	comma := strings.LastIndex(s, ",")
+	if comma <= 0 {
+		return "", BAD_TOKEN
+	}
+	t, err := strconv.ParseInt(s[comma+1:], 10, 64)
+	if err != nil {
+		return "", BAD_TOKEN
+	}
+	if time.Unix(t, 0).Before(time.Now()) {
+		return "", EXPIRED_TOKEN
+	}
+	return s[:comma], nil
+}
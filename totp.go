@@ -0,0 +1,152 @@
+package seven5
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	TOTP_PERIOD         = 30 //seconds
+	TOTP_DIGITS         = 6
+	TOTP_SKEW           = 1 //periods either side of now that are accepted
+	TOTP_RECOVERY_CODES = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//NewTOTPSecret returns a new random secret for RFC 6238 one time passwords,
+//in the base32 form that authenticator apps expect.
+func NewTOTPSecret() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		log.Panicf("failed to read the random stream: %v", err)
+	}
+	return totpEncoding.EncodeToString(b)
+}
+
+//TOTPCode returns the one time password for the secret at time t, using
+//HMAC-SHA1, TOTP_PERIOD and TOTP_DIGITS as most authenticator apps do.
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", fmt.Errorf("TOTP secret is not base32: %v", err)
+	}
+	return hotp(key, uint64(t.Unix()/TOTP_PERIOD)), nil
+}
+
+//hotp is the RFC 4226 algorithm that TOTP is built on.
+func hotp(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, bin%mod)
+}
+
+//VerifyTOTP returns true if code is the one time password for the secret at
+//time t, or within TOTP_SKEW periods of it to allow for clock drift.  A code
+//verified this way can be used again until it is out of the window; use
+//TOTPStep to refuse codes that have been used.
+func VerifyTOTP(secret string, code string, t time.Time) bool {
+	return TOTPStep(secret, code, t) >= 0
+}
+
+//TOTPStep returns the time step (counter) of code if it is the one time
+//password for the secret within TOTP_SKEW periods of time t, or -1 if it is
+//not.  Recording the last step accepted for a user and refusing steps that
+//are not after it stops a code being replayed within its window.
+func TOTPStep(secret string, code string, t time.Time) int64 {
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	if len(code) != TOTP_DIGITS {
+		return -1
+	}
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return -1
+	}
+	now := t.Unix() / TOTP_PERIOD
+	for i := int64(-TOTP_SKEW); i <= TOTP_SKEW; i++ {
+		step := now + i
+		if step < 0 {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(step))), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return -1
+}
+
+//TOTPProvisioningURI returns the otpauth:// URI that authenticator apps read,
+//usually from a QR code, to enroll a secret.  The issuer is the name of the
+//application and the account is usually the user's email address.
+func TOTPProvisioningURI(issuer, account, secret string) string {
+	v := url.Values{
+		"secret":    []string{secret},
+		"issuer":    []string{issuer},
+		"algorithm": []string{"SHA1"},
+		"digits":    []string{fmt.Sprint(TOTP_DIGITS)},
+		"period":    []string{fmt.Sprint(TOTP_PERIOD)},
+	}
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, v.Encode())
+}
+
+//NewRecoveryCodes returns n random recovery codes of the form xxxxx-xxxxx.
+//These are shown to the user once, and only HashRecoveryCode of each should
+//be stored.
+func NewRecoveryCodes(n int) []string {
+	result := make([]string, n)
+	for i := range result {
+		h := randomHex(5)
+		result[i] = h[:5] + "-" + h[5:]
+	}
+	return result
+}
+
+//HashRecoveryCode returns the form of a recovery code that should be stored
+//and compared.  Case, spaces and dashes in the code are ignored.
+func HashRecoveryCode(code string) string {
+	clean := strings.ToLower(code)
+	clean = strings.Replace(clean, "-", "", -1)
+	clean = strings.Replace(clean, " ", "", -1)
+	sum := sha256.Sum256([]byte(clean))
+	return hex.EncodeToString(sum[:])
+}
+
+//TOTPEnrollment is the information the user needs to set up an authenticator
+//app: the secret, the same secret as a provisioning URI (for a QR code) and
+//the recovery codes to use if the authenticator is lost.
+type TOTPEnrollment struct {
+	Secret        string
+	URI           string
+	RecoveryCodes []string
+}
+
+//NewTOTPEnrollment returns a new secret and recovery codes for the account.
+func NewTOTPEnrollment(issuer, account string) *TOTPEnrollment {
+	secret := NewTOTPSecret()
+	return &TOTPEnrollment{
+		Secret:        secret,
+		URI:           TOTPProvisioningURI(issuer, account, secret),
+		RecoveryCodes: NewRecoveryCodes(TOTP_RECOVERY_CODES),
+	}
+}
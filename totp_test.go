@@ -0,0 +1,192 @@
+package seven5
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//RFC 6238 appendix B uses the ascii secret "12345678901234567890" and 8
+//digits; we use 6, which is the last 6 digits of the same codes.
+func TestTOTPVectors(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, expected := range vectors {
+		code, err := TOTPCode(secret, time.Unix(unix, 0))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if code != expected {
+			t.Errorf("at %d expected %s but got %s", unix, expected, code)
+		}
+	}
+}
+
+func TestTOTPVerify(t *testing.T) {
+	secret := NewTOTPSecret()
+	now := time.Now()
+	code, _ := TOTPCode(secret, now)
+	if !VerifyTOTP(secret, code, now.Add(TOTP_PERIOD*time.Second)) {
+		t.Errorf("expected code from the previous period to be accepted")
+	}
+	if VerifyTOTP(secret, code, now.Add(3*TOTP_PERIOD*time.Second)) {
+		t.Errorf("expected code from long ago to be refused")
+	}
+	if VerifyTOTP(secret, "", now) || VerifyTOTP("not base32!", code, now) {
+		t.Errorf("expected bad input to be refused")
+	}
+	if HashRecoveryCode("ABCDE-12345") != HashRecoveryCode("abcde12345") {
+		t.Errorf("expected recovery codes to ignore case and dashes")
+	}
+}
+
+type testTwoFactor struct {
+	*SimpleSessionManager
+	secret   string
+	recovery map[string]bool
+}
+
+func (self *testTwoFactor) ValidateCredentials(username, pwd string) (string, interface{}, error) {
+	if pwd != "secret" {
+		return "", nil, nil
+	}
+	return username, username, nil
+}
+func (self *testTwoFactor) SendUserDetails(i interface{}, w http.ResponseWriter) error {
+	return SendJson(w, i)
+}
+func (self *testTwoFactor) GenerateResetRequest(string) (string, error)          { return "", nil }
+func (self *testTwoFactor) UseResetRequest(string, string, string) (bool, error) { return false, nil }
+func (self *testTwoFactor) TOTPSecret(uniq string) (string, error)               { return self.secret, nil }
+func (self *testTwoFactor) EnrollTOTP(ud interface{}, secret string, hashes []string) error {
+	self.secret = secret
+	self.recovery = make(map[string]bool)
+	for _, h := range hashes {
+		self.recovery[h] = true
+	}
+	return nil
+}
+func (self *testTwoFactor) UseRecoveryCode(uniq string, hash string) (bool, error) {
+	ok := self.recovery[hash]
+	delete(self.recovery, hash)
+	return ok, nil
+}
+
+func authRequest(t *testing.T, h *SimplePasswordHandler, c *http.Cookie, params *PasswordAuthParameters) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(params)
+	r, _ := http.NewRequest("POST", "/auth", strings.NewReader(string(b)))
+	if c != nil {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	h.AuthHandler(w, r)
+	return w
+}
+
+func TestTOTPLogin(t *testing.T) {
+	sm := NewDumbSessionManager()
+	sm.generator = &testGen{}
+	tf := &testTwoFactor{SimpleSessionManager: sm}
+	cm := NewSimpleCookieMapper("myapp")
+	h := NewSimplePasswordHandler(tf, cm)
+	login := &PasswordAuthParameters{Op: AUTH_OP_LOGIN, Username: "fred", Password: "secret"}
+
+	//not enrolled, so logged in with just the password
+	w := authRequest(t, h, nil, login)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected login to succeed, got %d", w.Code)
+	}
+	full := setCookieFromRecorder(t, w)
+
+	w = authRequest(t, h, full, &PasswordAuthParameters{Op: AUTH_OP_TOTP_ENROLL, Username: "fred"})
+	var e TOTPEnrollment
+	if err := json.NewDecoder(w.Body).Decode(&e); err != nil || e.Secret == "" {
+		t.Fatalf("unable to start enrollment (%d): %v", w.Code, err)
+	}
+	if !strings.HasPrefix(e.URI, "otpauth://totp/") || len(e.RecoveryCodes) != TOTP_RECOVERY_CODES {
+		t.Errorf("bad enrollment: %+v", e)
+	}
+	w = authRequest(t, h, full, &PasswordAuthParameters{Op: AUTH_OP_TOTP_CONFIRM, Code: "000000x"})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected bad code to be refused, got %d", w.Code)
+	}
+	code, _ := TOTPCode(e.Secret, time.Now())
+	w = authRequest(t, h, full, &PasswordAuthParameters{Op: AUTH_OP_TOTP_CONFIRM, Code: code})
+	if w.Code != http.StatusOK || tf.secret != e.Secret {
+		t.Fatalf("expected enrollment to be confirmed, got %d", w.Code)
+	}
+
+	//now the password is not enough
+	w = authRequest(t, h, nil, login)
+	var result PasswordAuthResult
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil || !result.SecondFactorRequired {
+		t.Fatalf("expected second factor to be required (%d): %v", w.Code, err)
+	}
+	pending := setCookieFromRecorder(t, w)
+	session, _, _ := ResolveCredential(sm, &Credential{SessionId: pending.Value})
+	if session != nil {
+		t.Errorf("half-authenticated session should not resolve")
+	}
+	w = authRequest(t, h, pending, &PasswordAuthParameters{Op: AUTH_OP_TOTP_VERIFY, RecoveryCode: e.RecoveryCodes[0]})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected recovery code to be accepted, got %d", w.Code)
+	}
+	session, _, _ = ResolveCredential(sm, &Credential{SessionId: setCookieFromRecorder(t, w).Value})
+	if session == nil || session.UserData() != "fred" {
+		t.Errorf("expected to be logged in as fred, got %v", session)
+	}
+
+	//recovery codes only work once and too many attempts end the login
+	w = authRequest(t, h, nil, login)
+	pending = setCookieFromRecorder(t, w)
+	for i := 0; i < SECOND_FACTOR_ATTEMPTS; i++ {
+		w = authRequest(t, h, pending, &PasswordAuthParameters{Op: AUTH_OP_TOTP_VERIFY, RecoveryCode: e.RecoveryCodes[0]})
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected used recovery code to be refused, got %d", w.Code)
+		}
+	}
+	code, _ = TOTPCode(e.Secret, time.Now())
+	w = authRequest(t, h, pending, &PasswordAuthParameters{Op: AUTH_OP_TOTP_VERIFY, Code: code})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected login to be abandoned after too many attempts, got %d", w.Code)
+	}
+}
+
+func TestTOTPReplay(t *testing.T) {
+	sm := NewDumbSessionManager()
+	sm.generator = &testGen{}
+	tf := &testTwoFactor{SimpleSessionManager: sm, secret: NewTOTPSecret()}
+	h := NewSimplePasswordHandler(tf, NewSimpleCookieMapper("myapp"))
+	login := &PasswordAuthParameters{Op: AUTH_OP_LOGIN, Username: "fred", Password: "secret"}
+	code, _ := TOTPCode(tf.secret, time.Now())
+
+	w := authRequest(t, h, nil, login)
+	w = authRequest(t, h, setCookieFromRecorder(t, w), &PasswordAuthParameters{Op: AUTH_OP_TOTP_VERIFY, Code: code})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the code to be accepted, got %d", w.Code)
+	}
+	//the same code, still in its window, is refused
+	w = authRequest(t, h, nil, login)
+	w = authRequest(t, h, setCookieFromRecorder(t, w), &PasswordAuthParameters{Op: AUTH_OP_TOTP_VERIFY, Code: code})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a replayed code to be refused, got %d", w.Code)
+	}
+
+	//Check does not skip the second factor
+	session, err := h.Check("fred", "secret")
+	if err != nil || !IsPendingSecondFactor(session) {
+		t.Errorf("expected Check to return a half-authenticated session, got %v (%v)", session, err)
+	}
+	if session, err := h.Check("fred", "wrong"); session != nil || err != nil {
+		t.Errorf("expected a wrong password to fail, got %v (%v)", session, err)
+	}
+}
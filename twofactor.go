@@ -0,0 +1,235 @@
+package seven5
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SECOND_FACTOR_TIMEOUT  = 5 * time.Minute
+	SECOND_FACTOR_ATTEMPTS = 5
+
+	s5PendingPrefix = "s5-2fa:" //unique ids of half-authenticated sessions
+)
+
+//TwoFactorSessionManager is an optional extension of ValidatingSessionManager
+//for applications that allow users to protect their account with a second
+//factor (TOTP).  If the ValidatingSessionManager given to SimplePasswordHandler
+//implements this interface, users that have a TOTP secret must supply a code
+//after their password before they are logged in.  TOTPSecret should return ""
+//for users that have not enrolled.  EnrollTOTP is given the user data of the
+//(fully logged in) session and should store the secret and the hashes of the
+//recovery codes (see HashRecoveryCode) for that user.  UseRecoveryCode should
+//return true, and forget the hash, if the user has such a recovery code.
+type TwoFactorSessionManager interface {
+	ValidatingSessionManager
+	TOTPSecret(uniq string) (string, error)
+	EnrollTOTP(userData interface{}, secret string, recoveryCodeHashes []string) error
+	UseRecoveryCode(uniq string, recoveryCodeHash string) (bool, error)
+}
+
+//TOTPStepSessionManager is an optional extension of TwoFactorSessionManager
+//that keeps the time step (see TOTPStep) of the last TOTP code accepted for
+//each user.  UseTOTPStep should return false if step is not after the last
+//step stored for uniq, and otherwise store it and return true.  Without it,
+//SimplePasswordHandler keeps the steps in memory, which stops a code being
+//replayed to this process but not to another instance or after a restart.
+type TOTPStepSessionManager interface {
+	TwoFactorSessionManager
+	UseTOTPStep(uniq string, step int64) (bool, error)
+}
+
+//PendingSecondFactor is the user data of a half-authenticated session: the
+//user has supplied the correct password but not yet the second factor.  Such
+//sessions are never considered logged in by RawIOHook, MeHandler or the
+//SimpleComponentMatcher.  They expire after SECOND_FACTOR_TIMEOUT or after
+//SECOND_FACTOR_ATTEMPTS wrong codes.
+type PendingSecondFactor struct {
+	UniqueId string
+	UserData interface{}
+	attempts int32
+}
+
+//IsPendingSecondFactor returns true if s is a half-authenticated session.
+func IsPendingSecondFactor(s Session) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := s.UserData().(*PendingSecondFactor)
+	return ok
+}
+
+//verifySecondFactor completes the login of a half-authenticated session if the
+//client supplied a correct TOTP code or recovery code.
+func (self *SimplePasswordHandler) verifySecondFactor(w http.ResponseWriter, auth *PasswordAuthParameters, val string) {
+	tf, ok := self.vsm.(TwoFactorSessionManager)
+	if !ok {
+		http.Error(w, "second factor not supported", http.StatusNotImplemented)
+		return
+	}
+	sr, err := self.vsm.Find(val)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	if sr == nil || !IsPendingSecondFactor(sr.Session) {
+		http.Error(w, "no login waiting for a second factor", http.StatusUnauthorized)
+		return
+	}
+	pending := sr.Session.UserData().(*PendingSecondFactor)
+	if atomic.AddInt32(&pending.attempts, 1) > SECOND_FACTOR_ATTEMPTS {
+		self.vsm.Destroy(val)
+		self.cm.RemoveCookie(w)
+		http.Error(w, "too many attempts", http.StatusUnauthorized)
+		return
+	}
+	var verified bool
+	if auth.RecoveryCode != "" {
+		verified, err = tf.UseRecoveryCode(pending.UniqueId, HashRecoveryCode(auth.RecoveryCode))
+	} else {
+		var secret string
+		secret, err = tf.TOTPSecret(pending.UniqueId)
+		if err == nil && secret != "" {
+			if step := TOTPStep(secret, auth.Code, time.Now()); step >= 0 {
+				verified, err = self.useTOTPStep(pending.UniqueId, step)
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("[AUTH] error checking second factor: %v", err)
+		WriteError(w, err)
+		return
+	}
+	if !verified {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	self.vsm.Destroy(val)
+	session, err := self.vsm.Assign(pending.UniqueId, pending.UserData, time.Time{})
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	log.Printf("[AUTH] user %s is authenticated with a second factor", pending.UniqueId)
+	self.sendLoginResult(w, pending.UniqueId, session, false)
+}
+
+//useTOTPStep returns true if step is after the last TOTP step accepted for
+//the user, recording it, so that each code is only accepted once.
+func (self *SimplePasswordHandler) useTOTPStep(uniq string, step int64) (bool, error) {
+	if sm, ok := self.vsm.(TOTPStepSessionManager); ok {
+		return sm.UseTOTPStep(uniq, step)
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if last, ok := self.totpSteps[uniq]; ok && step <= last {
+		return false, nil
+	}
+	self.totpSteps[uniq] = step
+	//steps from before the window can no longer be replayed
+	oldest := time.Now().Unix()/TOTP_PERIOD - TOTP_SKEW
+	for k, v := range self.totpSteps {
+		if v < oldest {
+			delete(self.totpSteps, k)
+		}
+	}
+	return true, nil
+}
+
+//fullSession returns the logged in (not half-authenticated) session with the
+//given id or nil.
+func (self *SimplePasswordHandler) fullSession(val string) (Session, error) {
+	if val == "" {
+		return nil, nil
+	}
+	s, _, err := ResolveCredential(self.vsm, &Credential{SessionId: val})
+	return s, err
+}
+
+//enrollTOTP starts the enrollment of a logged in user by generating a secret
+//and recovery codes.  These are not stored until confirmTOTP is called with a
+//correct code, proving the user's authenticator app has the secret.
+func (self *SimplePasswordHandler) enrollTOTP(w http.ResponseWriter, r *http.Request, auth *PasswordAuthParameters, val string) {
+	if _, ok := self.vsm.(TwoFactorSessionManager); !ok {
+		http.Error(w, "second factor not supported", http.StatusNotImplemented)
+		return
+	}
+	session, err := self.fullSession(val)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	if session == nil {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		return
+	}
+	issuer := self.issuer
+	if issuer == "" {
+		issuer = r.Host
+	}
+	account := auth.Username
+	if account == "" {
+		account = fmt.Sprint(session.UserData())
+	}
+	e := NewTOTPEnrollment(issuer, account)
+	self.lock.Lock()
+	self.enrolling[val] = &pendingEnrollment{e, time.Now()}
+	for k, v := range self.enrolling {
+		if time.Since(v.started) > SECOND_FACTOR_TIMEOUT {
+			delete(self.enrolling, k)
+		}
+	}
+	self.lock.Unlock()
+	SendJson(w, e)
+}
+
+//confirmTOTP finishes an enrollment started with enrollTOTP.
+func (self *SimplePasswordHandler) confirmTOTP(w http.ResponseWriter, auth *PasswordAuthParameters, val string) {
+	tf, ok := self.vsm.(TwoFactorSessionManager)
+	if !ok {
+		http.Error(w, "second factor not supported", http.StatusNotImplemented)
+		return
+	}
+	session, err := self.fullSession(val)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	if session == nil {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		return
+	}
+	self.lock.Lock()
+	pe, ok := self.enrolling[val]
+	self.lock.Unlock()
+	if !ok || time.Since(pe.started) > SECOND_FACTOR_TIMEOUT {
+		http.Error(w, "no enrollment in progress", http.StatusBadRequest)
+		return
+	}
+	if !VerifyTOTP(pe.enrollment.Secret, auth.Code, time.Now()) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	hashes := make([]string, len(pe.enrollment.RecoveryCodes))
+	for i, c := range pe.enrollment.RecoveryCodes {
+		hashes[i] = HashRecoveryCode(c)
+	}
+	if err := tf.EnrollTOTP(session.UserData(), pe.enrollment.Secret, hashes); err != nil {
+		log.Printf("[AUTH] unable to store TOTP enrollment: %v", err)
+		WriteError(w, err)
+		return
+	}
+	self.lock.Lock()
+	delete(self.enrolling, val)
+	self.lock.Unlock()
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{}")) //need to prevent the client-side dying
+}
+
+type pendingEnrollment struct {
+	enrollment *TOTPEnrollment
+	started    time.Time
+}
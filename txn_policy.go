@@ -0,0 +1,230 @@
+package seven5
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/coocood/qbs"
+)
+
+const (
+	TXN_RETRY_BACKOFF = 20 * time.Millisecond
+)
+
+//TransactionPolicy decides how the QbsWrap* functions run each call in a
+//transaction.  StartTransaction begins it, HandleResult commits or rolls back
+//based on the result of the call and HandlePanic cleans up if the call
+//panics.  QbsDefaultOrmTransactionPolicy is the usual one.
+type TransactionPolicy interface {
+	StartTransaction(*qbs.Qbs) *qbs.Qbs
+	HandleResult(*qbs.Qbs, interface{}, error) (interface{}, error)
+	HandlePanic(*qbs.Qbs, interface{}) (interface{}, error)
+}
+
+//ReadTransactionPolicy is a TransactionPolicy that begins transactions for
+//calls that only read (Index and Find) differently.
+type ReadTransactionPolicy interface {
+	TransactionPolicy
+	StartReadTransaction(*qbs.Qbs) *qbs.Qbs
+}
+
+//RetryTransactionPolicy is a TransactionPolicy that can run a call again, in
+//a new transaction, when it fails with an error that ShouldRetry accepts.  The
+//attempt is 1 for the first failure.  ShouldRetry may sleep before returning
+//true.
+type RetryTransactionPolicy interface {
+	TransactionPolicy
+	ShouldRetry(attempt int, err error) bool
+}
+
+//WithPolicy returns a copy of the store that uses a different transaction
+//policy; give it to QbsWrap* to change the policy of a single resource.  The
+//copy shares the database of the store.
+func (self *QbsStore) WithPolicy(p TransactionPolicy) *QbsStore {
+	result := *self
+	result.Policy = p
+	return &result
+}
+
+//isPostgres is true when the qbs is using the postgres dialect.  Other
+//dialects don't understand SET TRANSACTION; sqlite transactions are always
+//serializable anyway.
+func isPostgres(q *qbs.Qbs) bool {
+	return dialectDriver(q.Dialect) == "postgres"
+}
+
+//setTransaction runs SET TRANSACTION with the characteristics given, which
+//must be the first statement of the transaction, or panics as
+//StartTransaction does.
+func setTransaction(tx *qbs.Qbs, characteristics string) {
+	if !isPostgres(tx) {
+		return
+	}
+	if _, err := tx.Exec("SET TRANSACTION " + characteristics); err != nil {
+		tx.Rollback()
+		panic(err)
+	}
+}
+
+//IsSerializationFailure returns true for the errors that mean a transaction
+//lost a race with another and can be tried again: serialization failures and
+//deadlocks in postgres, and a busy database in sqlite.
+func IsSerializationFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var state interface {
+		SQLState() string
+	}
+	if errors.As(err, &state) {
+		code := state.SQLState()
+		return code == "40001" || code == "40P01"
+	}
+	msg := err.Error()
+	for _, s := range []string{"could not serialize access", "deadlock detected", "database is locked"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+//QbsReadOnlyPolicy is the default policy except that Index and Find run in
+//read only transactions, so the database refuses (and can optimize for the
+//lack of) writes.
+type QbsReadOnlyPolicy struct {
+	*QbsDefaultOrmTransactionPolicy
+}
+
+//NewQbsReadOnlyPolicy returns a new QbsReadOnlyPolicy.
+func NewQbsReadOnlyPolicy() *QbsReadOnlyPolicy {
+	return &QbsReadOnlyPolicy{NewQbsDefaultOrmTransactionPolicy()}
+}
+
+//StartReadTransaction begins a read only transaction.
+func (self *QbsReadOnlyPolicy) StartReadTransaction(q *qbs.Qbs) *qbs.Qbs {
+	tx := self.StartTransaction(q)
+	setTransaction(tx, "READ ONLY")
+	return tx
+}
+
+//QbsSerializablePolicy is the default policy with serializable transactions,
+//which are run again (up to the number of attempts given) when they fail
+//because of a concurrent transaction.  The calls must therefore be safe to
+//repeat, which they are unless they have effects outside the database.
+type QbsSerializablePolicy struct {
+	*QbsDefaultOrmTransactionPolicy
+	attempts int
+	backoff  time.Duration
+}
+
+//NewQbsSerializablePolicy returns a policy that makes at most attempts tries
+//at each call.
+func NewQbsSerializablePolicy(attempts int) *QbsSerializablePolicy {
+	if attempts < 1 {
+		panic("a transaction needs at least one attempt")
+	}
+	return &QbsSerializablePolicy{
+		QbsDefaultOrmTransactionPolicy: NewQbsDefaultOrmTransactionPolicy(),
+		attempts:                       attempts,
+		backoff:                        TXN_RETRY_BACKOFF,
+	}
+}
+
+//SetBackoff sets how long to wait before the second attempt; each later
+//attempt waits longer.  The default is TXN_RETRY_BACKOFF.
+func (self *QbsSerializablePolicy) SetBackoff(d time.Duration) {
+	self.backoff = d
+}
+
+//StartTransaction begins a serializable transaction.
+func (self *QbsSerializablePolicy) StartTransaction(q *qbs.Qbs) *qbs.Qbs {
+	tx := self.QbsDefaultOrmTransactionPolicy.StartTransaction(q)
+	setTransaction(tx, "ISOLATION LEVEL SERIALIZABLE")
+	return tx
+}
+
+//ShouldRetry is true for serialization failures until the attempts are used.
+func (self *QbsSerializablePolicy) ShouldRetry(attempt int, err error) bool {
+	if attempt >= self.attempts || !IsSerializationFailure(err) {
+		return false
+	}
+	log.Printf("[TXN] serialization failure, retrying (attempt %d of %d): %v", attempt+1, self.attempts, err)
+	time.Sleep(time.Duration(attempt) * self.backoff)
+	return true
+}
+
+//runTransaction runs fn in a transaction of the store's policy, trying again
+//if the policy says so.  Calls that only read go to a replica, if the store
+//has one, unless the request asks to read its writes.
+func runTransaction(store *QbsStore, pb PBundle, read bool, fn func(*qbs.Qbs) (interface{}, error)) (interface{}, error) {
+	retry, _ := store.Policy.(RetryTransactionPolicy)
+	useReplica := read && !ReadYourWrites(pb)
+	for attempt := 1; ; attempt++ {
+		value, err, again := runTransactionOnce(store, read, useReplica, fn, retry, attempt)
+		if !again {
+			return value, err
+		}
+	}
+}
+
+func runTransactionOnce(store *QbsStore, read bool, useReplica bool, fn func(*qbs.Qbs) (interface{}, error), retry RetryTransactionPolicy, attempt int) (result_obj interface{}, result_error error, again bool) {
+	q, rep, err := store.route(useReplica)
+	if err != nil {
+		return nil, err, false
+	}
+	//a replica that can't be reached is skipped and the call made again
+	//elsewhere, which is safe since it only reads
+	defer func() {
+		if rep != nil && isUnavailable(result_error) {
+			rep.markDown(result_error)
+			result_obj, result_error, again = runTransactionOnce(store, read, useReplica, fn, retry, attempt)
+		}
+	}()
+	defer store.Release(q)
+
+	policy := store.Policy
+	tx, err := startTransaction(policy, q, read)
+	if err != nil {
+		return nil, err, false
+	}
+	defer func() {
+		if x := recover(); x != nil {
+			result_obj, result_error = policy.HandlePanic(tx, x)
+			again = false
+		}
+	}()
+	value, err := fn(tx)
+	if err != nil && retry != nil && retry.ShouldRetry(attempt, err) {
+		tx.Rollback()
+		return nil, nil, true
+	}
+	value, err = policy.HandleResult(tx, value, err)
+	if err != nil && retry != nil {
+		//the commit can fail too (it is where postgres often notices)
+		if _, ok := err.(*Error); !ok && retry.ShouldRetry(attempt, err) {
+			return nil, nil, true
+		}
+	}
+	return value, err, false
+}
+
+//startTransaction begins a transaction of the policy.  Policies panic if
+//they cannot, which is a 503 if the database could not be reached.
+func startTransaction(policy TransactionPolicy, q *qbs.Qbs, read bool) (tx *qbs.Qbs, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			e, ok := x.(error)
+			if !ok || !IsConnectivityFailure(e) {
+				panic(x)
+			}
+			err = DatabaseUnavailable(e)
+		}
+	}()
+	if rp, ok := policy.(ReadTransactionPolicy); ok && read {
+		return rp.StartReadTransaction(q), nil
+	}
+	return policy.StartTransaction(q), nil
+}
@@ -0,0 +1,91 @@
+package seven5
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/coocood/qbs"
+)
+
+//testPolicy records what the wrappers ask of it, without a real transaction.
+type testPolicy struct {
+	reads, writes, results, retries int
+}
+
+func (self *testPolicy) StartTransaction(q *qbs.Qbs) *qbs.Qbs {
+	self.writes++
+	return q
+}
+func (self *testPolicy) StartReadTransaction(q *qbs.Qbs) *qbs.Qbs {
+	self.reads++
+	return q
+}
+func (self *testPolicy) HandleResult(tx *qbs.Qbs, value interface{}, err error) (interface{}, error) {
+	self.results++
+	return value, err
+}
+func (self *testPolicy) HandlePanic(tx *qbs.Qbs, x interface{}) (interface{}, error) {
+	return nil, HTTPError(http.StatusInternalServerError, "panic")
+}
+func (self *testPolicy) ShouldRetry(attempt int, err error) bool {
+	if attempt < 3 && IsSerializationFailure(err) {
+		self.retries++
+		return true
+	}
+	return false
+}
+
+type testRaceObj struct {
+	testObj
+	failures int
+}
+
+func (self *testRaceObj) PutQbs(id int64, value interface{}, pb PBundle, q *qbs.Qbs) (interface{}, error) {
+	self.testCallCount++
+	if self.testCallCount <= self.failures {
+		return nil, errors.New("pq: could not serialize access due to concurrent update")
+	}
+	return &HouseWire{Id: id}, nil
+}
+
+func TestTransactionPolicy(t *testing.T) {
+	store := NewMemoryQbsStore()
+	defer store.Close()
+	policy := &testPolicy{}
+	obj := &testRaceObj{failures: 2}
+	wrapped := QbsWrapAll(obj, store.WithPolicy(policy))
+	if store.Policy == TransactionPolicy(policy) {
+		t.Fatalf("expected WithPolicy to leave the store alone")
+	}
+
+	wrapped.Index(nil)
+	wrapped.Find(1, nil)
+	if policy.reads != 2 || policy.writes != 0 {
+		t.Errorf("expected two read transactions, got %d reads and %d writes", policy.reads, policy.writes)
+	}
+
+	obj.testCallCount = 0
+	v, err := wrapped.Put(7, &HouseWire{}, nil)
+	if err != nil || v.(*HouseWire).Id != 7 {
+		t.Fatalf("expected put to succeed after retries, got %v %v", v, err)
+	}
+	if policy.retries != 2 || obj.testCallCount != 3 || policy.writes != 3 {
+		t.Errorf("expected 2 retries in 3 write transactions, got %d retries, %d calls, %d writes", policy.retries, obj.testCallCount, policy.writes)
+	}
+
+	obj.testCallCount, obj.failures, policy.retries = 0, 10, 0
+	if _, err := wrapped.Put(7, &HouseWire{}, nil); err == nil {
+		t.Errorf("expected put to fail once attempts ran out")
+	}
+	if policy.retries != 2 || obj.testCallCount != 3 {
+		t.Errorf("expected 3 attempts, got %d", obj.testCallCount)
+	}
+
+	if IsSerializationFailure(errors.New("duplicate key")) || !IsSerializationFailure(errors.New("database is locked")) {
+		t.Errorf("unexpected serialization failure detection")
+	}
+	if NewQbsSerializablePolicy(1).ShouldRetry(1, errors.New("could not serialize access")) {
+		t.Errorf("expected a single attempt policy not to retry")
+	}
+}